@@ -0,0 +1,171 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// hostAlias is an address the driver aliased on a host interface for a
+// jail, in the interface|address form of jail(8)
+type hostAlias struct {
+	iface string
+	ip    net.IP
+}
+
+func (a hostAlias) String() string {
+	return a.iface + "|" + a.ip.String()
+}
+
+func (a hostAlias) family() string {
+	if a.ip.To4() != nil {
+		return "inet"
+	}
+	return "inet6"
+}
+
+func parseAlias(s string) (hostAlias, error) {
+	parts := strings.SplitN(s, "|", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return hostAlias{}, fmt.Errorf("invalid alias %q", s)
+	}
+	// a prefix length is accepted but aliases always get a host mask, so
+	// they don't clash with the route of the primary address
+	ip := net.ParseIP(strings.SplitN(parts[1], "/", 2)[0])
+	if ip == nil {
+		return hostAlias{}, fmt.Errorf("invalid address in %q", s)
+	}
+	return hostAlias{iface: parts[0], ip: ip}, nil
+}
+
+// hostAddresses maps every address configured on the host to its interface
+func hostAddresses() (map[string]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make(map[string]string)
+	for _, iface := range ifaces {
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range ifaddrs {
+			if n, ok := a.(*net.IPNet); ok {
+				addrs[n.IP.String()] = iface.Name
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// createAliases takes over the interface|address entries of the ip4.addr
+// and ip6.addr params, which jail(8) would alias itself and leave behind
+// when the jail dies. The driver aliases them instead, leaving bare
+// addresses in params, and returns what it created so it can be removed
+// with the task. Addresses already configured on the host are refused.
+func createAliases(params map[string]string) ([]string, error) {
+	if params["vnet"] == "new" {
+		return nil, nil
+	}
+	existing, err := hostAddresses()
+	if err != nil {
+		return nil, fmt.Errorf("failed listing host addresses: %s", err)
+	}
+
+	var wanted []hostAlias
+	for _, param := range []string{"ip4.addr", "ip6.addr"} {
+		if len(params[param]) == 0 {
+			continue
+		}
+		var addrs []string
+		for _, entry := range strings.Split(params[param], ",") {
+			entry = strings.TrimSpace(entry)
+			if !strings.Contains(entry, "|") {
+				addrs = append(addrs, entry)
+				continue
+			}
+			a, err := parseAlias(entry)
+			if err != nil {
+				return nil, err
+			}
+			if iface, ok := existing[a.ip.String()]; ok {
+				return nil, fmt.Errorf("address %s is already configured on %s", a.ip, iface)
+			}
+			existing[a.ip.String()] = a.iface
+			wanted = append(wanted, a)
+			addrs = append(addrs, a.ip.String())
+		}
+		params[param] = strings.Join(addrs, ",")
+	}
+
+	var created []string
+	for _, a := range wanted {
+		if err := addAlias(a); err != nil {
+			removeAliases(created)
+			return nil, err
+		}
+		created = append(created, a.String())
+	}
+	return created, nil
+}
+
+func addAlias(a hostAlias) error {
+	prefix := "/32"
+	if a.family() == "inet6" {
+		prefix = "/128"
+	}
+	out, err := exec.Command("ifconfig", a.iface, a.family(), a.ip.String()+prefix, "alias").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to alias %s on %s: %s: %s", a.ip, a.iface, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// removeAliases removes aliases made by createAliases, skipping the ones
+// that are gone already. All of them are tried, the last error is returned.
+func removeAliases(aliases []string) error {
+	if len(aliases) == 0 {
+		return nil
+	}
+	existing, err := hostAddresses()
+	if err != nil {
+		return err
+	}
+	var last error
+	for _, s := range aliases {
+		a, err := parseAlias(s)
+		if err != nil {
+			last = err
+			continue
+		}
+		if existing[a.ip.String()] != a.iface {
+			continue
+		}
+		out, err := exec.Command("ifconfig", a.iface, a.family(), a.ip.String(), "-alias").CombinedOutput()
+		if err != nil {
+			last = fmt.Errorf("failed to remove alias %s from %s: %s: %s", a.ip, a.iface, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return last
+}
+
+// releaseAliases removes the aliases of the task, once
+func (h *taskHandle) releaseAliases() {
+	h.stateLock.Lock()
+	aliases := h.aliases
+	h.aliases = nil
+	h.stateLock.Unlock()
+
+	if err := removeAliases(aliases); err != nil {
+		h.logger.Warn("failed to remove task address aliases", "error", err)
+	}
+}
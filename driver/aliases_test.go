@@ -0,0 +1,86 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import "testing"
+
+func TestParseAlias(t *testing.T) {
+	cases := []struct {
+		in     string
+		want   string
+		family string
+		err    bool
+	}{
+		{"em0|10.0.0.5", "em0|10.0.0.5", "inet", false},
+		{"em0|10.0.0.5/24", "em0|10.0.0.5", "inet", false},
+		{"lo1|fd00::5/64", "lo1|fd00::5", "inet6", false},
+		{"10.0.0.5", "", "", true},
+		{"|10.0.0.5", "", "", true},
+		{"em0|", "", "", true},
+		{"em0|jail.example", "", "", true},
+	}
+	for _, c := range cases {
+		a, err := parseAlias(c.in)
+		if (err != nil) != c.err {
+			t.Errorf("parseAlias(%q) error = %v, want error %v", c.in, err, c.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if a.String() != c.want || a.family() != c.family {
+			t.Errorf("parseAlias(%q) = %s %s, want %s %s", c.in, a, a.family(), c.want, c.family)
+		}
+	}
+}
+
+func TestCreateAliasesLeavesBareAddresses(t *testing.T) {
+	params := map[string]string{"ip4.addr": "10.0.0.5, 10.0.0.6", "ip6.addr": "fd00::5"}
+	created, err := createAliases(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 0 {
+		t.Fatalf("created aliases %v for bare addresses", created)
+	}
+	if params["ip4.addr"] != "10.0.0.5,10.0.0.6" || params["ip6.addr"] != "fd00::5" {
+		t.Fatalf("addresses changed to %q %q", params["ip4.addr"], params["ip6.addr"])
+	}
+}
+
+func TestCreateAliasesRefusesHostAddresses(t *testing.T) {
+	existing, err := hostAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	iface, ok := existing["127.0.0.1"]
+	if !ok {
+		t.Skip("the host has no 127.0.0.1")
+	}
+	params := map[string]string{"ip4.addr": iface + "|127.0.0.1"}
+	if _, err := createAliases(params); err == nil {
+		t.Fatal("expected an error aliasing an address of the host")
+	}
+	if params["ip4.addr"] != iface+"|127.0.0.1" {
+		t.Fatalf("params changed to %q", params["ip4.addr"])
+	}
+
+	for _, bad := range []string{"em0|not-an-address", "|10.0.0.5"} {
+		if _, err := createAliases(map[string]string{"ip4.addr": bad}); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestCreateAliasesSkipsVnet(t *testing.T) {
+	params := map[string]string{"vnet": "new", "ip4.addr": "em0|127.0.0.1"}
+	created, err := createAliases(params)
+	if err != nil || len(created) != 0 {
+		t.Fatalf("vnet jails get no aliases, got %v %v", created, err)
+	}
+}
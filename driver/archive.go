@@ -0,0 +1,336 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// mediaTypeDockerManifestList is the docker multi platform manifest
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// mediaTypeDockerConfig and mediaTypeDockerLayer describe the blobs of a
+	// docker save archive
+	mediaTypeDockerConfig = "application/vnd.docker.container.image.v1+json"
+	mediaTypeDockerLayer  = "application/vnd.docker.image.rootfs.diff.tar"
+
+	// mediaTypeDockerLayerGzip is a compressed docker layer
+	mediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// dockerSaveManifest is an entry of the manifest.json of a docker save archive
+type dockerSaveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// resolveImagePath turns the image task option into an absolute path. Paths
+// may be file:// urls, and relative paths are looked up in the task
+// directory, where nomad downloads artifacts.
+func resolveImagePath(cfg *drivers.TaskConfig, image string) (string, error) {
+	path := strings.TrimPrefix(image, "file://")
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(cfg.TaskDir().Dir, path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("image %s not found: %s", image, err)
+	}
+	return filepath.Clean(path), nil
+}
+
+// importImage imports a docker save archive, or an OCI image layout held in
+// a directory or a tar archive, into the store and unpacks it. The names the
+// archive gives the image are tagged below import/<namespace>/, never in
+// the names pulled and built images share, and not at all without a
+// namespace.
+func (s *imageStore) importImage(ctx context.Context, path, namespace string) (*imageRecord, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := path
+	if !fi.IsDir() {
+		dir, err = ioutil.TempDir(filepath.Join(s.root, "tmp"), "import-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		if err := unpackArchive(ctx, path, dir); err != nil {
+			return nil, fmt.Errorf("failed reading image archive %s: %s", path, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); err == nil {
+		return s.importOCILayout(ctx, dir, namespace)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err == nil {
+		return s.importDockerSave(ctx, dir, namespace)
+	}
+	return nil, fmt.Errorf("%s is neither a docker save archive nor an OCI image layout", path)
+}
+
+// unpackArchive writes the regular files of the tar archive at path below
+// dir. Archives may be compressed like image layers.
+func unpackArchive(ctx context.Context, path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := decompressStream(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name, err := cleanEntryPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if len(name) == 0 || name == "." {
+			continue
+		}
+		dest := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// importOCILayout imports the first image manifest of an OCI image layout
+func (s *imageStore) importOCILayout(ctx context.Context, dir, namespace string) (*imageRecord, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(buf, &index); err != nil {
+		return nil, fmt.Errorf("failed decoding index.json: %s", err)
+	}
+
+	desc, err := findManifest(dir, index)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := layoutBlobPath(dir, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("manifest %s missing from image layout: %s", desc.Digest, err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("failed decoding manifest %s: %s", desc.Digest, err)
+	}
+
+	var layers []digest.Digest
+	for _, blob := range append([]ocispec.Descriptor{desc, manifest.Config}, manifest.Layers...) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		path, err := layoutBlobPath(dir, blob.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.importBlob(path, blob.Digest); err != nil {
+			return nil, err
+		}
+	}
+	for _, l := range manifest.Layers {
+		layers = append(layers, l.Digest)
+	}
+
+	img, err := s.createImage(desc.Digest, manifest.Config.Digest, layers)
+	if err != nil {
+		return nil, err
+	}
+	if ref, ok := desc.Annotations[ocispec.AnnotationRefName]; ok && len(namespace) > 0 {
+		if err := s.tag(importRef(namespace, ref), img.ID); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// findManifest returns the first image manifest of index, descending into
+// nested indexes.
+func findManifest(dir string, index ocispec.Index) (ocispec.Descriptor, error) {
+	for _, m := range index.Manifests {
+		switch m.MediaType {
+		case ocispec.MediaTypeImageManifest, mediaTypeDockerManifest:
+			return m, nil
+		case ocispec.MediaTypeImageIndex, mediaTypeDockerManifestList:
+			path, err := layoutBlobPath(dir, m.Digest)
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				return ocispec.Descriptor{}, fmt.Errorf("index %s missing from image layout: %s", m.Digest, err)
+			}
+			var nested ocispec.Index
+			if err := json.Unmarshal(buf, &nested); err != nil {
+				return ocispec.Descriptor{}, fmt.Errorf("failed decoding index %s: %s", m.Digest, err)
+			}
+			return findManifest(dir, nested)
+		}
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("no image manifest found in image layout")
+}
+
+// layoutBlobPath is the file of blob d in the image layout dir. Digests come
+// from the layout itself and are checked before they become a path.
+func layoutBlobPath(dir string, d digest.Digest) (string, error) {
+	if err := d.Validate(); err != nil {
+		return "", fmt.Errorf("invalid digest %q in image layout: %s", d, err)
+	}
+	return filepath.Join(dir, "blobs", d.Algorithm().String(), d.Hex()), nil
+}
+
+// importRef is the tag of an image imported as ref under namespace
+func importRef(namespace, ref string) string {
+	return "import/" + namespace + "/" + ref
+}
+
+// importDockerSave imports the first image of a docker save archive. Its
+// layers are uncompressed tars, a manifest referencing them is generated.
+func (s *imageStore) importDockerSave(ctx context.Context, dir, namespace string) (*imageRecord, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	var saved []dockerSaveManifest
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		return nil, fmt.Errorf("failed decoding manifest.json: %s", err)
+	}
+	if len(saved) == 0 {
+		return nil, fmt.Errorf("docker save archive holds no image")
+	}
+	if len(saved) > 1 {
+		s.logger.Warn("docker save archive holds several images, importing the first one", "tags", saved[0].RepoTags)
+	}
+	entry := saved[0]
+
+	config, err := s.importFile(dir, entry.Config, mediaTypeDockerConfig)
+	if err != nil {
+		return nil, err
+	}
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+	}
+	for _, l := range entry.Layers {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		layer, err := s.importFile(dir, l, mediaTypeDockerLayer)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+
+	manifestDigest, err := s.putManifest(mediaTypeDockerManifest, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var layers []digest.Digest
+	for _, l := range manifest.Layers {
+		layers = append(layers, l.Digest)
+	}
+	img, err := s.createImage(manifestDigest, config.Digest, layers)
+	if err != nil {
+		return nil, err
+	}
+	if len(namespace) == 0 {
+		return img, nil
+	}
+	for _, ref := range entry.RepoTags {
+		if err := s.tag(importRef(namespace, ref), img.ID); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// importBlob copies the file at path into the store, checking its digest
+func (s *imageStore) importBlob(path string, expected digest.Digest) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("blob %s missing from image layout: %s", expected, err)
+	}
+	defer f.Close()
+	if _, _, err := s.putBlob(f, expected); err != nil {
+		return fmt.Errorf("failed importing blob %s: %s", expected, err)
+	}
+	return nil
+}
+
+// importFile copies the file name of the archive unpacked in dir into the
+// store, describing it as a blob of mediaType.
+func (s *imageStore) importFile(dir, name, mediaType string) (ocispec.Descriptor, error) {
+	rel, err := cleanEntryPath(name)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	path := filepath.Join(dir, rel)
+	f, err := os.Open(path)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed reading %s: %s", path, err)
+	}
+	defer f.Close()
+	d, n, err := s.putBlob(f, "")
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed importing %s: %s", path, err)
+	}
+	return ocispec.Descriptor{MediaType: mediaType, Digest: d, Size: n}, nil
+}
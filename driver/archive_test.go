@@ -0,0 +1,322 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// archiveFile is a file of an image archive built by writeArchive
+type archiveFile struct {
+	name string
+	body []byte
+}
+
+// writeArchive writes a tar archive holding files to a temporary file
+func writeArchive(t *testing.T, files ...archiveFile) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// dockerSaveFiles returns the files of a docker save archive of an image
+// holding a single file
+func dockerSaveFiles(t *testing.T, content string, saved ...dockerSaveManifest) []archiveFile {
+	config := mustJSON(t, ocispec.Image{OS: "freebsd", Architecture: "amd64"})
+	return []archiveFile{
+		{"manifest.json", mustJSON(t, saved)},
+		{"config.json", config},
+		{"layer/layer.tar", testLayer(t, file("hello", content)).Bytes()},
+	}
+}
+
+func assertRootfsFile(t *testing.T, s *imageStore, img *imageRecord, name, want string) {
+	t.Helper()
+	buf, err := ioutil.ReadFile(filepath.Join(s.rootfsPath(img.ID), name))
+	if err != nil || string(buf) != want {
+		t.Fatalf("%s of the rootfs holds %q %v, want %q", name, buf, err, want)
+	}
+}
+
+func TestImportDockerSave(t *testing.T) {
+	s := testStore(t)
+	path := writeArchive(t, dockerSaveFiles(t, "world", dockerSaveManifest{
+		Config:   "config.json",
+		RepoTags: []string{"app:1.0"},
+		Layers:   []string{"layer/layer.tar"},
+	})...)
+
+	img, err := s.importImage(context.Background(), path, "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRootfsFile(t, s, img, "hello", "world")
+	if got, err := s.resolve("import/job/app:1.0"); err != nil || got.ID != img.ID {
+		t.Fatalf("app:1.0 doesn't resolve to the imported image: %v", err)
+	}
+	if _, err := s.resolve("app:1.0"); err == nil {
+		t.Fatal("an imported image must not take the names of pulled ones")
+	}
+	if len(img.Layers) != 1 {
+		t.Fatalf("image has %d layers, want 1", len(img.Layers))
+	}
+}
+
+func TestImportDockerSaveMultipleImages(t *testing.T) {
+	logs := &bytes.Buffer{}
+	s := testStore(t)
+	s.logger = hclog.New(&hclog.LoggerOptions{Output: logs, Level: hclog.Warn})
+
+	path := writeArchive(t, dockerSaveFiles(t, "first",
+		dockerSaveManifest{Config: "config.json", RepoTags: []string{"first:1"}, Layers: []string{"layer/layer.tar"}},
+		dockerSaveManifest{Config: "config.json", RepoTags: []string{"second:1"}, Layers: []string{"layer/layer.tar"}},
+	)...)
+	if _, err := s.importImage(context.Background(), path, "job"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "several images") {
+		t.Errorf("expected a warning about the other images, logged %q", logs.String())
+	}
+	if _, err := s.resolve("import/job/first:1"); err != nil {
+		t.Errorf("the first image should be imported: %s", err)
+	}
+	if _, err := s.resolve("import/job/second:1"); err == nil {
+		t.Error("only the first image should be imported")
+	}
+}
+
+func TestImportDockerSaveRejectsEscapes(t *testing.T) {
+	cases := []struct {
+		name     string
+		manifest dockerSaveManifest
+	}{
+		{"config", dockerSaveManifest{Config: "../outside/config.json", Layers: []string{"layer/layer.tar"}}},
+		{"layer", dockerSaveManifest{Config: "config.json", Layers: []string{"layer/../../outside/layer.tar"}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// the archive is unpacked in a directory of the store, put the
+			// files the manifest points at next to it
+			s := testStore(t)
+			outside := filepath.Join(s.root, "outside")
+			if err := os.MkdirAll(outside, 0755); err != nil {
+				t.Fatal(err)
+			}
+			files := dockerSaveFiles(t, "pwned", c.manifest)
+			for _, f := range files[1:] {
+				if err := ioutil.WriteFile(filepath.Join(outside, filepath.Base(f.name)), f.body, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			path := writeArchive(t, files...)
+			if _, err := s.importImage(context.Background(), path, "job"); err == nil {
+				t.Fatal("expected an error")
+			}
+			images, err := s.images()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(images) != 0 {
+				t.Fatalf("%d images were imported", len(images))
+			}
+		})
+	}
+}
+
+func TestImportArchiveRejectsDotDotEntries(t *testing.T) {
+	s := testStore(t)
+	files := dockerSaveFiles(t, "world", dockerSaveManifest{Config: "config.json", Layers: []string{"layer/layer.tar"}})
+	files = append(files, archiveFile{"../../escaped", []byte("pwned")})
+	if _, err := s.importImage(context.Background(), writeArchive(t, files...), "job"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := os.Stat(filepath.Join(s.root, "escaped")); !os.IsNotExist(err) {
+		t.Fatal("entry was written outside of the unpack directory")
+	}
+}
+
+// ociLayout writes an OCI image layout of an image holding a single file
+// to a temporary directory, returning it with the image manifest
+func ociLayout(t *testing.T, content string, annotations map[string]string) (string, ocispec.Descriptor) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeBlob := func(mediaType string, body []byte) ocispec.Descriptor {
+		d := digest.FromBytes(body)
+		if err := ioutil.WriteFile(filepath.Join(dir, "blobs", "sha256", d.Hex()), body, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return ocispec.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(body))}
+	}
+
+	config := writeBlob(ocispec.MediaTypeImageConfig, mustJSON(t, ocispec.Image{OS: "freebsd", Architecture: "amd64"}))
+	layer := writeBlob(ocispec.MediaTypeImageLayer, testLayer(t, file("hello", content)).Bytes())
+	manifest := writeBlob(ocispec.MediaTypeImageManifest, mustJSON(t, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	}))
+	manifest.Annotations = annotations
+
+	// nest the manifest in an index, like multi platform layouts do
+	nested := writeBlob(ocispec.MediaTypeImageIndex, mustJSON(t, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{manifest},
+	}))
+	index := ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}, Manifests: []ocispec.Descriptor{nested}}
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.json"), mustJSON(t, index), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ocispec.ImageLayoutFile), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, manifest
+}
+
+func TestImportOCILayout(t *testing.T) {
+	s := testStore(t)
+	dir, manifest := ociLayout(t, "world", map[string]string{ocispec.AnnotationRefName: "registry.local/app:2.0"})
+
+	img, err := s.importImage(context.Background(), dir, "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Manifest != manifest.Digest {
+		t.Errorf("image manifest is %s, want %s", img.Manifest, manifest.Digest)
+	}
+	assertRootfsFile(t, s, img, "hello", "world")
+	if _, err := s.resolve("import/job/registry.local/app:2.0"); err != nil {
+		t.Errorf("image isn't tagged with its ref name annotation: %s", err)
+	}
+}
+
+func TestImportOCILayoutArchive(t *testing.T) {
+	s := testStore(t)
+	dir, _ := ociLayout(t, "archived", nil)
+
+	var files []archiveFile
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files = append(files, archiveFile{"./" + rel, body})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := s.importImage(context.Background(), writeArchive(t, files...), "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRootfsFile(t, s, img, "hello", "archived")
+}
+
+func TestImportOCILayoutDigestMismatch(t *testing.T) {
+	s := testStore(t)
+	dir, manifest := ociLayout(t, "world", nil)
+	body, err := ioutil.ReadFile(filepath.Join(dir, "blobs", "sha256", manifest.Digest.Hex()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m ocispec.Manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		t.Fatal(err)
+	}
+	// replace the layer with another one under the same digest
+	tampered := testLayer(t, file("hello", "pwned")).Bytes()
+	if err := ioutil.WriteFile(filepath.Join(dir, "blobs", "sha256", m.Layers[0].Digest.Hex()), tampered, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.importImage(context.Background(), dir, "job"); err == nil {
+		t.Fatal("expected a digest mismatch")
+	}
+	if s.hasBlob(m.Layers[0].Digest) {
+		t.Fatal("tampered layer was stored")
+	}
+}
+
+func TestImportOCILayoutInvalidDigest(t *testing.T) {
+	s := testStore(t)
+	dir, _ := ociLayout(t, "world", nil)
+	index := ocispec.Index{Manifests: []ocispec.Descriptor{{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    "sha256:../../../../etc/passwd",
+	}}}
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.json"), mustJSON(t, index), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.importImage(context.Background(), dir, "job"); err == nil || !strings.Contains(err.Error(), "invalid digest") {
+		t.Fatalf("expected an invalid digest, got %v", err)
+	}
+}
+
+func TestImportImageUnknownFormat(t *testing.T) {
+	s := testStore(t)
+	path := writeArchive(t, archiveFile{"README", []byte("not an image")})
+	if _, err := s.importImage(context.Background(), path, "job"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
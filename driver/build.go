@@ -0,0 +1,387 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Build implements the build command. It builds the Jailfile of a context
+// directory into an image of the local store, tagged so jobs can use it as
+// their image.
+func Build(args []string) int {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	file := flags.String("f", "", "path of the Jailfile, defaults to Jailfile in the context directory")
+	tag := flags.String("t", "", "name:tag of the built image")
+	push := flags.Bool("push", false, "push the image to the registry named by the tag")
+	config := storeFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s build [options] [context]\n\n", pluginName)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(*tag) == 0 || flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	contextDir := "."
+	if flags.NArg() == 1 {
+		contextDir = flags.Arg(0)
+	}
+	if len(*file) == 0 {
+		*file = filepath.Join(contextDir, "Jailfile")
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	d, err := newCommandDriver(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	img, err := d.build(ctx, *file, contextDir, *tag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Built %s %s\n", *tag, img.ID)
+	if *push {
+		if err := d.pushTag(ctx, *tag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		fmt.Printf("Pushed %s\n", parseImageRef(*tag))
+	}
+	return 0
+}
+
+// build builds the Jailfile at file and tags the result. Every instruction
+// runs on one copy of the base image, and the changes they make become a
+// single layer on top of it.
+func (d *Driver) build(ctx context.Context, file, contextDir, tag string) (*imageRecord, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	instructions, err := parseJailfile(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	contextDir, err = filepath.Abs(contextDir)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := d.resolveBase(ctx, instructions[0].Args, contextDir)
+	if err != nil {
+		return nil, fmt.Errorf("FROM %s: %s", instructions[0].Args, err)
+	}
+	image, err := d.images.imageConfig(base)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &builder{
+		ctx:        ctx,
+		contextDir: contextDir,
+		name:       fmt.Sprintf("build-%d", os.Getpid()),
+		linux:      image.OS == "linux",
+		config:     image.Config,
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+	}
+	var steps []string
+	for _, i := range instructions {
+		steps = append(steps, i.Cmd+" "+i.Args)
+	}
+
+	img, err := d.images.deriveImage(base, strings.Join(steps, "; "), b.run(instructions[1:]), func(config *ocispec.Image) {
+		now := time.Now().UTC()
+		config.Created = &now
+		config.Config = b.config
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := d.images.tag(tag, img.ID); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// resolveBase finds the image a FROM instruction names. It is a FreeBSD
+// release like 14.1-RELEASE, an image of the store, an image archive in the
+// context directory, or an image to pull from a registry.
+func (d *Driver) resolveBase(ctx context.Context, from, contextDir string) (*imageRecord, error) {
+	if releaseRegexp.MatchString(from) {
+		return d.pullRelease(ctx, commandReporter("Downloading"), from, nil)
+	}
+	if img, err := d.images.resolve(from); err == nil {
+		return img, nil
+	}
+
+	path := strings.TrimPrefix(from, "file://")
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(contextDir, path)
+	}
+	if _, err := os.Stat(path); err == nil {
+		return d.images.importImage(ctx, path, "")
+	}
+
+	ref := parseImageRef(from)
+	return d.images.coalesce(ctx, "pull:"+ref.String(), commandReporter("Downloading"), func(ctx context.Context, report func(pullProgress)) (*imageRecord, error) {
+		return d.registry.pull(ctx, d.images, ref, report)
+	})
+}
+
+// builder runs the instructions of a Jailfile on the rootfs being built
+type builder struct {
+	ctx        context.Context
+	contextDir string
+
+	// name is the jail RUN instructions are executed in
+	name  string
+	linux bool
+
+	// config is the image config as amended by the instructions
+	config ocispec.ImageConfig
+
+	// mounts are the filesystems mounted for the build jail
+	mounts []string
+
+	// resolvConf is the resolv.conf of the host copied for the build
+	resolvConf string
+
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// run returns the build func executing instructions on the rootfs at root
+func (b *builder) run(instructions []jailfileInstruction) func(root string) error {
+	return func(root string) error {
+		var started bool
+		defer func() {
+			if started {
+				b.stopJail()
+			}
+		}()
+
+		for _, i := range instructions {
+			fmt.Fprintf(b.stdout, "Step %s %s\n", i.Cmd, i.Args)
+			var err error
+			switch i.Cmd {
+			case "RUN":
+				if !started {
+					if err := b.startJail(root); err != nil {
+						return err
+					}
+					started = true
+				}
+				err = b.exec(root, i.Args)
+			case "COPY":
+				err = b.copy(root, i.Args)
+			case "ENV":
+				var env []string
+				if env, err = parseEnv(i.Args); err == nil {
+					b.config.Env = setEnv(b.config.Env, env)
+				}
+			case "WORKDIR":
+				dir := i.Args
+				if !path.IsAbs(dir) {
+					dir = path.Join("/", b.config.WorkingDir, dir)
+				}
+				b.config.WorkingDir = path.Clean(dir)
+				var resolved string
+				if resolved, err = secureDir(root, dir); err == nil {
+					err = os.MkdirAll(resolved, 0755)
+				}
+			case "USER":
+				b.config.User = i.Args
+			case "CMD":
+				b.config.Cmd, err = commandArgv(i.Args)
+			}
+			if err != nil {
+				return fmt.Errorf("line %d: %s failed: %s", i.Line, i.Cmd, err)
+			}
+		}
+		return nil
+	}
+}
+
+// startJail creates the jail RUN instructions are executed in. It shares
+// the network of the host, so packages can be fetched.
+func (b *builder) startJail(root string) error {
+	params := []string{
+		"-c",
+		"name=" + b.name,
+		"path=" + root,
+		"host.hostname=" + b.name,
+		"ip4=inherit",
+		"ip6=inherit",
+		"allow.raw_sockets",
+		"persist",
+	}
+	if b.linux {
+		if err := ensureLinuxABI(); err != nil {
+			return err
+		}
+		mounted, err := mountAll(root, linuxMounts(TaskConfig{}), defaultDevfsRuleset)
+		if err != nil {
+			return err
+		}
+		b.mounts = mounted
+		params = append(params, "linux=new", "linux.osname=Linux")
+		if release := linuxOsrelease(); len(release) > 0 {
+			params = append(params, "linux.osrelease="+release)
+		}
+	} else {
+		params = append(params, "mount.devfs", "devfs_ruleset="+defaultDevfsRuleset)
+	}
+
+	// name resolution for the build, removed again before the layer is
+	// created unless the image has its own resolv.conf
+	if resolv, err := securePath(root, "/etc/resolv.conf"); err == nil {
+		if _, err := os.Lstat(resolv); os.IsNotExist(err) {
+			if err := copyFile("/etc/resolv.conf", resolv); err == nil {
+				os.Chmod(resolv, 0644)
+				b.resolvConf = resolv
+			}
+		}
+	}
+
+	out, err := exec.Command("jail", params...).CombinedOutput()
+	if err != nil {
+		b.stopJail()
+		return fmt.Errorf("failed creating build jail: %s %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// stopJail removes the build jail and everything mounted for it
+func (b *builder) stopJail() {
+	exec.Command("jail", "-r", b.name).Run()
+	unmountAll(b.mounts)
+	b.mounts = nil
+	if len(b.resolvConf) > 0 {
+		os.Remove(b.resolvConf)
+		b.resolvConf = ""
+	}
+}
+
+// exec executes a RUN instruction in the build jail, as the user and with
+// the environment and working directory set so far.
+func (b *builder) exec(root, args string) error {
+	argv, err := commandArgv(args)
+	if err != nil {
+		return err
+	}
+	jexec := []string{}
+	if len(b.config.User) > 0 {
+		user, err := jailUser(root, b.config.User)
+		if err != nil {
+			return err
+		}
+		jexec = append(jexec, "-U", user)
+	}
+	config := b.config
+	if len(config.Env) == 0 {
+		config.Env = []string{"PATH=/sbin:/bin:/usr/sbin:/usr/bin:/usr/local/sbin:/usr/local/bin"}
+	}
+	jexec = append(jexec, b.name, "/bin/sh", "-c", startCommand(&config, nil, argv))
+
+	cmd := exec.CommandContext(b.ctx, "jexec", jexec...)
+	cmd.Stdout = b.stdout
+	cmd.Stderr = b.stderr
+	return cmd.Run()
+}
+
+// copy executes a COPY instruction. Sources are relative to the context
+// directory, symlinks in them are followed without leaving it, and copied
+// owned by root. Directories have their content copied, and files are
+// copied into dest when it is a directory.
+func (b *builder) copy(root, args string) error {
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		return fmt.Errorf("COPY needs a source and a destination")
+	}
+	srcs, dest := fields[:len(fields)-1], fields[len(fields)-1]
+	toDir := strings.HasSuffix(dest, "/") || len(srcs) > 1
+	if !path.IsAbs(dest) {
+		dest = path.Join("/", b.config.WorkingDir, dest)
+	}
+
+	for _, s := range srcs {
+		src, err := secureDir(b.contextDir, s)
+		if err != nil {
+			return fmt.Errorf("COPY source %s: %s", s, err)
+		}
+		fi, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+
+		target := dest
+		if !fi.IsDir() {
+			if resolved, err := secureDir(root, dest); err == nil {
+				if dfi, err := os.Stat(resolved); err == nil && dfi.IsDir() {
+					toDir = true
+				}
+			}
+			if toDir {
+				target = path.Join(dest, path.Base(path.Clean("/"+s)))
+			}
+		}
+		// a directory target that is a link of the image is followed inside
+		// of root, links below it are refused by copyTree rather than
+		// merged into
+		resolve := securePath
+		if fi.IsDir() {
+			resolve = secureDir
+		}
+		resolved, err := resolve(root, target)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(resolved), 0755); err != nil {
+			return err
+		}
+		if err := copyTree(src, resolved); err != nil {
+			return err
+		}
+		err = filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src, p)
+			if err != nil {
+				return err
+			}
+			return os.Lchown(filepath.Join(resolved, rel), 0, 0)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
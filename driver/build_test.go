@@ -0,0 +1,130 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testContext returns a build context holding app.conf and links pointing
+// inside and outside of it, together with an empty rootfs
+func testContext(t *testing.T) (b *builder, root, outside string) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("COPY chowns files to root")
+	}
+	root, outside = testRoot(t)
+	contextDir := filepath.Join(filepath.Dir(root), "context")
+	for _, dir := range []string{root, filepath.Join(contextDir, "conf.d")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, body := range map[string]string{"app.conf": "app", "conf.d/extra.conf": "extra"} {
+		if err := ioutil.WriteFile(filepath.Join(contextDir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"current": "app.conf",
+		"up":      "../outside",
+		"secret":  "../outside/secret",
+		"host":    outside,
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(contextDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &builder{contextDir: contextDir}, root, outside
+}
+
+func TestBuilderCopy(t *testing.T) {
+	cases := []struct {
+		args string
+		file string
+		want string
+	}{
+		{"app.conf /etc/app.conf", "etc/app.conf", "app"},
+		{"app.conf /etc/", "etc/app.conf", "app"},
+		{"current /etc/", "etc/current", "app"},
+		{"conf.d /etc/conf.d", "etc/conf.d/extra.conf", "extra"},
+		{"./conf.d/../app.conf /app.conf", "app.conf", "app"},
+	}
+	for _, c := range cases {
+		b, root, _ := testContext(t)
+		if err := b.copy(root, c.args); err != nil {
+			t.Errorf("COPY %s: %s", c.args, err)
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(root, c.file))
+		if err != nil || string(buf) != c.want {
+			t.Errorf("COPY %s: %s holds %q %v, want %q", c.args, c.file, buf, err, c.want)
+		}
+	}
+}
+
+func TestBuilderCopyStaysInContext(t *testing.T) {
+	for _, args := range []string{
+		"../outside/secret /secret",
+		"up/secret /secret",
+		"secret /secret",
+		"host/secret /secret",
+		"up /dir",
+	} {
+		b, root, outside := testContext(t)
+		if err := b.copy(root, args); err == nil {
+			t.Errorf("COPY %s: expected an error", args)
+		}
+		assertOutsideIntact(t, outside)
+		for _, p := range []string{"secret", "dir/secret"} {
+			if _, err := os.Lstat(filepath.Join(root, p)); err == nil {
+				t.Errorf("COPY %s: copied a file from outside of the context", args)
+			}
+		}
+	}
+}
+
+func TestBuilderCopyRefusesImageLinks(t *testing.T) {
+	b, root, outside := testContext(t)
+	if err := os.MkdirAll(filepath.Join(b.contextDir, "conf.d/sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(b.contextDir, "conf.d/sub/sub.conf"), []byte("sub"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// links planted by the image or an earlier RUN
+	if err := os.MkdirAll(filepath.Join(root, "etc/conf.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "etc/conf.d/sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "etc/conf.d/extra.conf")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.copy(root, "conf.d /etc/conf.d"); err == nil {
+		t.Fatal("expected an error copying into a link")
+	}
+	assertOutsideIntact(t, outside)
+	assertFile(t, filepath.Join(outside, "secret"), "secret")
+
+	// the target itself is followed inside of the rootfs
+	if err := os.Symlink(outside, filepath.Join(root, "srv")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.copy(root, "conf.d /srv"); err != nil {
+		t.Fatal(err)
+	}
+	assertOutsideIntact(t, outside)
+	assertFile(t, filepath.Join(root, outside, "sub/sub.conf"), "sub")
+}
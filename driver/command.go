@@ -0,0 +1,142 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	units "github.com/docker/go-units"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+const (
+	// defaultImageDir is the image store of the plugin unless configured
+	// otherwise
+	defaultImageDir = "/var/db/jail-task-driver"
+)
+
+// storeFlags registers the flags locating the image store of the plugin on
+// the node. They must match the plugin config for jobs to see the images.
+func storeFlags(flags *flag.FlagSet) *Config {
+	config := &Config{
+		Pull: PullConfig{Timeout: "10m", Retries: 3, Backoff: "2s"},
+	}
+	flags.StringVar(&config.ImageDir, "image-dir", defaultImageDir, "image store directory, the image_dir of the plugin")
+	flags.StringVar(&config.Storage, "storage", "dir", "storage backend of the image store, dir or zfs")
+	flags.StringVar(&config.ZfsDataset, "zfs-dataset", "", "parent dataset of the zfs storage backend")
+	flags.StringVar(&config.ReleaseMirror, "release-mirror", defaultReleaseMirror, "url or directory FreeBSD releases are fetched from")
+	return config
+}
+
+// newCommandDriver returns a driver working on the image store of config,
+// for the commands run outside of nomad.
+func newCommandDriver(config *Config) (*Driver, error) {
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:   pluginName,
+		Level:  hclog.Warn,
+		Output: os.Stderr,
+	})
+	d := NewJailDriver(logger).(*Driver)
+	d.config = config
+	if err := d.openImageStore(*config); err != nil {
+		return nil, err
+	}
+	d.registry.credentials = dockerCredentials()
+	return d, nil
+}
+
+// commandReporter prints the progress of the downloads or uploads of the
+// commands
+func commandReporter(verb string) func(pullProgress) {
+	return func(p pullProgress) {
+		msg := fmt.Sprintf("%s %s layer %s: %s", verb, p.Ref, p.shortBlob(), units.HumanSize(float64(p.Done)))
+		if p.Total > 0 {
+			msg += " of " + units.HumanSize(float64(p.Total))
+		}
+		fmt.Fprintln(os.Stderr, msg)
+	}
+}
+
+// pushTag uploads the image tagged tag in the store to the registry the tag
+// names
+func (d *Driver) pushTag(ctx context.Context, tag string) error {
+	img, err := d.images.resolve(tag)
+	if err != nil {
+		return err
+	}
+	ref := parseImageRef(tag)
+	if err := d.registry.push(ctx, d.images, img, ref, commandReporter("Uploading")); err != nil {
+		return fmt.Errorf("failed pushing %s: %s", ref, err)
+	}
+	return nil
+}
+
+// Push implements the push command. It uploads an image of the local store
+// to a registry, under the name it is tagged with or another one.
+func Push(args []string) int {
+	flags := flag.NewFlagSet("push", flag.ContinueOnError)
+	config := storeFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s push [options] <name:tag> [<registry/name:tag>]\n\n", pluginName)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return 2
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	d, err := newCommandDriver(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	tag := flags.Arg(0)
+	if flags.NArg() == 2 {
+		img, err := d.images.resolve(tag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		tag = flags.Arg(1)
+		if err := d.images.tag(tag, img.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+	}
+	if err := d.pushTag(ctx, tag); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Pushed %s\n", parseImageRef(tag))
+	return 0
+}
+
+// commandContext is canceled when the command is interrupted
+func commandContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,196 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// containerRecord links the rootfs of a task to the image it was created
+// from, so the task can be committed from outside of the plugin.
+type containerRecord struct {
+	Image  string `json:"image"`
+	Rootfs string `json:"rootfs"`
+
+	// Owned is set when the rootfs was created in the Path of the task,
+	// which the driver removes with the task. Those in the task directory
+	// are cleaned up by nomad.
+	Owned bool `json:"owned,omitempty"`
+}
+
+func (s *imageStore) containerPath(name string) string {
+	return filepath.Join(s.root, "containers", name+".json")
+}
+
+// writeContainer records the rootfs of the jail name
+func (s *imageStore) writeContainer(name string, c containerRecord) error {
+	if err := os.MkdirAll(filepath.Join(s.root, "containers"), 0700); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.containerPath(name), buf, 0600)
+}
+
+// removeContainer drops the record of the jail name
+func (s *imageStore) removeContainer(name string) error {
+	err := os.Remove(s.containerPath(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// findContainer finds the task of an allocation, accepting a prefix of the
+// allocation id like nomad does. It returns the jail name and its record.
+func (s *imageStore) findContainer(allocID, task string) (string, *containerRecord, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.root, "containers"))
+	if err != nil && !os.IsNotExist(err) {
+		return "", nil, err
+	}
+	var matches []string
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".json")
+		if strings.HasSuffix(e.Name(), ".json") && strings.HasPrefix(name, task+"-"+allocID) {
+			matches = append(matches, name)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		// tasks using Path or the task directory have no record, there is
+		// no image to diff their rootfs against
+		return "", nil, fmt.Errorf("no task %s of allocation %s created from an image on this node, commit requires an image-backed task", task, allocID)
+	case 1:
+	default:
+		return "", nil, fmt.Errorf("allocation id %s is ambiguous", allocID)
+	}
+
+	c, err := s.container(matches[0])
+	if err != nil {
+		return "", nil, err
+	}
+	return matches[0], c, nil
+}
+
+// container reads the record of the jail name
+func (s *imageStore) container(name string) (*containerRecord, error) {
+	buf, err := ioutil.ReadFile(s.containerPath(name))
+	if err != nil {
+		return nil, err
+	}
+	var c containerRecord
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return nil, fmt.Errorf("corrupt task record %s: %s", name, err)
+	}
+	return &c, nil
+}
+
+// ownsRootfs tells whether path is the rootfs the driver created in the
+// Path of the jail name
+func (s *imageStore) ownsRootfs(name, path string) bool {
+	c, err := s.container(name)
+	return err == nil && c.Owned && filepath.Clean(c.Rootfs) == filepath.Clean(path)
+}
+
+// commitContainer creates an image from the rootfs of the jail name, made
+// of its image plus a layer holding the changes made by the task. Clones
+// are snapshotted first, otherwise the live rootfs is read, leaving out
+// pseudo filesystems like devfs.
+func (s *imageStore) commitContainer(name string, c *containerRecord, comment string) (*imageRecord, error) {
+	base, err := s.image(c.Image)
+	if err != nil {
+		return nil, fmt.Errorf("image %s of %s is no longer in the store: %s", c.Image, name, err)
+	}
+	lower, err := s.backend.BasePath(base)
+	if err != nil {
+		return nil, err
+	}
+
+	upper, discard, err := s.backend.SnapshotRootfs(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot %s: %s", name, err)
+	}
+	defer discard()
+	var skip map[string]bool
+	if len(upper) == 0 {
+		upper = c.Rootfs
+		if skip, err = pseudoMounts(upper); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.commitLayer(base, lower, upper, skip, "commit "+name, func(config *ocispec.Image) {
+		now := time.Now().UTC()
+		config.Created = &now
+		config.History[len(config.History)-1].Created = &now
+		config.History[len(config.History)-1].Comment = comment
+	})
+}
+
+// Commit implements the commit command. It captures the rootfs of a task
+// running on the node into an image of the local store.
+func Commit(args []string) int {
+	flags := flag.NewFlagSet("commit", flag.ContinueOnError)
+	message := flags.String("m", "", "comment recorded in the image history")
+	push := flags.Bool("push", false, "push the image to the registry named by the tag")
+	config := storeFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s commit [options] <alloc id> <task> <name:tag>\n\n", pluginName)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 3 {
+		flags.Usage()
+		return 2
+	}
+	allocID, task, tag := flags.Arg(0), flags.Arg(1), flags.Arg(2)
+
+	d, err := newCommandDriver(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	name, c, err := d.images.findContainer(allocID, task)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	img, err := d.images.commitContainer(name, c, *message)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	if err := d.images.tag(tag, img.ID); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Committed %s %s\n", tag, img.ID)
+	if *push {
+		ctx, cancel := commandContext()
+		defer cancel()
+		if err := d.pushTag(ctx, tag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		fmt.Printf("Pushed %s\n", parseImageRef(tag))
+	}
+	return 0
+}
@@ -0,0 +1,111 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestFindContainer(t *testing.T) {
+	s := testStore(t)
+	for _, name := range []string{"web-8a1e0c2f-1111", "web-8a1e9999-2222", "db-8a1e0c2f-1111"} {
+		if err := s.writeContainer(name, containerRecord{Image: "img-" + name, Rootfs: "/jails/" + name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	name, c, err := s.findContainer("8a1e0c2f", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "web-8a1e0c2f-1111" || c.Image != "img-web-8a1e0c2f-1111" {
+		t.Errorf("found %s created from %s", name, c.Image)
+	}
+
+	if _, _, err := s.findContainer("8a1e", "web"); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("expected an ambiguous allocation id, got %v", err)
+	}
+	// tasks using Path have no record
+	if _, _, err := s.findContainer("8a1e0c2f", "cache"); err == nil || !strings.Contains(err.Error(), "image-backed") {
+		t.Errorf("expected an image-backed task to be required, got %v", err)
+	}
+}
+
+func TestCommitLayer(t *testing.T) {
+	s := testStore(t)
+	base := gcImage(t, s, "base", time.Now())
+	lower, err := s.backend.BasePath(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "commit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	rootfs := filepath.Join(tmp, "rootfs")
+	if _, err := s.backend.CreateRootfs(base, "task", rootfs); err != nil {
+		t.Fatal(err)
+	}
+
+	// what the task changed
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "added"), []byte("added"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(rootfs, "shared")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(rootfs, "dev"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "dev/null"), []byte("devfs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := s.commitLayer(base, lower, rootfs, map[string]bool{"dev": true}, "commit task", func(config *ocispec.Image) {
+		config.History[len(config.History)-1].Comment = "message"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Layers) != len(base.Layers)+1 || !reflect.DeepEqual(img.Layers[:len(base.Layers)], base.Layers) {
+		t.Fatalf("layers %v on top of %v", img.Layers, base.Layers)
+	}
+
+	buf, err := s.readBlob(img.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(buf, &config); err != nil {
+		t.Fatal(err)
+	}
+	last := config.History[len(config.History)-1]
+	if last.CreatedBy != "commit task" || last.Comment != "message" || len(config.RootFS.DiffIDs) != 1 {
+		t.Errorf("config %+v", config)
+	}
+
+	// the committed image holds the changes, but not the pseudo filesystem
+	committed, err := s.backend.BasePath(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"base": strings.Repeat("base", 1024), "added": "added"}
+	if got := treeContent(t, committed); !reflect.DeepEqual(got, want) {
+		t.Errorf("committed rootfs %v, want %v", got, want)
+	}
+}
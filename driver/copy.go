@@ -0,0 +1,137 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// copyTree copies the directory tree at src into dst, preserving ownership,
+// modes, times, symlinks and hard links. Existing directories in dst are
+// merged into, any other existing entry on the way is refused rather than
+// followed, so a link left in dst can't redirect the copy out of it.
+func copyTree(src, dst string) error {
+	type dirTimes struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTimes
+	links := make(map[inodeKey]string)
+
+	err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("unsupported file info for %s", p)
+		}
+		mode := fi.Mode()
+
+		switch {
+		case mode.IsDir():
+			if err := os.Mkdir(target, 0700); err != nil {
+				if !os.IsExist(err) {
+					return err
+				}
+				if tfi, err := os.Lstat(target); err != nil || !tfi.IsDir() {
+					return fmt.Errorf("%s exists and is not a directory", target)
+				}
+			}
+
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			return os.Lchown(target, int(st.Uid), int(st.Gid))
+
+		case mode.IsRegular():
+			key := inodeKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+			if uint64(st.Nlink) > 1 {
+				if first, ok := links[key]; ok {
+					os.Remove(target)
+					return os.Link(first, target)
+				}
+				links[key] = target
+			}
+			os.Remove(target)
+			if err := copyFile(p, target); err != nil {
+				return err
+			}
+
+		case mode&os.ModeNamedPipe != 0:
+			os.Remove(target)
+			if err := syscall.Mkfifo(target, uint32(mode.Perm())); err != nil {
+				return err
+			}
+
+		default:
+			// sockets and device nodes are not part of a rootfs
+			return nil
+		}
+
+		if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+		if err := os.Chmod(target, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+		if mode.IsDir() {
+			dirs = append(dirs, dirTimes{path: target, mtime: fi.ModTime()})
+			return nil
+		}
+		return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
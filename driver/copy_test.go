@@ -0,0 +1,70 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyTreeRefusesLinks(t *testing.T) {
+	root, outside := testRoot(t)
+	src := filepath.Join(filepath.Dir(root), "src")
+	if err := extractLayer(testLayer(t, dir("usr"), file("usr/secret", "image")), src); err != nil {
+		t.Fatal(err)
+	}
+
+	// a jail that ran in root left a link out of it
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../outside", filepath.Join(root, "usr")); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyTree(src, root); err == nil {
+		t.Fatal("expected an error copying through a link")
+	}
+	assertOutsideIntact(t, outside)
+}
+
+func TestCreateRootfsIsFresh(t *testing.T) {
+	s := testStore(t)
+	root, outside := testRoot(t)
+	img := &imageRecord{ID: "0123abcd"}
+	if err := extractLayer(testLayer(t, dir("usr"), file("usr/secret", "image"), file("bin", "bin")), s.rootfsPath(img.ID)); err != nil {
+		t.Fatal(err)
+	}
+
+	// what the jail left behind from an earlier start, next to a directory
+	// nomad created
+	for _, d := range []string{root, filepath.Join(root, "local")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../outside", filepath.Join(root, "usr")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../outside/secret", filepath.Join(root, "bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.backend.CreateRootfs(img, "task", root); err != nil {
+		t.Fatal(err)
+	}
+	assertOutsideIntact(t, outside)
+	if buf, err := ioutil.ReadFile(filepath.Join(outside, "secret")); err != nil || string(buf) != "secret" {
+		t.Fatalf("outside file was written: %q", buf)
+	}
+	tree := treeContent(t, root)
+	if tree["usr"] != "/" || tree["usr/secret"] != "image" || tree["bin"] != "bin" || tree["local"] != "/" {
+		t.Fatalf("got %v", tree)
+	}
+}
@@ -0,0 +1,344 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// managedFilesLabel lists the files of the image the driver must leave
+	// alone, like "/etc/resolv.conf /etc/hosts"
+	managedFilesLabel = "org.jail-task-driver.managed"
+
+	generatedHeader = "# Generated by jail-task-driver\n"
+)
+
+// hostResolvConf is where the servers of the host are read from
+var hostResolvConf = "/etc/resolv.conf"
+
+// DNSConfig is the dns block of a task, or the defaults of the plugin
+type DNSConfig struct {
+	Servers  []string `codec:"servers"`
+	Searches []string `codec:"searches"`
+	Options  []string `codec:"options"`
+}
+
+func (c DNSConfig) enabled() bool {
+	return len(c.Servers) > 0 || len(c.Searches) > 0 || len(c.Options) > 0
+}
+
+// resolveDNS fills the fields the task leaves empty from the plugin
+// defaults, and those still empty from the resolv.conf of the host
+func resolveDNS(task, defaults DNSConfig) (DNSConfig, error) {
+	c := task
+	if len(c.Servers) == 0 {
+		c.Servers = defaults.Servers
+	}
+	if len(c.Searches) == 0 {
+		c.Searches = defaults.Searches
+	}
+	if len(c.Options) == 0 {
+		c.Options = defaults.Options
+	}
+	if len(c.Servers) == 0 {
+		f, err := os.Open(hostResolvConf)
+		if err != nil {
+			return DNSConfig{}, fmt.Errorf("no dns servers configured and %s can't be read: %s", hostResolvConf, err)
+		}
+		host := parseResolvConf(f)
+		f.Close()
+		c.Servers = host.Servers
+		if len(c.Searches) == 0 {
+			c.Searches = host.Searches
+		}
+		if len(c.Options) == 0 {
+			c.Options = host.Options
+		}
+	}
+
+	for _, s := range c.Servers {
+		if net.ParseIP(s) == nil {
+			return DNSConfig{}, fmt.Errorf("invalid dns server %q", s)
+		}
+	}
+	return c, nil
+}
+
+// checkDNS refuses a dns block for a jail of a Path, the driver only
+// writes in the rootfs it created, never in a Path that may be shared
+func checkDNS(c TaskConfig) error {
+	if !c.DNS.enabled() || len(c.Path) == 0 || c.Ephemeral {
+		return nil
+	}
+	if len(c.Image) != 0 || len(c.Docker) != 0 || len(c.BaseRelease) != 0 {
+		return nil
+	}
+	return fmt.Errorf("dns with Path requires ephemeral, the driver doesn't write in a Path it didn't create")
+}
+
+// parseResolvConf reads the servers, search domains and options of a
+// resolv.conf. Loopback servers are left out, in a jail they are the jail
+// itself rather than the resolver of the host.
+func parseResolvConf(r io.Reader) DNSConfig {
+	var c DNSConfig
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if ip := net.ParseIP(fields[1]); ip != nil && !ip.IsLoopback() {
+				c.Servers = append(c.Servers, fields[1])
+			}
+		case "domain", "search":
+			// the last of them wins, like in the resolver
+			c.Searches = fields[1:]
+		case "options":
+			c.Options = append(c.Options, fields[1:]...)
+		}
+	}
+	return c
+}
+
+func renderResolvConf(c DNSConfig) string {
+	var b strings.Builder
+	b.WriteString(generatedHeader)
+	if len(c.Searches) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(c.Searches, " "))
+	}
+	for _, s := range c.Servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s)
+	}
+	if len(c.Options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(c.Options, " "))
+	}
+	return b.String()
+}
+
+// dnsFiles is how a task is known to /etc/hosts, and whether the driver
+// generates the resolv.conf and hosts of its rootfs. It is kept in the task
+// state.
+type dnsFiles struct {
+	Root     string
+	Hostname string
+	Task     string
+	Addrs    []string
+
+	ResolvConf bool
+	Hosts      bool
+}
+
+// renderHosts renders the hosts file of self, with the tasks of its
+// allocation after it
+func renderHosts(self *dnsFiles, siblings []*dnsFiles) string {
+	var b strings.Builder
+	b.WriteString(generatedHeader)
+	b.WriteString("::1\t\tlocalhost\n")
+	b.WriteString("127.0.0.1\tlocalhost\n")
+	for _, f := range append([]*dnsFiles{self}, siblings...) {
+		for _, addr := range f.Addrs {
+			fmt.Fprintf(&b, "%s\t%s %s\n", addr, f.Hostname, f.Task)
+		}
+	}
+	return b.String()
+}
+
+// managedFiles are the files listed in the managed label of an image
+func managedFiles(labels map[string]string) map[string]bool {
+	files := make(map[string]bool)
+	for _, f := range strings.Fields(labels[managedFilesLabel]) {
+		files[filepath.Clean("/"+f)] = true
+	}
+	return files
+}
+
+// writeRootfsFile replaces the file name of the rootfs root with content,
+// through a rename so the jail never reads half of it. The jail may be
+// running and swap a directory of name for a link at any time, so name is
+// walked one directory at a time without following links and the file is
+// created and renamed relative to the last of them.
+func writeRootfsFile(root, name, content string) error {
+	// like in the jail, .. of the rootfs is the rootfs
+	rel := strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	if len(rel) == 0 {
+		return fmt.Errorf("invalid rootfs file %q", name)
+	}
+	parts := strings.Split(rel, "/")
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	fd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %s", root, err)
+	}
+	for _, part := range parts[:len(parts)-1] {
+		next, err := openDirAt(fd, part)
+		unix.Close(fd)
+		if err != nil {
+			return fmt.Errorf("failed to open %s of %s: %s", part, name, err)
+		}
+		fd = next
+	}
+	defer unix.Close(fd)
+
+	tmp := fmt.Sprintf(".jail-task-driver.%d", time.Now().UnixNano())
+	tfd, err := unix.Openat(fd, tmp, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0644)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(tfd), tmp)
+	_, err = f.WriteString(content)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = unix.Renameat(fd, tmp, fd, parts[len(parts)-1])
+	}
+	if err != nil {
+		unix.Unlinkat(fd, tmp, 0)
+	}
+	return err
+}
+
+// openDirAt opens the directory name of the directory fd, creating it when
+// missing, and fails when name is a link
+func openDirAt(fd int, name string) (int, error) {
+	const flags = unix.O_RDONLY | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC
+	next, err := unix.Openat(fd, name, flags, 0)
+	if err == unix.ENOENT {
+		if err := unix.Mkdirat(fd, name, 0755); err != nil && err != unix.EEXIST {
+			return -1, err
+		}
+		next, err = unix.Openat(fd, name, flags, 0)
+	}
+	return next, err
+}
+
+// setupDNS writes the resolv.conf and hosts of a jail before it is created.
+// Rootfs created by the driver get them unless the image manages them,
+// jails of a Path never do, as the Path may be shared. Addresses only known once the jail runs, like those of dhcp, are
+// added to hosts by refreshHosts.
+func (d *Driver) setupDNS(cfg *drivers.TaskConfig, taskConfig TaskConfig, params map[string]string, lease *poolLease, ownRootfs bool, labels map[string]string) (*dnsFiles, error) {
+	f := &dnsFiles{Root: params["path"], Hostname: params["host.hostname"], Task: cfg.Name}
+	if addrs, err := configuredAddresses(params, taskConfig.Network, lease); err == nil {
+		for _, ip := range addrs {
+			f.Addrs = append(f.Addrs, ip.String())
+		}
+	}
+	if !ownRootfs {
+		return f, nil
+	}
+
+	managed := managedFiles(labels)
+	f.ResolvConf = !managed["/etc/resolv.conf"]
+	f.Hosts = !managed["/etc/hosts"]
+
+	if f.ResolvConf {
+		var defaults DNSConfig
+		if d.config != nil {
+			defaults = d.config.DNS
+		}
+		c, err := resolveDNS(taskConfig.DNS, defaults)
+		if err != nil {
+			return nil, err
+		}
+		if len(c.Servers) == 0 {
+			d.logger.Warn("no dns servers for the jail, the host only has loopback ones", "task", cfg.Name)
+		}
+		if err := writeRootfsFile(f.Root, "/etc/resolv.conf", renderResolvConf(c)); err != nil {
+			return nil, fmt.Errorf("failed to write resolv.conf: %s", err)
+		}
+	}
+	if f.Hosts {
+		if err := writeRootfsFile(f.Root, "/etc/hosts", renderHosts(f, d.siblingHosts(cfg.AllocID, cfg.ID, ""))); err != nil {
+			return nil, fmt.Errorf("failed to write hosts: %s", err)
+		}
+	}
+	return f, nil
+}
+
+// siblingHosts are the running tasks of an allocation but self and gone,
+// sorted by task name
+func (d *Driver) siblingHosts(allocID, self, gone string) []*dnsFiles {
+	var siblings []*dnsFiles
+	for _, h := range d.tasks.List() {
+		id := h.taskConfig.ID
+		if h.taskConfig.AllocID != allocID || id == self || id == gone || !h.IsRunning() {
+			continue
+		}
+		h.stateLock.RLock()
+		if h.dns != nil {
+			siblings = append(siblings, h.dns)
+		}
+		h.stateLock.RUnlock()
+	}
+	sort.Slice(siblings, func(i, j int) bool {
+		return siblings[i].Task < siblings[j].Task
+	})
+	return siblings
+}
+
+// refreshHosts rewrites the hosts file of every running task of an
+// allocation after one of them started or stopped, leaving out the task
+// gone
+func (d *Driver) refreshHosts(allocID, gone string) {
+	d.hostsLock.Lock()
+	defer d.hostsLock.Unlock()
+	for _, h := range d.tasks.List() {
+		if h.taskConfig.AllocID != allocID || h.taskConfig.ID == gone || !h.IsRunning() {
+			continue
+		}
+		h.stateLock.RLock()
+		f := h.dns
+		h.stateLock.RUnlock()
+		if f == nil || !f.Hosts {
+			continue
+		}
+		if err := writeRootfsFile(f.Root, "/etc/hosts", renderHosts(f, d.siblingHosts(allocID, h.taskConfig.ID, gone))); err != nil {
+			d.logger.Warn("failed to update hosts", "task", f.Task, "error", err)
+		}
+	}
+}
+
+// learnAddresses records the addresses of a started jail for the hosts of
+// its allocation, when they weren't known before it started
+func (d *Driver) learnAddresses(h *taskHandle, networkJail string) {
+	addrs, _, err := jailAddresses(networkJail)
+	if err != nil || len(addrs) == 0 {
+		return
+	}
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	if h.dns == nil {
+		return
+	}
+	f := *h.dns
+	f.Addrs = nil
+	for _, ip := range addrs {
+		f.Addrs = append(f.Addrs, ip.String())
+	}
+	h.dns = &f
+}
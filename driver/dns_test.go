@@ -0,0 +1,261 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// testHostResolvConf points hostResolvConf at a file holding content for
+// the duration of the test
+func testHostResolvConf(t *testing.T, content string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "resolv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "resolv.conf")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := hostResolvConf
+	hostResolvConf = path
+	t.Cleanup(func() { hostResolvConf = old })
+}
+
+func TestParseResolvConf(t *testing.T) {
+	got := parseResolvConf(strings.NewReader(`# comment
+; other comment
+domain first.example
+nameserver 127.0.0.1
+nameserver 192.0.2.53
+nameserver ::1
+nameserver 2001:db8::53
+nameserver not-an-address
+search example.com example.org
+options ndots:2
+options timeout:1 attempts:3
+nameserver
+`))
+	want := DNSConfig{
+		Servers:  []string{"192.0.2.53", "2001:db8::53"},
+		Searches: []string{"example.com", "example.org"},
+		Options:  []string{"ndots:2", "timeout:1", "attempts:3"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestResolveDNS(t *testing.T) {
+	testHostResolvConf(t, "search host.example\nnameserver 198.51.100.1\noptions rotate\n")
+
+	cases := []struct {
+		name     string
+		task     DNSConfig
+		defaults DNSConfig
+		want     DNSConfig
+	}{
+		{"task", DNSConfig{Servers: []string{"192.0.2.1"}, Searches: []string{"task.example"}, Options: []string{"ndots:1"}},
+			DNSConfig{Servers: []string{"192.0.2.2"}, Searches: []string{"plugin.example"}, Options: []string{"ndots:3"}},
+			DNSConfig{Servers: []string{"192.0.2.1"}, Searches: []string{"task.example"}, Options: []string{"ndots:1"}}},
+		{"plugin", DNSConfig{Searches: []string{"task.example"}},
+			DNSConfig{Servers: []string{"192.0.2.2"}, Options: []string{"ndots:3"}},
+			DNSConfig{Servers: []string{"192.0.2.2"}, Searches: []string{"task.example"}, Options: []string{"ndots:3"}}},
+		{"host", DNSConfig{Options: []string{"ndots:1"}}, DNSConfig{},
+			DNSConfig{Servers: []string{"198.51.100.1"}, Searches: []string{"host.example"}, Options: []string{"ndots:1"}}},
+		// the host only fills in what the plugin doesn't set either
+		{"plugin searches", DNSConfig{}, DNSConfig{Searches: []string{"plugin.example"}},
+			DNSConfig{Servers: []string{"198.51.100.1"}, Searches: []string{"plugin.example"}, Options: []string{"rotate"}}},
+		// the host isn't read when servers are set
+		{"no host", DNSConfig{Servers: []string{"192.0.2.1"}}, DNSConfig{},
+			DNSConfig{Servers: []string{"192.0.2.1"}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := resolveDNS(c.task, c.defaults)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+
+	if _, err := resolveDNS(DNSConfig{Servers: []string{"resolver.example"}}, DNSConfig{}); err == nil {
+		t.Error("expected an error for a server that isn't an address")
+	}
+	hostResolvConf = filepath.Join(filepath.Dir(hostResolvConf), "missing")
+	if _, err := resolveDNS(DNSConfig{}, DNSConfig{}); err == nil {
+		t.Error("expected an error without servers and a host resolv.conf")
+	}
+}
+
+func TestRenderResolvConf(t *testing.T) {
+	got := renderResolvConf(DNSConfig{
+		Servers:  []string{"192.0.2.53", "2001:db8::53"},
+		Searches: []string{"example.com", "example.org"},
+		Options:  []string{"ndots:2"},
+	})
+	want := generatedHeader +
+		"search example.com example.org\n" +
+		"nameserver 192.0.2.53\n" +
+		"nameserver 2001:db8::53\n" +
+		"options ndots:2\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if got := renderResolvConf(DNSConfig{}); got != generatedHeader {
+		t.Errorf("empty config rendered %q", got)
+	}
+}
+
+func TestRenderHosts(t *testing.T) {
+	self := &dnsFiles{Hostname: "web-1", Task: "web", Addrs: []string{"10.0.0.5", "fd00::5"}}
+	siblings := []*dnsFiles{
+		{Hostname: "api-1", Task: "api", Addrs: []string{"10.0.0.6"}},
+		{Hostname: "dhcp-1", Task: "dhcp"},
+	}
+	want := generatedHeader +
+		"::1\t\tlocalhost\n" +
+		"127.0.0.1\tlocalhost\n" +
+		"10.0.0.5\tweb-1 web\n" +
+		"fd00::5\tweb-1 web\n" +
+		"10.0.0.6\tapi-1 api\n"
+	if got := renderHosts(self, siblings); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestManagedFiles(t *testing.T) {
+	got := managedFiles(map[string]string{managedFilesLabel: "/etc/resolv.conf  etc/hosts /etc/../etc/rc.conf"})
+	want := map[string]bool{"/etc/resolv.conf": true, "/etc/hosts": true, "/etc/rc.conf": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := managedFiles(nil); len(got) != 0 {
+		t.Errorf("got %v without the label", got)
+	}
+}
+
+func TestWriteRootfsFile(t *testing.T) {
+	root, outside := testRoot(t)
+	if err := writeRootfsFile(root, "/etc/resolv.conf", "nameserver 192.0.2.53\n"); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(root, "etc/resolv.conf"), "nameserver 192.0.2.53\n")
+
+	// links of the rootfs are replaced or refused, never followed
+	if err := os.Symlink(outside, filepath.Join(root, "etc/hosts")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "etc/motd")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeRootfsFile(root, "/etc/hosts/secret", "pwned"); err == nil {
+		t.Fatal("expected an error writing through a link")
+	}
+	if err := writeRootfsFile(root, "/etc/motd", "motd"); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(root, "etc/motd"), "motd")
+	// like in the jail, .. of the rootfs is the rootfs
+	if err := writeRootfsFile(root, "../outside/secret", "pwned"); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(root, "outside/secret"), "pwned")
+
+	// a running jail swapped etc for a link out of the rootfs
+	if err := os.Rename(filepath.Join(root, "etc"), filepath.Join(root, "etc.old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeRootfsFile(root, "/etc/hosts", "pwned"); err == nil {
+		t.Fatal("expected an error writing through a link")
+	}
+	assertOutsideIntact(t, outside)
+	assertFile(t, filepath.Join(outside, "secret"), "secret")
+}
+
+func assertFile(t *testing.T, path, want string) {
+	t.Helper()
+	buf, err := ioutil.ReadFile(path)
+	if err != nil || string(buf) != want {
+		t.Fatalf("%s holds %q %v, want %q", path, buf, err, want)
+	}
+}
+
+func TestCheckDNS(t *testing.T) {
+	dns := DNSConfig{Servers: []string{"192.0.2.53"}}
+	cases := []struct {
+		name string
+		c    TaskConfig
+		err  bool
+	}{
+		{"path", TaskConfig{Path: "/jails/web", DNS: dns}, true},
+		{"ephemeral path", TaskConfig{Path: "/jails/web", Ephemeral: true, DNS: dns}, false},
+		{"image", TaskConfig{Image: "app:1", DNS: dns}, false},
+		{"docker", TaskConfig{Docker: "alpine", DNS: dns}, false},
+		{"base release", TaskConfig{BaseRelease: "12.0-RELEASE", DNS: dns}, false},
+		{"path without dns", TaskConfig{Path: "/jails/web"}, false},
+	}
+	for _, c := range cases {
+		if err := checkDNS(c.c); (err != nil) != c.err {
+			t.Errorf("%s: checkDNS() error = %v, want error %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestSetupDNSLeavesPathAlone(t *testing.T) {
+	testHostResolvConf(t, "nameserver 198.51.100.1\n")
+	d := &Driver{tasks: newTaskStore(), logger: hclog.NewNullLogger()}
+	cfg := &drivers.TaskConfig{ID: "task", AllocID: "alloc", Name: "web"}
+
+	shared, err := ioutil.TempDir("", "path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(shared)
+	params := map[string]string{"path": shared, "host.hostname": "web-1", "ip4.addr": "10.0.0.5"}
+	f, err := d.setupDNS(cfg, TaskConfig{Path: shared}, params, nil, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.ResolvConf || f.Hosts {
+		t.Error("the files of a Path shouldn't be managed")
+	}
+	if _, err := os.Stat(filepath.Join(shared, "etc")); !os.IsNotExist(err) {
+		t.Error("nothing should be written in the Path")
+	}
+
+	owned, _ := testRoot(t)
+	params["path"] = owned
+	f, err = d.setupDNS(cfg, TaskConfig{}, params, nil, true, map[string]string{managedFilesLabel: "/etc/hosts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.ResolvConf || f.Hosts {
+		t.Errorf("only resolv.conf should be managed, got %+v", f)
+	}
+	assertFile(t, filepath.Join(owned, "etc/resolv.conf"), generatedHeader+"nameserver 198.51.100.1\n")
+	if _, err := os.Stat(filepath.Join(owned, "etc/hosts")); !os.IsNotExist(err) {
+		t.Error("hosts is managed by the image")
+	}
+}
@@ -10,8 +10,13 @@ package jail
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
+	metrics "github.com/armon/go-metrics"
+	units "github.com/docker/go-units"
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad/drivers/shared/eventer"
 	"github.com/hashicorp/nomad/plugins/base"
@@ -41,11 +46,105 @@ var (
 		Name:              pluginName,
 	}
 
+	// configSpec is the hcl specification returned by the ConfigSchema RPC
+	configSpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"image_dir": hclspec.NewDefault(
+			hclspec.NewAttr("image_dir", "string", false),
+			hclspec.NewLiteral(`"/var/db/jail-task-driver"`),
+		),
+		"storage": hclspec.NewDefault(
+			hclspec.NewAttr("storage", "string", false),
+			hclspec.NewLiteral(`"dir"`),
+		),
+		"zfs_dataset": hclspec.NewAttr("zfs_dataset", "string", false),
+		"release_mirror": hclspec.NewDefault(
+			hclspec.NewAttr("release_mirror", "string", false),
+			hclspec.NewLiteral(`"https://download.freebsd.org/releases"`),
+		),
+		"pull": hclspec.NewDefault(hclspec.NewBlock("pull", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"timeout": hclspec.NewDefault(
+				hclspec.NewAttr("timeout", "string", false),
+				hclspec.NewLiteral(`"10m"`),
+			),
+			"retries": hclspec.NewDefault(
+				hclspec.NewAttr("retries", "number", false),
+				hclspec.NewLiteral("3"),
+			),
+			"backoff": hclspec.NewDefault(
+				hclspec.NewAttr("backoff", "string", false),
+				hclspec.NewLiteral(`"2s"`),
+			),
+		})), hclspec.NewLiteral(`{
+			timeout = "10m"
+			retries = 3
+			backoff = "2s"
+		}`)),
+		"gc": hclspec.NewDefault(hclspec.NewBlock("gc", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"enabled": hclspec.NewDefault(
+				hclspec.NewAttr("enabled", "bool", false),
+				hclspec.NewLiteral("true"),
+			),
+			"interval": hclspec.NewDefault(
+				hclspec.NewAttr("interval", "string", false),
+				hclspec.NewLiteral(`"5m"`),
+			),
+			"image_ttl": hclspec.NewDefault(
+				hclspec.NewAttr("image_ttl", "string", false),
+				hclspec.NewLiteral(`"24h"`),
+			),
+			"image_delay": hclspec.NewDefault(
+				hclspec.NewAttr("image_delay", "string", false),
+				hclspec.NewLiteral(`"3m"`),
+			),
+			"max_size_mb": hclspec.NewAttr("max_size_mb", "number", false),
+		})), hclspec.NewLiteral(`{
+			enabled     = true
+			interval    = "5m"
+			image_ttl   = "24h"
+			image_delay = "3m"
+		}`)),
+		"ipam": hclspec.NewBlock("ipam", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"db": hclspec.NewDefault(
+				hclspec.NewAttr("db", "string", false),
+				hclspec.NewLiteral(`"/var/db/jail-task-driver/ipam.db"`),
+			),
+			"pool": hclspec.NewBlockList("pool", hclspec.NewObject(map[string]*hclspec.Spec{
+				"name":      hclspec.NewAttr("name", "string", true),
+				"interface": hclspec.NewAttr("interface", "string", true),
+				"ipv4":      hclspec.NewAttr("ipv4", "string", false),
+				"ipv6":      hclspec.NewAttr("ipv6", "string", false),
+				"exclude":   hclspec.NewAttr("exclude", "list(string)", false),
+			})),
+		})),
+		"dns": hclspec.NewBlock("dns", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"servers":  hclspec.NewAttr("servers", "list(string)", false),
+			"searches": hclspec.NewAttr("searches", "list(string)", false),
+			"options":  hclspec.NewAttr("options", "list(string)", false),
+		})),
+		"telemetry": hclspec.NewBlock("telemetry", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"statsd_address":   hclspec.NewAttr("statsd_address", "string", false),
+			"statsite_address": hclspec.NewAttr("statsite_address", "string", false),
+			"disable_hostname": hclspec.NewAttr("disable_hostname", "bool", false),
+		})),
+	})
+
 	// taskConfigSpec is the hcl specification for the driver config section of
 	// a task within a job. It is returned in the TaskConfigSchema RPC
 	taskConfigSpec = hclspec.NewObject(map[string]*hclspec.Spec{
 		"Path":                  hclspec.NewAttr("Path", "string", false),
 		"Docker":                hclspec.NewAttr("Docker", "string", false),
+		"image":                 hclspec.NewAttr("image", "string", false),
+		"force_pull":            hclspec.NewAttr("force_pull", "bool", false),
+		"entrypoint":            hclspec.NewAttr("entrypoint", "list(string)", false),
+		"args":                  hclspec.NewAttr("args", "list(string)", false),
+		"base_release":          hclspec.NewAttr("base_release", "string", false),
+		"base_distsets":         hclspec.NewAttr("base_distsets", "list(string)", false),
+		"rootfs_mode":           hclspec.NewAttr("rootfs_mode", "string", false),
+		"ephemeral":             hclspec.NewAttr("ephemeral", "bool", false),
+		"packages":              hclspec.NewAttr("packages", "list(string)", false),
+		"port_map":              hclspec.NewBlockAttrs("port_map", "number", false),
+		"ip_pool":               hclspec.NewAttr("ip_pool", "string", false),
+		"shared_network":        hclspec.NewAttr("shared_network", "bool", false),
 		"Jid":                   hclspec.NewAttr("Jid", "string", false),
 		"Ip4_addr":              hclspec.NewAttr("Ip4_addr", "string", false),
 		"Ip4_saddrsel":          hclspec.NewAttr("Ip4_saddrsel", "bool", false),
@@ -264,6 +363,40 @@ var (
 				"Per":    hclspec.NewAttr("Per", "string", false),
 			})),
 		})),
+
+		"network": hclspec.NewBlock("network", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"mode": hclspec.NewAttr("mode", "string", true),
+			"bridge": hclspec.NewDefault(
+				hclspec.NewAttr("bridge", "string", false),
+				hclspec.NewLiteral(`"bridge0"`),
+			),
+			"ipv4":     hclspec.NewAttr("ipv4", "string", false),
+			"ipv6":     hclspec.NewAttr("ipv6", "string", false),
+			"gateway":  hclspec.NewAttr("gateway", "string", false),
+			"gateway6": hclspec.NewAttr("gateway6", "string", false),
+		})),
+
+		"firewall": hclspec.NewBlock("firewall", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"allow_egress":       hclspec.NewAttr("allow_egress", "list(string)", false),
+			"allow_ingress_from": hclspec.NewAttr("allow_ingress_from", "list(string)", false),
+		})),
+
+		"network_limits": hclspec.NewBlock("network_limits", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"egress_kbps":  hclspec.NewAttr("egress_kbps", "number", false),
+			"ingress_kbps": hclspec.NewAttr("ingress_kbps", "number", false),
+			"delay_ms":     hclspec.NewAttr("delay_ms", "number", false),
+		})),
+
+		"dns": hclspec.NewBlock("dns", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"servers":  hclspec.NewAttr("servers", "list(string)", false),
+			"searches": hclspec.NewAttr("searches", "list(string)", false),
+			"options":  hclspec.NewAttr("options", "list(string)", false),
+		})),
+		"telemetry": hclspec.NewBlock("telemetry", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"statsd_address":   hclspec.NewAttr("statsd_address", "string", false),
+			"statsite_address": hclspec.NewAttr("statsite_address", "string", false),
+			"disable_hostname": hclspec.NewAttr("disable_hostname", "bool", false),
+		})),
 	})
 
 	// capabilities is returned by the Capabilities RPC and indicates what
@@ -297,12 +430,73 @@ type Driver struct {
 	// ctx passed to any subsystems
 	signalShutdown context.CancelFunc
 
+	// images is the local image store, opened by SetConfig
+	images *imageStore
+
+	// registry downloads images into the store
+	registry *registryClient
+
+	// pulls cancels the image pulls of tasks being started, by task id
+	pullsLock sync.Mutex
+	pulls     map[string]context.CancelFunc
+
+	// ipam leases addresses to tasks, opened by SetConfig when pools are
+	// configured
+	ipam *ipam
+
+	// pf holds the port forwards of the tasks, loaded in a pf anchor per
+	// allocation
+	pf *pfAnchors
+
+	// shared are the parent jails of allocations sharing their network
+	sharedLock sync.Mutex
+	shared     map[string]*sharedNetwork
+
+	// shaper numbers the dummynet pipes of network_limits
+	shaper *shaper
+
+	// hostsLock serializes the rewrites of the hosts of allocations
+	hostsLock sync.Mutex
+
+	// metrics sends the metrics of the plugin to the sinks of its
+	// telemetry block, set up once by SetConfig
+	metrics *metrics.Metrics
+
 	// logger will log to the Nomad agent
 	logger hclog.Logger
 }
 
 // Config is the driver configuration set by the SetConfig RPC call
 type Config struct {
+	// ImageDir is where pulled images and their unpacked rootfs are kept
+	ImageDir string `codec:"image_dir"`
+
+	// GC is the garbage collection policy of the image store
+	GC GCConfig `codec:"gc"`
+
+	// Storage selects how images are unpacked and task rootfs are created,
+	// either "dir" or "zfs"
+	Storage string `codec:"storage"`
+
+	// ZfsDataset is the dataset holding layers and task clones when using
+	// the zfs storage backend
+	ZfsDataset string `codec:"zfs_dataset"`
+
+	// Pull sets the timeouts and retries of image downloads
+	Pull PullConfig `codec:"pull"`
+
+	// ReleaseMirror is the url or local directory FreeBSD release distsets
+	// are fetched from
+	ReleaseMirror string `codec:"release_mirror"`
+
+	// IPAM defines the address pools tasks lease their addresses from
+	IPAM IPAMConfig `codec:"ipam"`
+
+	// DNS is the resolv.conf of jails whose dns block leaves it unset
+	DNS DNSConfig `codec:"dns"`
+
+	// Telemetry sets where the metrics of the plugin are sent
+	Telemetry TelemetryConfig `codec:"telemetry"`
 }
 
 type RctlOpts struct {
@@ -411,6 +605,58 @@ type TaskConfig struct {
 	Mount_fdescfs         bool   `codec:"Mount_fdescfs"`
 	Depend                string `codec:"Depend"`
 	Rctl                  Rctl   `codec:"Rctl"`
+
+	// Image is a docker save archive or an OCI image layout to create the
+	// jail from
+	Image string `codec:"image"`
+
+	// ForcePull downloads the manifest of Docker again even when the image
+	// is in the store
+	ForcePull bool `codec:"force_pull"`
+
+	// Entrypoint and Args override the entrypoint and cmd of the image
+	Entrypoint []string `codec:"entrypoint"`
+	Args       []string `codec:"args"`
+
+	// BaseRelease creates the jail from the distsets of a FreeBSD release,
+	// BaseDistsets defaults to base
+	BaseRelease  string   `codec:"base_release"`
+	BaseDistsets []string `codec:"base_distsets"`
+
+	// RootfsMode is how the rootfs is created from the image, either
+	// "copy", "thin" or "union"
+	RootfsMode string `codec:"rootfs_mode"`
+
+	// Ephemeral runs the task on a copy of Path discarded when the task is
+	// destroyed
+	Ephemeral bool `codec:"ephemeral"`
+
+	// Packages are installed with pkg from the repositories of the host
+	Packages []string `codec:"packages"`
+
+	// PortMap maps nomad port labels to the ports the task listens on in
+	// the jail
+	PortMap map[string]int `codec:"port_map"`
+
+	// IPPool leases the addresses of the jail from a pool of the plugin
+	// config
+	IPPool string `codec:"ip_pool"`
+
+	// Network is the networking set up by the driver for the jail
+	Network NetworkConfig `codec:"network"`
+
+	// Firewall restricts the peers of the jail with pf
+	Firewall FirewallConfig `codec:"firewall"`
+
+	// SharedNetwork runs the jail as a child of a parent jail holding the
+	// network of the allocation, shared by the tasks setting it
+	SharedNetwork bool `codec:"shared_network"`
+
+	// NetworkLimits shapes the traffic of the jail with dummynet
+	NetworkLimits NetworkLimits `codec:"network_limits"`
+
+	// DNS sets the resolv.conf written in the jail rootfs
+	DNS DNSConfig `codec:"dns"`
 }
 
 // TaskState is the state which is encoded in the handle returned in
@@ -420,6 +666,16 @@ type TaskState struct {
 	TaskConfig    *drivers.TaskConfig
 	ContainerName string
 	StartedAt     time.Time
+	ImageID       string
+	Mounts        []string
+	Ephemeral     string
+	Aliases       []string
+	Epair         string
+	Forwards      []portForward
+	Firewall      string
+	SharedNetwork *sharedNetwork
+	Shaping       *shaping
+	DNS           *dnsFiles
 }
 
 func NewJailDriver(logger hclog.Logger) drivers.DriverPlugin {
@@ -429,6 +685,10 @@ func NewJailDriver(logger hclog.Logger) drivers.DriverPlugin {
 		eventer:        eventer.NewEventer(ctx, logger),
 		config:         &Config{},
 		tasks:          newTaskStore(),
+		pulls:          make(map[string]context.CancelFunc),
+		pf:             newPFAnchors(),
+		shared:         make(map[string]*sharedNetwork),
+		shaper:         newShaper(),
 		ctx:            ctx,
 		signalShutdown: cancel,
 		logger:         logger,
@@ -440,7 +700,7 @@ func (d *Driver) PluginInfo() (*base.PluginInfoResponse, error) {
 }
 
 func (d *Driver) ConfigSchema() (*hclspec.Spec, error) {
-	return nil, nil
+	return configSpec, nil
 }
 
 func (d *Driver) SetConfig(cfg *base.Config) error {
@@ -456,11 +716,88 @@ func (d *Driver) SetConfig(cfg *base.Config) error {
 		d.nomadConfig = cfg.AgentConfig.Driver
 	}
 
+	if d.metrics == nil {
+		m, err := setupTelemetry(config.Telemetry)
+		if err != nil {
+			return err
+		}
+		d.metrics = m
+	}
+
+	if len(config.ImageDir) > 0 {
+		if missing := missingDecompressors(); len(missing) > 0 {
+			d.logger.Warn("images with layers compressed by missing programs will fail to pull", "missing", missing)
+		}
+	}
+
+	// the agent calls SetConfig again when it reloads, the open store keeps
+	// the images in use and its collector running
+	if len(config.ImageDir) > 0 && d.images == nil {
+		if err := d.openImageStore(config); err != nil {
+			return err
+		}
+
+		if config.GC.Enabled {
+			policy, err := config.GC.policy()
+			if err != nil {
+				return err
+			}
+			go d.images.runGC(d.ctx, policy)
+		}
+	}
+
+	if len(config.IPAM.Pools) > 0 && d.ipam == nil {
+		if len(config.IPAM.DB) == 0 {
+			config.IPAM.DB = filepath.Join(defaultImageDir, "ipam.db")
+		}
+		ipam, err := newIPAM(config.IPAM, d.logger)
+		if err != nil {
+			return err
+		}
+		d.ipam = ipam
+		go ipam.reapOrphans(d.ctx, func(taskID string) bool {
+			_, ok := d.tasks.Get(taskID)
+			return ok || d.hasSharedNetwork(taskID)
+		})
+	}
+
+	return nil
+}
+
+// openImageStore opens the image store and the registry client configured
+// by config
+func (d *Driver) openImageStore(config Config) error {
+	images, err := newImageStore(config.ImageDir, d.logger)
+	if err != nil {
+		return err
+	}
+
+	switch config.Storage {
+	case "", "dir":
+	case "zfs":
+		backend, err := newZfsBackend(images, config.ZfsDataset)
+		if err != nil {
+			return err
+		}
+		images.backend = backend
+	default:
+		return fmt.Errorf("unknown storage backend %q", config.Storage)
+	}
+	d.images = images
+
+	registry, err := newRegistryClient(config.Pull)
+	if err != nil {
+		return err
+	}
+	d.registry = registry
 	return nil
 }
 
 func (d *Driver) Shutdown(ctx context.Context) error {
 	d.signalShutdown()
+	if d.ipam != nil {
+		return d.ipam.close()
+	}
 	return nil
 }
 
@@ -500,6 +837,16 @@ func (d *Driver) buildFingerprint() *drivers.Fingerprint {
 	attrs := map[string]*pstructs.Attribute{"driver.jail": pstructs.NewStringAttribute("1")}
 	health = drivers.HealthStateHealthy
 	desc = "ready"
+
+	// layers compressed with zstd or xz are piped through their programs,
+	// jobs pulling them can be constrained on these
+	missing := make(map[string]bool)
+	for _, name := range missingDecompressors() {
+		missing[name] = true
+	}
+	for _, name := range decompressors {
+		attrs["driver.jail.decompressor."+name] = pstructs.NewBoolAttribute(!missing[name])
+	}
 	d.logger.Info("buildFingerprint()", "driver.FingerPrint", hclog.Fmt("%+v", health))
 	return &drivers.Fingerprint{
 		Attributes:        attrs,
@@ -527,21 +874,60 @@ func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
 		return fmt.Errorf("failed to decode task state from handle: %v", err)
 	}
 
-	_, err := d.initializeContainer(handle.Config, driverConfig)
-	if err != nil {
-		d.logger.Info("Error RecoverTask k", "driver_cfg", hclog.Fmt("%+v", err))
-		return fmt.Errorf("task with ID %q failed", handle.Config.ID)
-
-	}
-
 	h := &taskHandle{
 		taskConfig: taskState.TaskConfig,
 		State:      drivers.TaskStateRunning,
 		startedAt:  taskState.StartedAt,
 		exitResult: &drivers.ExitResult{},
 		logger:     d.logger,
+		imageID:    taskState.ImageID,
+		mounts:     taskState.Mounts,
+		ephemeral:  taskState.Ephemeral,
+		aliases:    taskState.Aliases,
+		epair:      taskState.Epair,
+		firewall:   taskState.Firewall,
+
+		containerName: taskState.ContainerName,
+		shared:        d.recoverSharedNetwork(handle.Config.ID, taskState.SharedNetwork),
+		dns:           taskState.DNS,
+	}
+
+	if len(h.imageID) > 0 && d.images != nil {
+		if err := d.images.acquire(h.imageID, handle.Config.ID); err != nil {
+			d.logger.Warn("failed to reacquire task image", "image", h.imageID, "error", err)
+		}
+	}
+
+	// Only recreate the jail if it went away while the driver was down
+	if !IsJailActive(taskState.ContainerName) {
+		if err := unmountAll(h.mounts); err != nil {
+			d.logger.Warn("failed to unmount task filesystems", "error", err)
+		}
+		h.mounts = nil
+		h.releaseAliases()
+		h.releaseVnet()
+		// the limits are applied again to the new jail
+		if taskState.Shaping != nil {
+			if err := d.shaper.remove(taskState.Shaping); err != nil {
+				d.logger.Warn("failed to remove task network limits", "error", err)
+			}
+			taskState.Shaping = nil
+		}
+		_, err := d.initializeContainer(d.ctx, handle.Config, driverConfig, h)
+		if err != nil {
+			d.logger.Info("Error RecoverTask k", "driver_cfg", hclog.Fmt("%+v", err))
+			return fmt.Errorf("task with ID %q failed", handle.Config.ID)
+
+		}
 	}
 
+	d.pf.set(handle.Config.AllocID, handle.Config.ID, taskState.Forwards, false)
+	if h.shaping == nil {
+		h.shaping = taskState.Shaping
+		d.shaper.restore(h.shaping)
+	}
+	d.resumeShaping(handle.Config, h.shaping, h)
+
 	d.tasks.Set(taskState.TaskConfig.ID, h)
 	go h.run()
 	return nil
@@ -562,13 +948,6 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 	handle := drivers.NewTaskHandle(taskHandleVersion)
 	handle.Config = cfg
 
-	_, err := d.initializeContainer(cfg, driverConfig)
-	if err != nil {
-		d.logger.Info("Error starting jail task", "driver_cfg", hclog.Fmt("%+v", err))
-		return nil, nil, fmt.Errorf("task with ID %q failed", cfg.ID)
-
-	}
-
 	h := &taskHandle{
 		taskConfig: cfg,
 		State:      drivers.TaskStateRunning,
@@ -576,10 +955,39 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 		logger:     d.logger,
 	}
 
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.pullsLock.Lock()
+	d.pulls[cfg.ID] = cancel
+	d.pullsLock.Unlock()
+
+	_, err := d.initializeContainer(ctx, cfg, driverConfig, h)
+
+	d.pullsLock.Lock()
+	delete(d.pulls, cfg.ID)
+	d.pullsLock.Unlock()
+	cancel()
+
+	if err != nil {
+		d.logger.Info("Error starting jail task", "driver_cfg", hclog.Fmt("%+v", err))
+		d.releaseRootfs(h)
+		d.releaseNetwork(h)
+		return nil, nil, fmt.Errorf("task with ID %q failed", cfg.ID)
+
+	}
+
 	driverState := TaskState{
-		ContainerName: fmt.Sprintf("%s-%s", cfg.Name, cfg.AllocID),
+		ContainerName: h.containerName,
 		TaskConfig:    cfg,
 		StartedAt:     h.startedAt,
+		ImageID:       h.imageID,
+		Mounts:        h.mounts,
+		Ephemeral:     h.ephemeral,
+		Aliases:       h.aliases,
+		Epair:         h.epair,
+		Firewall:      h.firewall,
+		SharedNetwork: d.sharedState(h.shared),
+		DNS:           h.dns,
+		Shaping:       h.shaping,
 	}
 
 	if err := handle.SetDriverState(&driverState); err != nil {
@@ -591,7 +999,58 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 
 	go h.run()
 
-	return handle, nil, nil
+	if len(driverConfig.PortMap) == 0 {
+		driverConfig.PortMap = h.portMap
+	}
+
+	// children of a shared network jail inherit its addresses
+	networkJail := driverState.ContainerName
+	if len(h.shared) > 0 {
+		networkJail = h.shared
+	}
+	network, err := jailNetwork(d.ctx, networkJail, cfg, driverConfig, h.IsRunning)
+	if err != nil {
+		d.logger.Warn("failed to determine the jail address", "task", cfg.Name, "error", err)
+	}
+
+	if network != nil {
+		driverState.Forwards = portForwards(cfg, network.IP, driverConfig.PortMap)
+		for i := range driverState.Forwards {
+			driverState.Forwards[i].Filtered = len(driverConfig.Firewall.AllowIngressFrom) > 0
+		}
+		if err := d.pf.set(cfg.AllocID, cfg.ID, driverState.Forwards, true); err != nil {
+			// the ports nomad allocated would not reach the jail, like
+			// network_limits failing to apply the task doesn't start
+			d.logger.Error("failed to load port forwards, stopping the task", "task", cfg.Name, "error", err)
+			d.abortTask(h)
+			return nil, nil, fmt.Errorf("failed to load port forwards: %s", err)
+		}
+		d.learnAddresses(h, networkJail)
+		driverState.DNS = h.dns
+	}
+	d.refreshHosts(cfg.AllocID, "")
+
+	d.resumeShaping(cfg, h.shaping, h)
+
+	if network != nil {
+		if err := handle.SetDriverState(&driverState); err != nil {
+			d.logger.Error("failed to set driver state", "error", err)
+		}
+	}
+
+	return handle, network, nil
+}
+
+// abortTask removes the jail of a task StartTask fails after starting it,
+// and everything set up for it
+func (d *Driver) abortTask(h *taskHandle) {
+	if err := h.shutdown(0); err != nil {
+		d.logger.Warn("failed to stop task", "task", h.taskConfig.Name, "error", err)
+	}
+	d.tasks.Delete(h.taskConfig.ID)
+	d.releaseRootfs(h)
+	d.releaseNetwork(h)
+	d.refreshHosts(h.taskConfig.AllocID, h.taskConfig.ID)
 }
 
 func (d *Driver) WaitTask(ctx context.Context, taskID string) (<-chan *drivers.ExitResult, error) {
@@ -629,6 +1088,8 @@ func (d *Driver) handleWait(ctx context.Context, handle *taskHandle, ch chan *dr
 }
 
 func (d *Driver) StopTask(taskID string, timeout time.Duration, signal string) error {
+	d.cancelPull(taskID)
+
 	handle, ok := d.tasks.Get(taskID)
 	if !ok {
 		return drivers.ErrTaskNotFound
@@ -637,11 +1098,20 @@ func (d *Driver) StopTask(taskID string, timeout time.Duration, signal string) e
 	if err := handle.shutdown(timeout); err != nil {
 		return fmt.Errorf("executor Shutdown failed: %v", err)
 	}
+	handle.releaseAliases()
+	handle.releaseFirewall()
+	d.releaseShaping(handle)
+	if err := d.pf.remove(handle.taskConfig.AllocID, taskID); err != nil {
+		d.logger.Warn("failed to flush port forwards", "error", err)
+	}
+	d.refreshHosts(handle.taskConfig.AllocID, taskID)
 
 	return nil
 }
 
 func (d *Driver) DestroyTask(taskID string, force bool) error {
+	d.cancelPull(taskID)
+
 	handle, ok := d.tasks.Get(taskID)
 	if !ok {
 		return drivers.ErrTaskNotFound
@@ -658,10 +1128,117 @@ func (d *Driver) DestroyTask(taskID string, force bool) error {
 		}
 	}
 
+	d.releaseRootfs(handle)
+	d.releaseNetwork(handle)
 	d.tasks.Delete(taskID)
+	d.refreshHosts(handle.taskConfig.AllocID, taskID)
 	return nil
 }
 
+// releaseRootfs unmounts the filesystems mounted in the task rootfs and
+// discards its ephemeral copy. Rootfs created from images are destroyed and
+// the reference of the task on the image is dropped so it can be garbage
+// collected.
+func (d *Driver) releaseRootfs(h *taskHandle) {
+	mounted := false
+	if err := unmountAll(h.mounts); err != nil {
+		d.logger.Warn("failed to unmount task filesystems", "error", err)
+		mounted = true
+	}
+	h.mounts = nil
+
+	if len(h.ephemeral) > 0 {
+		if err := destroyEphemeral(h.ephemeral); err != nil {
+			d.logger.Warn("failed to destroy ephemeral rootfs", "dataset", h.ephemeral, "error", err)
+		}
+		h.ephemeral = ""
+	}
+
+	if len(h.imageID) == 0 || d.images == nil {
+		return
+	}
+	containerName := fmt.Sprintf("%s-%s", h.taskConfig.Name, h.taskConfig.AllocID)
+	// removing the rootfs with filesystems still mounted in it would reach
+	// into them
+	if mounted {
+		d.logger.Warn("keeping task rootfs with filesystems mounted in it", "image", h.imageID)
+	} else if err := d.images.destroyRootfs(containerName); err != nil {
+		d.logger.Warn("failed to destroy task rootfs", "image", h.imageID, "error", err)
+	}
+	if err := d.images.removeContainer(containerName); err != nil {
+		d.logger.Warn("failed to remove task record", "image", h.imageID, "error", err)
+	}
+	if err := d.images.release(h.imageID, h.taskConfig.ID); err != nil {
+		d.logger.Warn("failed to release task image", "image", h.imageID, "error", err)
+	}
+}
+
+// releaseNetwork removes the port forwards, network limits, address aliases
+// and the epair of the task and returns its leased addresses to their pool
+func (d *Driver) releaseNetwork(h *taskHandle) {
+	if err := d.pf.remove(h.taskConfig.AllocID, h.taskConfig.ID); err != nil {
+		d.logger.Warn("failed to flush port forwards", "error", err)
+	}
+	d.releaseShaping(h)
+	h.releaseFirewall()
+	h.releaseAliases()
+	h.releaseVnet()
+	d.leaveSharedNetwork(h)
+	if d.ipam == nil {
+		return
+	}
+	if err := d.ipam.release(h.taskConfig.ID); err != nil {
+		d.logger.Warn("failed to release task addresses", "error", err)
+	}
+}
+
+// cancelPull aborts the image pull of a task that is still being started
+func (d *Driver) cancelPull(taskID string) {
+	d.pullsLock.Lock()
+	defer d.pullsLock.Unlock()
+	if cancel, ok := d.pulls[taskID]; ok {
+		cancel()
+	}
+}
+
+// pullImage pulls ref into the image store unless it is already there,
+// emitting the download progress as events of the task. The registry is
+// only asked for the manifest of images missing from the store, or on
+// refresh, so tasks of cached images start while it is unreachable.
+func (d *Driver) pullImage(ctx context.Context, cfg *drivers.TaskConfig, ref imageRef, refresh bool) (*imageRecord, error) {
+	if !refresh {
+		if img, err := d.images.resolve(ref.String()); err == nil {
+			return img, nil
+		}
+	}
+	return d.images.coalesce(ctx, "pull:"+ref.String(), d.pullReporter(cfg), func(ctx context.Context, report func(pullProgress)) (*imageRecord, error) {
+		return d.registry.pull(ctx, d.images, ref, report)
+	})
+}
+
+// pullReporter emits download progress as events of the task
+func (d *Driver) pullReporter(cfg *drivers.TaskConfig) func(pullProgress) {
+	return func(p pullProgress) {
+		msg := fmt.Sprintf("Downloading %s layer %s: %s", p.Ref, p.shortBlob(), units.HumanSize(float64(p.Done)))
+		if p.Total > 0 {
+			msg += " of " + units.HumanSize(float64(p.Total))
+		}
+		d.eventer.EmitEvent(&drivers.TaskEvent{
+			TaskID:    cfg.ID,
+			TaskName:  cfg.Name,
+			AllocID:   cfg.AllocID,
+			Timestamp: time.Now(),
+			Message:   msg,
+			Annotations: map[string]string{
+				"image":      p.Ref,
+				"layer":      p.Blob.String(),
+				"downloaded": strconv.FormatInt(p.Done, 10),
+				"total":      strconv.FormatInt(p.Total, 10),
+			},
+		})
+	}
+}
+
 func (d *Driver) InspectTask(taskID string) (*drivers.TaskStatus, error) {
 	handle, ok := d.tasks.Get(taskID)
 
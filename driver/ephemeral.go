@@ -0,0 +1,104 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// ephemeralSnapshotPrefix names the snapshots ephemeral clones are
+	// created from
+	ephemeralSnapshotPrefix = "nomad-"
+)
+
+// zfsDatasetAt returns the dataset mounted at path, if any
+func zfsDatasetAt(path string) (string, bool) {
+	out, err := zfsCmd("list", "-H", "-o", "name,mountpoint", path)
+	if err != nil {
+		return "", false
+	}
+	return datasetMountedAt(out, path)
+}
+
+// datasetMountedAt parses the name and mountpoint zfs list printed for
+// path. zfs lists the dataset containing a path, which is only the dataset
+// of the rootfs when it is mounted at path itself.
+func datasetMountedAt(out, path string) (string, bool) {
+	fields := strings.Split(out, "\t")
+	if len(fields) != 2 || filepath.Clean(fields[1]) != filepath.Clean(path) {
+		return "", false
+	}
+	return fields[0], true
+}
+
+// ephemeralClone names the clone of the dataset ds given to the jail name
+// and the snapshot it is created from
+func ephemeralClone(ds, name string) (string, string) {
+	return ds + "-" + datasetName(name), ds + "@" + ephemeralSnapshotPrefix + datasetName(name)
+}
+
+// ephemeralCommands are the zfs commands cloning snapshot to clone mounted
+// at dest, skipping what a task recovered before its jail went away left
+func ephemeralCommands(clone, snapshot, dest string, cloneExists, snapshotExists bool) [][]string {
+	if cloneExists {
+		return nil
+	}
+	var cmds [][]string
+	if !snapshotExists {
+		cmds = append(cmds, []string{"snapshot", snapshot})
+	}
+	return append(cmds, []string{"clone", "-o", "mountpoint=" + dest, snapshot, clone})
+}
+
+// createEphemeral gives the jail name a disposable copy of the rootfs at
+// path, mounted at dest. Datasets are snapshotted and cloned next to the
+// original, returning the clone. Other directories are mounted below dest
+// with unionfs, so writes land in dest, returning the mounted paths.
+func createEphemeral(path, name, dest string) (string, []string, error) {
+	ds, ok := zfsDatasetAt(path)
+	if !ok {
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return "", nil, err
+		}
+		mounted, err := mountAll(dest, []jailMount{{FSType: "unionfs", Source: path, Target: "/", Options: "below,noatime"}}, "")
+		return "", mounted, err
+	}
+
+	clone, snapshot := ephemeralClone(ds, name)
+	for _, cmd := range ephemeralCommands(clone, snapshot, dest, zfsExists(clone), zfsExists(snapshot)) {
+		if _, err := zfsCmd(cmd...); err != nil {
+			if cmd[0] == "clone" {
+				zfsCmd("destroy", snapshot)
+			}
+			return "", nil, err
+		}
+	}
+	return clone, nil, nil
+}
+
+// destroyEphemeral discards a clone made by createEphemeral together with
+// the snapshot it was created from.
+func destroyEphemeral(clone string) error {
+	if !zfsExists(clone) {
+		return nil
+	}
+	origin, err := zfsCmd("get", "-H", "-o", "value", "origin", clone)
+	if err != nil {
+		return err
+	}
+	if _, err := zfsCmd("destroy", "-r", "-f", clone); err != nil {
+		return err
+	}
+	if strings.Contains(origin, "@"+ephemeralSnapshotPrefix) {
+		_, err = zfsCmd("destroy", origin)
+	}
+	return err
+}
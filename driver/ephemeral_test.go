@@ -0,0 +1,70 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDatasetMountedAt(t *testing.T) {
+	cases := []struct {
+		name string
+		out  string
+		path string
+		ds   string
+	}{
+		{"dataset", "zroot/jails/web\t/jails/web", "/jails/web", "zroot/jails/web"},
+		{"trailing slash", "zroot/jails/web\t/jails/web", "/jails/web/", "zroot/jails/web"},
+		{"directory in a dataset", "zroot/jails\t/jails", "/jails/web", ""},
+		{"legacy mountpoint", "zroot/jails/web\tlegacy", "/jails/web", ""},
+		{"unexpected output", "zroot/jails/web", "/jails/web", ""},
+		{"no output", "", "/jails/web", ""},
+	}
+	for _, c := range cases {
+		ds, ok := datasetMountedAt(c.out, c.path)
+		if ds != c.ds || ok != (len(c.ds) > 0) {
+			t.Errorf("%s: got %q, %v, want %q", c.name, ds, ok, c.ds)
+		}
+	}
+}
+
+func TestEphemeralClone(t *testing.T) {
+	clone, snapshot := ephemeralClone("zroot/jails/web", "web-1a2b/task@1")
+	if clone != "zroot/jails/web-web-1a2b_task_1" {
+		t.Errorf("clone = %s", clone)
+	}
+	if snapshot != "zroot/jails/web@nomad-web-1a2b_task_1" {
+		t.Errorf("snapshot = %s", snapshot)
+	}
+	if other, _ := ephemeralClone("zroot/jails/web", "web-3c4d"); other == clone {
+		t.Error("two tasks got the same clone")
+	}
+}
+
+func TestEphemeralCommands(t *testing.T) {
+	clone := "zroot/jails/web-task"
+	snapshot := "zroot/jails/web@nomad-task"
+	cloneCmd := []string{"clone", "-o", "mountpoint=/alloc/task/ephemeral", snapshot, clone}
+	cases := []struct {
+		name           string
+		cloneExists    bool
+		snapshotExists bool
+		want           [][]string
+	}{
+		{"new task", false, false, [][]string{{"snapshot", snapshot}, cloneCmd}},
+		{"snapshot left over", false, true, [][]string{cloneCmd}},
+		{"recovered task", true, true, nil},
+	}
+	for _, c := range cases {
+		got := ephemeralCommands(clone, snapshot, "/alloc/task/ephemeral", c.cloneExists, c.snapshotExists)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
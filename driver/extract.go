@@ -0,0 +1,385 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// whiteoutPrefix marks a file deleted from the layers below
+	whiteoutPrefix = ".wh."
+
+	// whiteoutOpaque marks a directory whose lower layer contents are hidden
+	whiteoutOpaque = ".wh..wh..opq"
+
+	// maxSymlinkDepth bounds symlink resolution while extracting
+	maxSymlinkDepth = 255
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+)
+
+// decompressors are the external programs layers compressed with zstd or
+// xz are piped through
+var decompressors = []string{"zstd", "xz"}
+
+// missingDecompressors lists the decompressors not found in the PATH
+func missingDecompressors() []string {
+	var missing []string
+	for _, name := range decompressors {
+		if _, err := exec.LookPath(name); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// cmdReader streams the output of an external decompressor
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdReader) Close() error {
+	c.ReadCloser.Close()
+	return c.cmd.Wait()
+}
+
+func execDecompressor(r io.Reader, name string, args ...string) (io.ReadCloser, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, fmt.Errorf("layer is compressed with %s, which is not installed: %s", name, err)
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = r
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error running %s: %s", name, err)
+	}
+	return &cmdReader{ReadCloser: out, cmd: cmd}, nil
+}
+
+// decompressStream sniffs the compression used by a layer and returns a
+// reader over the plain tar stream.
+func decompressStream(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(6)
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		return execDecompressor(br, "zstd", "-dcq")
+	case bytes.HasPrefix(magic, xzMagic):
+		return execDecompressor(br, "xz", "-dcq")
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// cleanEntryPath returns the path of a tar entry relative to the root of
+// the layer, refusing names that climb above it.
+func cleanEntryPath(name string) (string, error) {
+	depth := 0
+	for _, c := range strings.Split(name, "/") {
+		switch c {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return "", fmt.Errorf("layer entry %q escapes the rootfs", name)
+			}
+		default:
+			depth++
+		}
+	}
+	return strings.TrimPrefix(path.Clean("/"+name), "/"), nil
+}
+
+// securePath resolves rel inside root, following symlinks the way they
+// would be followed from inside the jail. Absolute link targets are
+// re-rooted at root and relative targets climbing above it are refused, so
+// the result never points outside of root. The last component is not
+// followed.
+func securePath(root, rel string) (string, error) {
+	dir, base := path.Split(path.Clean("/" + rel))
+	resolved, err := secureDir(root, dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, base), nil
+}
+
+func secureDir(root, rel string) (string, error) {
+	var done []string
+	todo := strings.Split(rel, "/")
+	links := 0
+
+	for len(todo) > 0 {
+		c := todo[0]
+		todo = todo[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(done) == 0 {
+				return "", fmt.Errorf("path %q escapes the rootfs", rel)
+			}
+			done = done[:len(done)-1]
+			continue
+		}
+
+		candidate := filepath.Join(root, filepath.Join(done...), c)
+		fi, err := os.Lstat(candidate)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			done = append(done, c)
+			continue
+		}
+
+		links++
+		if links > maxSymlinkDepth {
+			return "", fmt.Errorf("too many levels of symbolic links in %q", rel)
+		}
+		target, err := os.Readlink(candidate)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			done = nil
+		}
+		todo = append(strings.Split(target, "/"), todo...)
+	}
+	return filepath.Join(root, filepath.Join(done...)), nil
+}
+
+// whiteoutTarget is the path a whiteout of name in parent deletes. Names
+// that aren't a single entry of parent are refused, a whiteout can only
+// hide something below the directory it is in.
+func whiteoutTarget(root, parent, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", fmt.Errorf("%q doesn't name an entry", name)
+	}
+	hidden := filepath.Join(parent, name)
+	if filepath.Dir(hidden) != filepath.Clean(parent) || !isBelow(root, hidden) {
+		return "", fmt.Errorf("%q escapes the rootfs", name)
+	}
+	return hidden, nil
+}
+
+// isBelow tells whether p is strictly below the directory root
+func isBelow(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// removeLowerEntries implements an opaque whiteout by removing every child
+// of dir that was not written by the current layer.
+func removeLowerEntries(dir, rel string, current map[string]bool) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		if current[path.Join(rel, e.Name())] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractLayer unpacks a (possibly gzip, zstd or xz compressed) layer tarball
+// on top of root, honoring OCI whiteouts and preserving ownership, modes,
+// times and hard links. Layers must be applied in manifest order.
+func extractLayer(r io.Reader, root string) error {
+	stream, err := decompressStream(r)
+	if err != nil {
+		return fmt.Errorf("failed to decompress layer: %s", err)
+	}
+	defer stream.Close()
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+
+	type dirTimes struct {
+		path  string
+		mtime time.Time
+		atime time.Time
+	}
+	var dirs []dirTimes
+	current := make(map[string]bool)
+
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed reading layer: %s", err)
+		}
+
+		rel, err := cleanEntryPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if rel == "" {
+			continue
+		}
+		dir, base := path.Split(rel)
+
+		parent, err := secureDir(root, dir)
+		if err != nil {
+			return err
+		}
+
+		if base == whiteoutOpaque {
+			if err := removeLowerEntries(parent, path.Clean(dir), current); err != nil {
+				return fmt.Errorf("failed applying opaque whiteout in %q: %s", dir, err)
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			hidden, err := whiteoutTarget(root, parent, strings.TrimPrefix(base, whiteoutPrefix))
+			if err != nil {
+				return fmt.Errorf("invalid whiteout %q: %s", rel, err)
+			}
+			if err := os.RemoveAll(hidden); err != nil {
+				return fmt.Errorf("failed applying whiteout %q: %s", rel, err)
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		target := filepath.Join(parent, base)
+		current[rel] = true
+
+		if fi, err := os.Lstat(target); err == nil {
+			if !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+				if err := os.RemoveAll(target); err != nil {
+					return err
+				}
+			}
+		}
+
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+				return err
+			}
+
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed writing %q: %s", rel, err)
+			}
+
+		case tar.TypeSymlink:
+			if !path.IsAbs(hdr.Linkname) {
+				if _, err := cleanEntryPath(path.Join(dir, hdr.Linkname)); err != nil {
+					return fmt.Errorf("symlink %q -> %q escapes the rootfs", rel, hdr.Linkname)
+				}
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+
+		case tar.TypeLink:
+			linkRel, err := cleanEntryPath(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			// the source is resolved entirely, a link to a symlink
+			// would otherwise be followed by link(2) out of the rootfs
+			source, err := secureDir(root, linkRel)
+			if err != nil {
+				return err
+			}
+			if fi, err := os.Lstat(source); err != nil || fi.IsDir() {
+				return fmt.Errorf("hard link %q -> %q has no file to link to", rel, hdr.Linkname)
+			}
+			if err := os.Link(source, target); err != nil {
+				return fmt.Errorf("failed linking %q to %q: %s", rel, hdr.Linkname, err)
+			}
+			// Hard links share the inode of their source, which
+			// already carries the right metadata.
+			continue
+
+		case tar.TypeFifo:
+			if err := syscall.Mkfifo(target, uint32(mode.Perm())); err != nil {
+				return err
+			}
+
+		case tar.TypeChar, tar.TypeBlock:
+			// Device nodes are provided by devfs inside the jail
+			continue
+
+		default:
+			continue
+		}
+
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return fmt.Errorf("failed setting owner of %q: %s", rel, err)
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			continue
+		}
+		// chmod after chown, otherwise setuid/setgid bits are cleared
+		if err := os.Chmod(target, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+		atime := hdr.AccessTime
+		if atime.IsZero() {
+			atime = hdr.ModTime
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{path: target, mtime: hdr.ModTime, atime: atime})
+		} else if err := os.Chtimes(target, atime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+
+	// Directory times are restored last, since populating a directory
+	// updates its mtime.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chtimes(dirs[i].path, dirs[i].atime, dirs[i].mtime)
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// tarEntry is an entry of a layer built by testLayer
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+func file(name, body string) tarEntry {
+	return tarEntry{name: name, typeflag: tar.TypeReg, body: body}
+}
+
+func dir(name string) tarEntry {
+	return tarEntry{name: name, typeflag: tar.TypeDir}
+}
+
+func symlink(name, target string) tarEntry {
+	return tarEntry{name: name, typeflag: tar.TypeSymlink, linkname: target}
+}
+
+func hardlink(name, target string) tarEntry {
+	return tarEntry{name: name, typeflag: tar.TypeLink, linkname: target}
+}
+
+func testLayer(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.body))}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// testRoot returns a rootfs in a temporary directory next to a sibling
+// directory holding a file, the rootfs must never touch either
+func testRoot(t *testing.T) (root, outside string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	root = filepath.Join(dir, "rootfs")
+	outside = filepath.Join(dir, "outside")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root, outside
+}
+
+func assertOutsideIntact(t *testing.T, outside string) {
+	t.Helper()
+	entries, err := ioutil.ReadDir(outside)
+	if err != nil {
+		t.Fatalf("outside directory is gone: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "secret" {
+		t.Fatalf("outside directory was modified: %v", entries)
+	}
+}
+
+func TestCleanEntryPath(t *testing.T) {
+	cases := []struct {
+		name string
+		want string
+		err  bool
+	}{
+		{"etc/passwd", "etc/passwd", false},
+		{"./etc//passwd", "etc/passwd", false},
+		{"/etc/passwd", "etc/passwd", false},
+		{"a/../b", "b", false},
+		{".", "", false},
+		{"../etc", "", true},
+		{"a/../../etc", "", true},
+		{"/../etc", "", true},
+	}
+	for _, c := range cases {
+		got, err := cleanEntryPath(c.name)
+		if (err != nil) != c.err {
+			t.Errorf("cleanEntryPath(%q) error = %v, want error %v", c.name, err, c.err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("cleanEntryPath(%q) = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSecureDir(t *testing.T) {
+	root, outside := testRoot(t)
+	for _, d := range []string{"usr/lib", "sub"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"lib":       "usr/lib",
+		"abs":       "/usr/lib",
+		"escape":    outside,
+		"sub/up":    "..",
+		"sub/climb": "../../..",
+		"loop":      "loop",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		rel  string
+		want string
+		err  bool
+	}{
+		{"usr/lib", "usr/lib", false},
+		{"lib", "usr/lib", false},
+		{"abs/x", "usr/lib/x", false},
+		{"escape/secret", strings.TrimPrefix(outside, "/") + "/secret", false},
+		{"sub/up/usr", "usr", false},
+		{"sub/climb", "", true},
+		{"..", "", true},
+		{"loop", "", true},
+	}
+	for _, c := range cases {
+		got, err := secureDir(root, c.rel)
+		if (err != nil) != c.err {
+			t.Errorf("secureDir(%q) error = %v, want error %v", c.rel, err, c.err)
+			continue
+		}
+		if err == nil && got != filepath.Join(root, c.want) {
+			t.Errorf("secureDir(%q) = %q, want %q", c.rel, got, filepath.Join(root, c.want))
+		}
+	}
+}
+
+func TestExtractLayerWhiteouts(t *testing.T) {
+	root, outside := testRoot(t)
+	lower := testLayer(t,
+		dir("etc"), file("etc/keep", "keep"), file("etc/gone", "gone"),
+		dir("opaque"), file("opaque/old", "old"),
+	)
+	if err := extractLayer(lower, root); err != nil {
+		t.Fatal(err)
+	}
+	upper := testLayer(t,
+		file("etc/.wh.gone", ""),
+		dir("opaque"), file("opaque/new", "new"), file("opaque/.wh..wh..opq", ""),
+	)
+	if err := extractLayer(upper, root); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"etc/keep", "opaque/new"} {
+		if _, err := os.Stat(filepath.Join(root, p)); err != nil {
+			t.Errorf("%s should exist: %s", p, err)
+		}
+	}
+	for _, p := range []string{"etc/gone", "opaque/old", "etc/.wh.gone", "opaque/.wh..wh..opq"} {
+		if _, err := os.Lstat(filepath.Join(root, p)); !os.IsNotExist(err) {
+			t.Errorf("%s should not exist", p)
+		}
+	}
+	assertOutsideIntact(t, outside)
+}
+
+func TestExtractLayerRejectsEscapes(t *testing.T) {
+	cases := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"whiteout of the parent", []tarEntry{dir("etc"), file("etc/.wh...", "")}},
+		{"whiteout of the rootfs parent", []tarEntry{file(".wh...", "")}},
+		{"whiteout of nothing", []tarEntry{file(".wh.", "")}},
+		{"whiteout of dot", []tarEntry{dir("etc"), file("etc/.wh..", "")}},
+		{"dot dot entry", []tarEntry{file("../outside/secret", "pwned")}},
+		{"nested dot dot entry", []tarEntry{dir("etc"), file("etc/../../outside/secret", "pwned")}},
+		{"relative symlink escape", []tarEntry{dir("etc"), symlink("etc/up", "../../outside")}},
+		{"dot dot hard link", []tarEntry{hardlink("secret", "../outside/secret")}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root, outside := testRoot(t)
+			if err := extractLayer(testLayer(t, c.entries...), root); err == nil {
+				t.Fatal("expected an error")
+			}
+			assertOutsideIntact(t, outside)
+			if _, err := os.Stat(root); err != nil {
+				t.Fatalf("rootfs was removed: %s", err)
+			}
+		})
+	}
+}
+
+func TestExtractLayerAbsoluteSymlinkStaysInRoot(t *testing.T) {
+	root, outside := testRoot(t)
+	// the link is fine inside the jail, but writing through it must land in
+	// the rootfs rather than on the host
+	layer := testLayer(t,
+		symlink("escape", outside),
+		file("escape/secret", "pwned"),
+		file("escape/new", "new"),
+	)
+	if err := extractLayer(layer, root); err != nil {
+		t.Fatal(err)
+	}
+	assertOutsideIntact(t, outside)
+	buf, err := ioutil.ReadFile(filepath.Join(outside, "secret"))
+	if err != nil || string(buf) != "secret" {
+		t.Fatalf("host file was overwritten: %q %v", buf, err)
+	}
+	buf, err = ioutil.ReadFile(filepath.Join(root, outside, "secret"))
+	if err != nil || string(buf) != "pwned" {
+		t.Fatalf("file should be written below the rootfs: %q %v", buf, err)
+	}
+}
+
+func TestExtractLayerHardlinkThroughSymlink(t *testing.T) {
+	root, outside := testRoot(t)
+	layer := testLayer(t,
+		symlink("passwd", filepath.Join(outside, "secret")),
+		hardlink("stolen", "passwd"),
+	)
+	if err := extractLayer(layer, root); err == nil {
+		t.Fatal("expected an error linking to a file outside the rootfs")
+	}
+	fi, err := os.Stat(filepath.Join(outside, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "stolen")); err == nil {
+		if other, err := os.Stat(filepath.Join(root, "stolen")); err == nil && os.SameFile(fi, other) {
+			t.Fatal("hard link points at the host file")
+		}
+	}
+}
+
+func TestExtractLayerHardlink(t *testing.T) {
+	root, _ := testRoot(t)
+	layer := testLayer(t,
+		dir("bin"), file("bin/sh", "shell"),
+		hardlink("bin/csh", "bin/sh"),
+	)
+	if err := extractLayer(layer, root); err != nil {
+		t.Fatal(err)
+	}
+	a, err := os.Stat(filepath.Join(root, "bin/sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(filepath.Join(root, "bin/csh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Fatal("bin/csh should be a hard link of bin/sh")
+	}
+}
+
+func TestExtractLayerGzip(t *testing.T) {
+	root, _ := testRoot(t)
+	plain := testLayer(t, file("hello", "world"))
+	compressed := &bytes.Buffer{}
+	zw := gzip.NewWriter(compressed)
+	zw.Write(plain.Bytes())
+	zw.Close()
+	if err := extractLayer(compressed, root); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(root, "hello"))
+	if err != nil || string(buf) != "world" {
+		t.Fatalf("got %q %v", buf, err)
+	}
+}
+
+func TestMissingDecompressors(t *testing.T) {
+	bin, err := ioutil.TempDir("", "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+	if err := ioutil.WriteFile(filepath.Join(bin, "xz"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+
+	if missing := missingDecompressors(); len(missing) != 1 || missing[0] != "zstd" {
+		t.Fatalf("missingDecompressors() = %v", missing)
+	}
+	_, err = decompressStream(bytes.NewReader(append(append([]byte{}, zstdMagic...), 0, 0)))
+	if err == nil || !strings.Contains(err.Error(), "zstd") {
+		t.Fatalf("expected an error naming zstd, got %v", err)
+	}
+
+	d := &Driver{logger: hclog.NewNullLogger()}
+	attrs := d.buildFingerprint().Attributes
+	for name, want := range map[string]bool{"zstd": false, "xz": true} {
+		got, ok := attrs["driver.jail.decompressor."+name].GetBool()
+		if !ok || got != want {
+			t.Errorf("%s attribute = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// FirewallConfig is the firewall block of a task. A direction is only
+// restricted when its list is set, to the peers it lists.
+type FirewallConfig struct {
+	// AllowEgress lists what the jail may connect to
+	AllowEgress []string `codec:"allow_egress"`
+
+	// AllowIngressFrom lists who may connect to the jail
+	AllowIngressFrom []string `codec:"allow_ingress_from"`
+}
+
+func (c FirewallConfig) enabled() bool {
+	return len(c.AllowEgress) > 0 || len(c.AllowIngressFrom) > 0
+}
+
+// firewallPeer is an entry of the allow lists, an address, CIDR or any,
+// optionally followed by port <port or range> and proto <tcp|udp|icmp|icmp6>
+type firewallPeer struct {
+	addr  string
+	ipv4  bool
+	ipv6  bool
+	port  string
+	proto string
+}
+
+func parseFirewallPeer(s string) (firewallPeer, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return firewallPeer{}, fmt.Errorf("empty firewall entry")
+	}
+	p := firewallPeer{addr: fields[0], ipv4: true, ipv6: true}
+	if p.addr != "any" {
+		ip, n, err := net.ParseCIDR(p.addr)
+		if err != nil {
+			if ip = net.ParseIP(p.addr); ip == nil {
+				return firewallPeer{}, fmt.Errorf("invalid firewall entry %q, expected an address, a CIDR or any", s)
+			}
+		} else {
+			p.addr = n.String()
+		}
+		p.ipv4, p.ipv6 = ip.To4() != nil, ip.To4() == nil
+	}
+
+	for rest := fields[1:]; len(rest) > 0; rest = rest[2:] {
+		if len(rest) < 2 {
+			return firewallPeer{}, fmt.Errorf("invalid firewall entry %q, %s needs a value", s, rest[0])
+		}
+		switch rest[0] {
+		case "port":
+			if !validPortRange(rest[1]) {
+				return firewallPeer{}, fmt.Errorf("invalid port %q in firewall entry %q", rest[1], s)
+			}
+			p.port = rest[1]
+		case "proto":
+			switch rest[1] {
+			case "tcp", "udp", "icmp", "icmp6":
+			default:
+				return firewallPeer{}, fmt.Errorf("invalid proto %q in firewall entry %q", rest[1], s)
+			}
+			p.proto = rest[1]
+		default:
+			return firewallPeer{}, fmt.Errorf("invalid firewall entry %q, unknown %s", s, rest[0])
+		}
+	}
+	if len(p.port) > 0 && (p.proto == "icmp" || p.proto == "icmp6") {
+		return firewallPeer{}, fmt.Errorf("invalid firewall entry %q, %s has no ports", s, p.proto)
+	}
+	return p, nil
+}
+
+// validPortRange accepts a port or a range of ports like 8000:8080
+func validPortRange(s string) bool {
+	for _, part := range strings.SplitN(s, ":", 2) {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 1 || n > 65535 {
+			return false
+		}
+	}
+	return true
+}
+
+// protoClause is the proto part of a rule for the peer
+func (p firewallPeer) protoClause() string {
+	switch {
+	case len(p.proto) > 0:
+		return "proto " + p.proto + " "
+	case len(p.port) > 0:
+		return "proto { tcp udp } "
+	}
+	return ""
+}
+
+func (p firewallPeer) portClause() string {
+	if len(p.port) == 0 {
+		return ""
+	}
+	return " port " + p.port
+}
+
+// renderFirewall renders the pf rules of a task firewall for the jail
+// addresses, without touching pf. Replies to allowed connections pass with
+// their state, everything else to or from the jail is dropped. A direction
+// left open passes with state too, so the replies of its connections aren't
+// dropped by the other direction. Entries of a family the jail has no
+// address of are left out.
+func renderFirewall(c FirewallConfig, jailIPs []net.IP) (string, error) {
+	if len(jailIPs) == 0 {
+		return "", fmt.Errorf("the firewall needs the addresses of the jail")
+	}
+	var v4, v6 bool
+	var addrs []string
+	for _, ip := range jailIPs {
+		v4, v6 = v4 || ip.To4() != nil, v6 || ip.To4() == nil
+		addrs = append(addrs, ip.String())
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "table <jail> const { %s }\n", strings.Join(addrs, ", "))
+	rules := []struct {
+		entries []string
+		render  func(p firewallPeer) string
+		open    string
+		block   string
+	}{
+		{c.AllowEgress, func(p firewallPeer) string {
+			return "pass quick " + p.protoClause() + "from <jail> to " + p.addr + p.portClause()
+		}, "pass quick from <jail> to any keep state\n", "block drop quick from <jail> to any\n"},
+		{c.AllowIngressFrom, func(p firewallPeer) string {
+			return "pass quick " + p.protoClause() + "from " + p.addr + " to <jail>" + p.portClause()
+		}, "pass quick from any to <jail> keep state\n", "block drop quick from any to <jail>\n"},
+	}
+	for _, r := range rules {
+		if len(r.entries) == 0 {
+			b.WriteString(r.open)
+			continue
+		}
+		for _, e := range r.entries {
+			p, err := parseFirewallPeer(e)
+			if err != nil {
+				return "", err
+			}
+			if (p.ipv4 && v4) || (p.ipv6 && v6) {
+				b.WriteString(r.render(p) + "\n")
+			}
+		}
+		b.WriteString(r.block)
+	}
+	return b.String(), nil
+}
+
+// firewallAnchor is the anchor of the firewall of the jail name
+func firewallAnchor(name string) string {
+	return pfAnchorRoot + "/" + name
+}
+
+// loadFirewall loads the rules of the task firewall in its anchor in a
+// single transaction, replacing those of an earlier start
+func loadFirewall(name string, c FirewallConfig, jailIPs []net.IP) (string, error) {
+	rules, err := renderFirewall(c, jailIPs)
+	if err != nil {
+		return "", err
+	}
+	if err := checkPf(); err != nil {
+		return "", err
+	}
+	anchor := firewallAnchor(name)
+	if err := pfctl(anchor, []byte(rules), "-f", "-"); err != nil {
+		return "", err
+	}
+	return anchor, nil
+}
+
+// checkPf fails unless pf is enabled and pf.conf evaluates the anchors of
+// the driver, rules loaded otherwise would silently filter nothing
+func checkPf() error {
+	out, err := exec.Command("pfctl", "-s", "info").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("pfctl -s info failed: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	if !pfEnabled(string(out)) {
+		return fmt.Errorf("the firewall needs pf enabled, run pfctl -e")
+	}
+	out, err = exec.Command("pfctl", "-s", "Anchors").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("pfctl -s Anchors failed: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	if !pfHasAnchor(string(out), pfAnchorRoot) {
+		return fmt.Errorf("the firewall needs anchor \"%s/*\" in pf.conf", pfAnchorRoot)
+	}
+	return nil
+}
+
+// pfEnabled tells whether the output of pfctl -s info shows pf enabled
+func pfEnabled(info string) bool {
+	for _, line := range strings.Split(info, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "Status:" {
+			return fields[1] == "Enabled"
+		}
+	}
+	return false
+}
+
+// pfHasAnchor tells whether the output of pfctl -s Anchors lists anchor
+func pfHasAnchor(anchors, anchor string) bool {
+	for _, line := range strings.Split(anchors, "\n") {
+		name := strings.TrimSpace(line)
+		if name == anchor || name == anchor+"/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// configuredAddresses are the addresses the jail is created with, from the
+// ip4.addr and ip6.addr params or the network block of VNET jails
+func configuredAddresses(params map[string]string, nc NetworkConfig, lease *poolLease) ([]net.IP, error) {
+	var addrs []string
+	if nc.Mode == networkModeVnet {
+		v4, v6, err := vnetAddresses(nc, lease)
+		if err != nil {
+			return nil, err
+		}
+		if v4 == "dhcp" {
+			return nil, fmt.Errorf("the firewall needs static addresses, not dhcp")
+		}
+		addrs = append(addrs, v4, v6)
+	} else {
+		addrs = append(strings.Split(params["ip4.addr"], ","), strings.Split(params["ip6.addr"], ",")...)
+	}
+
+	var ips []net.IP
+	for _, a := range addrs {
+		a = a[strings.LastIndex(a, "|")+1:]
+		if ip := net.ParseIP(strings.SplitN(strings.TrimSpace(a), "/", 2)[0]); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// releaseFirewall flushes the firewall anchor of the task, once
+func (h *taskHandle) releaseFirewall() {
+	h.stateLock.Lock()
+	anchor := h.firewall
+	h.firewall = ""
+	h.stateLock.Unlock()
+
+	if len(anchor) == 0 {
+		return
+	}
+	if err := pfctl(anchor, nil, "-F", "all"); err != nil {
+		h.logger.Warn("failed to flush task firewall", "anchor", anchor, "error", err)
+	}
+}
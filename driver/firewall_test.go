@@ -0,0 +1,179 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestRenderFirewall(t *testing.T) {
+	v4 := []net.IP{net.ParseIP("192.0.2.10")}
+	v6 := []net.IP{net.ParseIP("2001:db8::10")}
+	dual := append(append([]net.IP{}, v4...), v6...)
+
+	cases := []struct {
+		name   string
+		config FirewallConfig
+		ips    []net.IP
+		want   string
+		err    bool
+	}{
+		{
+			name:   "egress only",
+			config: FirewallConfig{AllowEgress: []string{"10.0.5.0/24 port 5432", "any port 53 proto udp"}},
+			ips:    v4,
+			want: "table <jail> const { 192.0.2.10 }\n" +
+				"pass quick proto { tcp udp } from <jail> to 10.0.5.0/24 port 5432\n" +
+				"pass quick proto udp from <jail> to any port 53\n" +
+				"block drop quick from <jail> to any\n" +
+				"pass quick from any to <jail> keep state\n",
+		},
+		{
+			name:   "ingress only",
+			config: FirewallConfig{AllowIngressFrom: []string{"192.0.2.0/24", "198.51.100.7 port 8000:8080 proto tcp"}},
+			ips:    v4,
+			want: "table <jail> const { 192.0.2.10 }\n" +
+				"pass quick from <jail> to any keep state\n" +
+				"pass quick from 192.0.2.0/24 to <jail>\n" +
+				"pass quick proto tcp from 198.51.100.7 to <jail> port 8000:8080\n" +
+				"block drop quick from any to <jail>\n",
+		},
+		{
+			name: "both",
+			config: FirewallConfig{
+				AllowEgress:      []string{"any proto icmp"},
+				AllowIngressFrom: []string{"10.1.2.3/8"},
+			},
+			ips: v4,
+			want: "table <jail> const { 192.0.2.10 }\n" +
+				"pass quick proto icmp from <jail> to any\n" +
+				"block drop quick from <jail> to any\n" +
+				"pass quick from 10.0.0.0/8 to <jail>\n" +
+				"block drop quick from any to <jail>\n",
+		},
+		{
+			name:   "ipv6 jail skips ipv4 entries",
+			config: FirewallConfig{AllowEgress: []string{"10.0.0.0/8", "2001:db8:1::/48 port 443", "any proto icmp6"}},
+			ips:    v6,
+			want: "table <jail> const { 2001:db8::10 }\n" +
+				"pass quick proto { tcp udp } from <jail> to 2001:db8:1::/48 port 443\n" +
+				"pass quick proto icmp6 from <jail> to any\n" +
+				"block drop quick from <jail> to any\n" +
+				"pass quick from any to <jail> keep state\n",
+		},
+		{
+			name:   "dual stack",
+			config: FirewallConfig{AllowIngressFrom: []string{"10.0.0.1", "2001:db8::1"}},
+			ips:    dual,
+			want: "table <jail> const { 192.0.2.10, 2001:db8::10 }\n" +
+				"pass quick from <jail> to any keep state\n" +
+				"pass quick from 10.0.0.1 to <jail>\n" +
+				"pass quick from 2001:db8::1 to <jail>\n" +
+				"block drop quick from any to <jail>\n",
+		},
+		{name: "invalid cidr", config: FirewallConfig{AllowEgress: []string{"10.0.0.0/33"}}, ips: v4, err: true},
+		{name: "invalid address", config: FirewallConfig{AllowIngressFrom: []string{"10.0.0.256"}}, ips: v4, err: true},
+		{name: "hostname", config: FirewallConfig{AllowEgress: []string{"example.com"}}, ips: v4, err: true},
+		{name: "no jail address", config: FirewallConfig{AllowEgress: []string{"any"}}, err: true},
+	}
+	for _, c := range cases {
+		got, err := renderFirewall(c.config, c.ips)
+		if (err != nil) != c.err {
+			t.Errorf("%s: error = %v, want error %v", c.name, err, c.err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseFirewallPeer(t *testing.T) {
+	cases := []struct {
+		entry string
+		want  firewallPeer
+		err   bool
+	}{
+		{entry: "any", want: firewallPeer{addr: "any", ipv4: true, ipv6: true}},
+		{entry: "10.0.5.7/24", want: firewallPeer{addr: "10.0.5.0/24", ipv4: true}},
+		{entry: "2001:db8::1", want: firewallPeer{addr: "2001:db8::1", ipv6: true}},
+		{entry: "any port 53 proto udp", want: firewallPeer{addr: "any", ipv4: true, ipv6: true, port: "53", proto: "udp"}},
+		{entry: "any proto tcp port 1:1024", want: firewallPeer{addr: "any", ipv4: true, ipv6: true, port: "1:1024", proto: "tcp"}},
+		{entry: "", err: true},
+		{entry: "any port", err: true},
+		{entry: "any port 0", err: true},
+		{entry: "any port 65536", err: true},
+		{entry: "any port 80:http", err: true},
+		{entry: "any proto sctp", err: true},
+		{entry: "any port 1 proto icmp", err: true},
+		{entry: "any to 10.0.0.1", err: true},
+	}
+	for _, c := range cases {
+		got, err := parseFirewallPeer(c.entry)
+		if (err != nil) != c.err {
+			t.Errorf("parseFirewallPeer(%q) error = %v, want error %v", c.entry, err, c.err)
+			continue
+		}
+		if !c.err && got != c.want {
+			t.Errorf("parseFirewallPeer(%q) = %+v, want %+v", c.entry, got, c.want)
+		}
+	}
+}
+
+func TestConfiguredAddresses(t *testing.T) {
+	params := map[string]string{
+		"ip4.addr": "em0|192.0.2.10/24,192.0.2.11",
+		"ip6.addr": "lo1|2001:db8::10/64",
+	}
+	got, err := configuredAddresses(params, NetworkConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("192.0.2.11"), net.ParseIP("2001:db8::10")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	got, err = configuredAddresses(nil, NetworkConfig{Mode: networkModeVnet, IPv4: "10.0.0.5/24"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !got[0].Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("vnet jail addresses are %v", got)
+	}
+
+	if _, err := configuredAddresses(nil, NetworkConfig{Mode: networkModeVnet, IPv4: "dhcp"}, nil); err == nil {
+		t.Error("dhcp addresses can't be filtered")
+	}
+}
+
+func TestPfStatus(t *testing.T) {
+	enabled := "Status: Enabled for 0 days 01:02:03           Debug: Urgent\n\nState Table                          Total             Rate\n"
+	disabled := "Status: Disabled for 0 days 00:00:10          Debug: Urgent\n"
+	if !pfEnabled(enabled) || pfEnabled(disabled) || pfEnabled("") {
+		t.Error("wrong pf status")
+	}
+
+	cases := []struct {
+		anchors string
+		want    bool
+	}{
+		{"  jail-task-driver\n  blacklistd\n", true},
+		{"  blacklistd\n  jail-task-driver/*\n", true},
+		{"  blacklistd\n", false},
+		{"  jail-task-driver-old\n", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := pfHasAnchor(c.anchors, pfAnchorRoot); got != c.want {
+			t.Errorf("pfHasAnchor(%q) = %v, want %v", c.anchors, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// GCConfig is the image garbage collection policy of the plugin config
+type GCConfig struct {
+	Enabled    bool   `codec:"enabled"`
+	Interval   string `codec:"interval"`
+	ImageTTL   string `codec:"image_ttl"`
+	ImageDelay string `codec:"image_delay"`
+	MaxSizeMB  int64  `codec:"max_size_mb"`
+}
+
+// gcPolicy is the parsed form of GCConfig
+type gcPolicy struct {
+	// interval between two collections
+	interval time.Duration
+
+	// ttl keeps images used within this period, 0 disables it
+	ttl time.Duration
+
+	// delay is how long an image has to be unused before it can be removed
+	delay time.Duration
+
+	// maxSize is the store size enforced by evicting the least recently
+	// used images, 0 disables it
+	maxSize int64
+}
+
+func (c GCConfig) policy() (*gcPolicy, error) {
+	p := &gcPolicy{maxSize: c.MaxSizeMB * 1024 * 1024}
+	var err error
+	if p.interval, err = time.ParseDuration(c.Interval); err != nil || p.interval <= 0 {
+		return nil, fmt.Errorf("invalid gc interval %q", c.Interval)
+	}
+	if len(c.ImageTTL) > 0 {
+		if p.ttl, err = time.ParseDuration(c.ImageTTL); err != nil {
+			return nil, fmt.Errorf("invalid gc image_ttl %q: %s", c.ImageTTL, err)
+		}
+	}
+	if len(c.ImageDelay) > 0 {
+		if p.delay, err = time.ParseDuration(c.ImageDelay); err != nil {
+			return nil, fmt.Errorf("invalid gc image_delay %q: %s", c.ImageDelay, err)
+		}
+	}
+	return p, nil
+}
+
+// runGC collects images periodically until ctx is done
+func (s *imageStore) runGC(ctx context.Context, p *gcPolicy) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			removed, reclaimed, err := s.collect(p, start)
+			if err != nil {
+				s.logger.Error("image gc failed", "error", err)
+				continue
+			}
+			metrics.IncrCounter([]string{"jail_task_driver", "image_gc", "reclaimed_bytes"}, float32(reclaimed))
+			s.logger.Info("image gc completed", "removed", removed,
+				"reclaimed_bytes", reclaimed, "duration", time.Since(start))
+		}
+	}
+}
+
+// collect removes the images allowed by the policy. Images used by tasks or
+// used more recently than the delay are never removed. The others are
+// removed once they outlive the ttl, or least recently used first while the
+// store is above its maximum size.
+func (s *imageStore) collect(p *gcPolicy, now time.Time) (int, int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	imgs, err := s.images()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var total int64
+	var candidates []*imageRecord
+	for _, img := range imgs {
+		total += img.Size
+		if len(s.users[img.ID]) > 0 || now.Sub(img.LastUsed) < p.delay {
+			continue
+		}
+		candidates = append(candidates, img)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LastUsed.Before(candidates[j].LastUsed)
+	})
+
+	removed := make(map[string]*imageRecord)
+	var reclaimed int64
+	for _, img := range candidates {
+		expired := p.ttl > 0 && now.Sub(img.LastUsed) > p.ttl
+		oversize := p.maxSize > 0 && total > p.maxSize
+		if !expired && !oversize {
+			continue
+		}
+
+		unpacked := img.Size - s.blobsSize(img)
+		if err := s.backend.Remove(img); err != nil {
+			s.logger.Error("failed to remove image", "image", img.ID, "error", err)
+			continue
+		}
+		if err := os.RemoveAll(s.imageDir(img.ID)); err != nil {
+			s.logger.Error("failed to remove image", "image", img.ID, "error", err)
+			continue
+		}
+		s.logger.Debug("removed image", "image", img.ID, "last_used", img.LastUsed)
+		removed[img.ID] = img
+		if unpacked > 0 {
+			reclaimed += unpacked
+		}
+		total -= img.Size
+	}
+	if len(removed) == 0 {
+		return 0, 0, nil
+	}
+
+	unlock, err := s.lockFile()
+	if err != nil {
+		return len(removed), reclaimed, err
+	}
+	defer unlock()
+	repos, err := s.repositories()
+	if err != nil {
+		return len(removed), reclaimed, err
+	}
+	for ref, id := range repos {
+		if _, ok := removed[id]; ok {
+			delete(repos, ref)
+		}
+	}
+	if err := s.writeRepositories(repos); err != nil {
+		return len(removed), reclaimed, err
+	}
+
+	// Only blobs of removed images are swept, blobs of images still being
+	// pulled are not referenced by any record yet.
+	referenced := make(map[digest.Digest]bool)
+	for _, img := range imgs {
+		if _, ok := removed[img.ID]; ok {
+			continue
+		}
+		for _, blob := range imageBlobs(img) {
+			referenced[blob] = true
+		}
+	}
+	for _, img := range removed {
+		for _, blob := range imageBlobs(img) {
+			if referenced[blob] {
+				continue
+			}
+			if fi, err := os.Stat(s.blobPath(blob)); err == nil {
+				if err := os.Remove(s.blobPath(blob)); err == nil {
+					reclaimed += fi.Size()
+				}
+			}
+			referenced[blob] = true
+		}
+	}
+	return len(removed), reclaimed, nil
+}
+
+func imageBlobs(img *imageRecord) []digest.Digest {
+	return append([]digest.Digest{img.Manifest, img.Config}, img.Layers...)
+}
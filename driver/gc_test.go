@@ -0,0 +1,215 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	hclog "github.com/hashicorp/go-hclog"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// gcImage stores an image made of a layer shared by every test image and a
+// layer of its own, last used at lastUsed and tagged name
+func gcImage(t *testing.T, s *imageStore, name string, lastUsed time.Time) *imageRecord {
+	t.Helper()
+	put := func(body []byte) digest.Digest {
+		d, _, err := s.putBlob(bytes.NewReader(body), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	shared := put(testLayer(t, file("shared", "shared")).Bytes())
+	own := put(testLayer(t, file(name, strings.Repeat(name, 1024))).Bytes())
+	config := put([]byte(`{"os":"freebsd","name":"` + name + `"}`))
+	manifest := put([]byte(`{"name":"` + name + `"}`))
+
+	img, err := s.createImage(manifest, config, []digest.Digest{shared, own})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.LastUsed = lastUsed
+	if err := s.writeImage(img); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.tag(name+":1", img.ID); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func assertCollected(t *testing.T, s *imageStore, kept, removed []*imageRecord) {
+	t.Helper()
+	for _, img := range kept {
+		if _, err := s.image(img.ID); err != nil {
+			t.Errorf("image %s should be kept: %s", img.ID, err)
+		}
+		for _, blob := range imageBlobs(img) {
+			if !s.hasBlob(blob) {
+				t.Errorf("blob %s of kept image %s was removed", blob, img.ID)
+			}
+		}
+	}
+	repos, err := s.repositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range removed {
+		if _, err := os.Stat(s.imageDir(img.ID)); !os.IsNotExist(err) {
+			t.Errorf("image %s should be removed", img.ID)
+		}
+		for ref, id := range repos {
+			if id == img.ID {
+				t.Errorf("%s still points at removed image %s", ref, img.ID)
+			}
+		}
+		for _, blob := range []digest.Digest{img.Manifest, img.Config, img.Layers[1]} {
+			if s.hasBlob(blob) {
+				t.Errorf("blob %s of removed image %s was kept", blob, img.ID)
+			}
+		}
+	}
+}
+
+func TestGCConfigPolicy(t *testing.T) {
+	p, err := GCConfig{Interval: "10m", ImageTTL: "24h", ImageDelay: "1h", MaxSizeMB: 2}.policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.interval != 10*time.Minute || p.ttl != 24*time.Hour || p.delay != time.Hour || p.maxSize != 2*1024*1024 {
+		t.Fatalf("got policy %+v", p)
+	}
+	for _, c := range []GCConfig{
+		{Interval: ""},
+		{Interval: "0s"},
+		{Interval: "10m", ImageTTL: "a day"},
+		{Interval: "10m", ImageDelay: "soon"},
+	} {
+		if _, err := c.policy(); err == nil {
+			t.Errorf("expected an error for %+v", c)
+		}
+	}
+}
+
+func TestGCRemovesExpiredImages(t *testing.T) {
+	s := testStore(t)
+	now := time.Now()
+	old := gcImage(t, s, "old", now.Add(-48*time.Hour))
+	recent := gcImage(t, s, "recent", now.Add(-time.Hour))
+	inUse := gcImage(t, s, "used", now.Add(-48*time.Hour))
+	s.users[inUse.ID] = map[string]bool{"task": true}
+
+	removed, reclaimed, err := s.collect(&gcPolicy{ttl: 24 * time.Hour}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || reclaimed <= 0 {
+		t.Fatalf("removed %d images reclaiming %d bytes, want 1", removed, reclaimed)
+	}
+	assertCollected(t, s, []*imageRecord{recent, inUse}, []*imageRecord{old})
+}
+
+func TestGCEvictsLeastRecentlyUsed(t *testing.T) {
+	s := testStore(t)
+	now := time.Now()
+	oldest := gcImage(t, s, "oldest", now.Add(-3*time.Hour))
+	older := gcImage(t, s, "older", now.Add(-2*time.Hour))
+	newest := gcImage(t, s, "newest", now.Add(-time.Hour))
+
+	// room for two images
+	maxSize := oldest.Size + older.Size + newest.Size - 1
+	removed, _, err := s.collect(&gcPolicy{maxSize: maxSize}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("removed %d images, want 1", removed)
+	}
+	assertCollected(t, s, []*imageRecord{older, newest}, []*imageRecord{oldest})
+}
+
+func TestGCKeepsImagesWithinDelay(t *testing.T) {
+	s := testStore(t)
+	now := time.Now()
+	fresh := gcImage(t, s, "fresh", now.Add(-time.Minute))
+	stale := gcImage(t, s, "stale", now.Add(-time.Hour))
+
+	// the store is over any size, but fresh was used too recently
+	removed, _, err := s.collect(&gcPolicy{maxSize: 1, delay: 10 * time.Minute}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("removed %d images, want 1", removed)
+	}
+	assertCollected(t, s, []*imageRecord{fresh}, []*imageRecord{stale})
+}
+
+func TestGCWithoutLimits(t *testing.T) {
+	s := testStore(t)
+	img := gcImage(t, s, "old", time.Now().Add(-24*365*time.Hour))
+	removed, reclaimed, err := s.collect(&gcPolicy{interval: time.Minute}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 || reclaimed != 0 {
+		t.Fatalf("removed %d images reclaiming %d bytes without ttl or size", removed, reclaimed)
+	}
+	assertCollected(t, s, []*imageRecord{img}, nil)
+}
+
+func TestRunGCReportsReclaimedBytes(t *testing.T) {
+	conf := TelemetryConfig{DisableHostname: true}.metricsConfig()
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	if _, err := metrics.NewGlobal(conf, sink); err != nil {
+		t.Fatal(err)
+	}
+	defer metrics.NewGlobal(conf, &metrics.BlackholeSink{})
+
+	logs := &bytes.Buffer{}
+	s := testStore(t)
+	s.logger = hclog.New(&hclog.LoggerOptions{Output: logs, Level: hclog.Info})
+	old := gcImage(t, s, "old", time.Now().Add(-48*time.Hour))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.runGC(ctx, &gcPolicy{interval: 10 * time.Millisecond, ttl: time.Hour})
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := s.image(old.ID); err != nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	assertCollected(t, s, nil, []*imageRecord{old})
+
+	var reclaimed float64
+	for _, interval := range sink.Data() {
+		if c, ok := interval.Counters["jail_task_driver.image_gc.reclaimed_bytes"]; ok {
+			reclaimed += c.Sum
+		}
+	}
+	if reclaimed <= 0 {
+		t.Errorf("reclaimed bytes didn't reach the sink")
+	}
+	if !strings.Contains(logs.String(), "reclaimed_bytes") {
+		t.Errorf("reclaimed bytes aren't logged: %q", logs.String())
+	}
+}
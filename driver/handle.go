@@ -31,6 +31,46 @@ type taskHandle struct {
 	startedAt   time.Time
 	completedAt time.Time
 	exitResult  *drivers.ExitResult
+
+	// imageID is the image in the store the task rootfs was created from
+	imageID string
+
+	// mounts are the filesystems mounted by the driver in the rootfs, in
+	// mount order
+	mounts []string
+
+	// ephemeral is the dataset cloned from Path for the task
+	ephemeral string
+
+	// aliases are the addresses the driver aliased on host interfaces for
+	// the jail, as interface|address
+	aliases []string
+
+	// epair is the epair created for network mode vnet, without its a or b
+	// suffix
+	epair string
+
+	// firewall is the pf anchor of the task firewall
+	firewall string
+
+	// containerName is the name of the jail, a child of the parent jail of
+	// the allocation when the task shares its network
+	containerName string
+
+	// shared is the parent jail the task is a child of
+	shared string
+
+	// shaping is the dummynet setup of network_limits, sampled until
+	// shapingCancel is called
+	shaping       *shaping
+	shapingCancel context.CancelFunc
+
+	// dns is how the task appears in the hosts of its allocation
+	dns *dnsFiles
+
+	// portMap maps port labels to the ports exposed by the image, for tasks
+	// without port_map
+	portMap map[string]int
 }
 
 func (h *taskHandle) TaskStatus() *drivers.TaskStatus {
@@ -60,7 +100,7 @@ func (h *taskHandle) run() {
 	}
 	h.stateLock.Unlock()
 
-	containerName := fmt.Sprintf("%s-%s", h.taskConfig.Name, h.taskConfig.AllocID)
+	containerName := h.containerName
 
 	for IsJailActive(containerName) {
 		time.Sleep(containerMonitorIntv)
@@ -71,6 +111,10 @@ func (h *taskHandle) run() {
 		return
 	}
 
+	// the jail is gone, don't keep its addresses on the host
+	h.releaseAliases()
+	h.releaseVnet()
+
 	h.stateLock.Lock()
 	defer h.stateLock.Unlock()
 
@@ -104,9 +148,8 @@ func keysToVal(line string) (string, uint64, error) {
 }
 
 func (h *taskHandle) Exec(ctx context.Context, cmd string, args []string) (*drivers.ExecTaskResult, error) {
-	containerName := fmt.Sprintf("%s-%s", h.taskConfig.Name, h.taskConfig.AllocID)
 	fullCmd := make([]string, len(args)+1)
-	fullCmd[0] = containerName
+	fullCmd[0] = h.containerName
 	fullCmd[1] = cmd
 	copy(fullCmd[2:], args)
 	execResult := &drivers.ExecTaskResult{ExitResult: &drivers.ExitResult{}}
@@ -135,9 +178,8 @@ func (h *taskHandle) Exec(ctx context.Context, cmd string, args []string) (*driv
 // shutdown shuts down the container, with `timeout` grace period
 // before shutdown a zone.
 func (h *taskHandle) shutdown(timeout time.Duration) error {
-	containerName := fmt.Sprintf("%s-%s", h.taskConfig.Name, h.taskConfig.AllocID)
 	args := []string{"-r"}
-	args = append(args, containerName)
+	args = append(args, h.containerName)
 	time.Sleep(timeout)
 
 	out, err := exec.Command("jail", args...).Output()
@@ -0,0 +1,240 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// imageConfig reads the config of img from the image store
+func (s *imageStore) imageConfig(img *imageRecord) (*ocispec.Image, error) {
+	buf, err := s.readBlob(img.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading image config %s: %s", img.Config, err)
+	}
+
+	var config struct {
+		ocispec.Image
+
+		// ContainerConfig is the config of the container the image was
+		// committed from, only used by images lacking a runtime config
+		ContainerConfig *ocispec.ImageConfig `json:"container_config,omitempty"`
+	}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return nil, fmt.Errorf("failed decoding image config %s: %s", img.Config, err)
+	}
+
+	if isZeroConfig(config.Config) && config.ContainerConfig != nil {
+		config.Config = *config.ContainerConfig
+	}
+	return &config.Image, nil
+}
+
+func isZeroConfig(c ocispec.ImageConfig) bool {
+	return len(c.Entrypoint) == 0 && len(c.Cmd) == 0 && len(c.Env) == 0 &&
+		len(c.User) == 0 && len(c.WorkingDir) == 0
+}
+
+// imageArgv is the command of a task. Like docker, an entrypoint set by the
+// task drops the cmd of the image, and args replace the cmd.
+func imageArgv(c *ocispec.ImageConfig, entrypoint, args []string) []string {
+	argv := c.Entrypoint
+	cmd := c.Cmd
+	if len(entrypoint) > 0 {
+		argv = entrypoint
+		cmd = nil
+	}
+	if len(args) > 0 {
+		cmd = args
+	}
+	return append(append([]string{}, argv...), cmd...)
+}
+
+// shellQuote quotes every argument so the shell jail(8) runs exec.start
+// with passes them unchanged.
+func shellQuote(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// startCommand runs argv in the working directory of the image with the
+// environment of the image, overridden by the environment of the task.
+func startCommand(c *ocispec.ImageConfig, env map[string]string, argv []string) string {
+	cmd := "exec /usr/bin/env -i " + shellQuote(append(taskEnv(c, env), argv...))
+	if len(c.WorkingDir) > 0 {
+		cmd = "cd " + shellQuote([]string{c.WorkingDir}) + " && " + cmd
+	}
+	return cmd
+}
+
+// taskEnv merges the environment of the task, like the NOMAD_ variables,
+// over the environment of the image
+func taskEnv(c *ocispec.ImageConfig, env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	add := make([]string, len(keys))
+	for i, k := range keys {
+		add[i] = k + "=" + env[k]
+	}
+	return setEnv(append([]string{}, c.Env...), add)
+}
+
+// stopCommand sends the stop signal of the image to every process in the
+// jail, before jail(8) sends SIGTERM to the ones left.
+func stopCommand(signal string) (string, error) {
+	sig := strings.TrimPrefix(strings.ToUpper(signal), "SIG")
+	if _, err := strconv.Atoi(sig); err != nil && !isSignalName(sig) {
+		return "", fmt.Errorf("invalid image stop signal %q", signal)
+	}
+	return "kill -s " + sig + " -1", nil
+}
+
+func isSignalName(sig string) bool {
+	for _, c := range sig {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return len(sig) > 0
+}
+
+// jailUser maps the user of the image, a name or uid optionally followed by
+// a group, to the login name exec.jail_user expects, looking uids up in the
+// passwd file of the rootfs. Jails run as the primary group of the user, so
+// a group other than that one is refused.
+func jailUser(root, user string) (string, error) {
+	parts := strings.SplitN(user, ":", 2)
+	name := parts[0]
+	_, err := strconv.Atoi(name)
+	if err != nil && len(parts) == 1 {
+		return name, nil
+	}
+
+	passwd, err := lookupEntry(root, "/etc/passwd", name)
+	if err != nil {
+		return "", err
+	}
+	if len(parts) == 1 || len(parts[1]) == 0 || parts[1] == passwd[3] {
+		return passwd[0], nil
+	}
+	group, err := lookupEntry(root, "/etc/group", parts[1])
+	if err != nil {
+		return "", err
+	}
+	if group[2] != passwd[3] {
+		return "", fmt.Errorf("image user %s: jails run as the primary group of %s, not %s", user, passwd[0], parts[1])
+	}
+	return passwd[0], nil
+}
+
+// lookupEntry finds the entry of the passwd or group file of the rootfs
+// named key, or with key as its id
+func lookupEntry(root, file, key string) ([]string, error) {
+	path, err := securePath(root, file)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot look %s up: %s", key, err)
+	}
+	defer f.Close()
+
+	var byID []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 4 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == key {
+			return fields, nil
+		}
+		if fields[2] == key && byID == nil {
+			byID = fields
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading the image %s file: %s", file, err)
+	}
+	if byID == nil {
+		return nil, fmt.Errorf("%s not found in the image %s file", key, file)
+	}
+	return byID, nil
+}
+
+// createVolumes creates the volume directories of the image in the rootfs
+func createVolumes(root string, volumes map[string]struct{}) error {
+	for v := range volumes {
+		dir, err := secureDir(root, v)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create volume %s: %s", v, err)
+		}
+	}
+	return nil
+}
+
+// exposedPorts lists the port numbers exposed by the image, which are
+// keyed like "80/tcp"
+func exposedPorts(c *ocispec.ImageConfig) []int {
+	seen := make(map[int]bool)
+	var ports []int
+	for p := range c.ExposedPorts {
+		port, err := strconv.Atoi(strings.SplitN(p, "/", 2)[0])
+		if err != nil || port <= 0 || port > 65535 || seen[port] {
+			continue
+		}
+		seen[port] = true
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// imagePortMap maps the nomad port labels of a task without port_map to
+// the ports exposed by its image. A label naming an exposed port, like
+// "8080", maps to it, and when the image exposes a single port it is the
+// target of the only label left.
+func imagePortMap(c *ocispec.ImageConfig, labels []string) map[string]int {
+	ports := exposedPorts(c)
+	exposed := make(map[int]bool)
+	for _, p := range ports {
+		exposed[p] = true
+	}
+
+	mapped := make(map[string]int)
+	var left []string
+	for _, label := range labels {
+		if p, err := strconv.Atoi(label); err == nil && exposed[p] {
+			mapped[label] = p
+			continue
+		}
+		left = append(left, label)
+	}
+	if len(ports) == 1 && len(left) == 1 && len(mapped) == 0 {
+		mapped[left[0]] = ports[0]
+	}
+	return mapped
+}
@@ -0,0 +1,257 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func exposing(ports ...string) *ocispec.ImageConfig {
+	c := &ocispec.ImageConfig{ExposedPorts: make(map[string]struct{})}
+	for _, p := range ports {
+		c.ExposedPorts[p] = struct{}{}
+	}
+	return c
+}
+
+func TestExposedPorts(t *testing.T) {
+	got := exposedPorts(exposing("8080/tcp", "53/udp", "53/tcp", "443", "http/tcp", "70000/tcp"))
+	if want := []int{53, 443, 8080}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestImagePortMap(t *testing.T) {
+	cases := []struct {
+		name   string
+		config *ocispec.ImageConfig
+		labels []string
+		want   map[string]int
+	}{
+		{"single port and label", exposing("80/tcp"), []string{"http"}, map[string]int{"http": 80}},
+		{"label names the port", exposing("80/tcp", "443/tcp"), []string{"443", "admin"}, map[string]int{"443": 443}},
+		{"numeric label not exposed", exposing("80/tcp"), []string{"8080"}, map[string]int{"8080": 80}},
+		{"several ports", exposing("80/tcp", "443/tcp"), []string{"http"}, map[string]int{}},
+		{"several labels", exposing("80/tcp"), []string{"http", "metrics"}, map[string]int{}},
+		{"no exposed ports", exposing(), []string{"http"}, map[string]int{}},
+		{"no labels", exposing("80/tcp"), nil, map[string]int{}},
+		{"same port on both protocols", exposing("53/tcp", "53/udp"), []string{"dns"}, map[string]int{"dns": 53}},
+	}
+	for _, c := range cases {
+		if got := imagePortMap(c.config, c.labels); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestImageArgv(t *testing.T) {
+	image := &ocispec.ImageConfig{Entrypoint: []string{"/bin/app"}, Cmd: []string{"serve", "-v"}}
+	cases := []struct {
+		name       string
+		config     *ocispec.ImageConfig
+		entrypoint []string
+		args       []string
+		want       []string
+	}{
+		{"image command", image, nil, nil, []string{"/bin/app", "serve", "-v"}},
+		{"args replace the cmd", image, nil, []string{"check"}, []string{"/bin/app", "check"}},
+		{"entrypoint drops the cmd", image, []string{"/bin/sh"}, nil, []string{"/bin/sh"}},
+		{"entrypoint and args", image, []string{"/bin/sh"}, []string{"-c", "true"}, []string{"/bin/sh", "-c", "true"}},
+		{"cmd only", &ocispec.ImageConfig{Cmd: []string{"/bin/sh"}}, nil, nil, []string{"/bin/sh"}},
+		{"no command", &ocispec.ImageConfig{}, nil, nil, []string{}},
+	}
+	for _, c := range cases {
+		if got := imageArgv(c.config, c.entrypoint, c.args); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+	if !reflect.DeepEqual(image.Entrypoint, []string{"/bin/app"}) {
+		t.Errorf("the image config was modified: %v", image.Entrypoint)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	cases := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"/bin/app"}, "'/bin/app'"},
+		{[]string{"echo", "$HOME", "a b"}, "'echo' '$HOME' 'a b'"},
+		{[]string{"it's"}, `'it'\''s'`},
+		{[]string{""}, "''"},
+		{nil, ""},
+	}
+	for _, c := range cases {
+		if got := shellQuote(c.argv); got != c.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", c.argv, got, c.want)
+		}
+	}
+}
+
+func TestStartCommand(t *testing.T) {
+	image := &ocispec.ImageConfig{Env: []string{"PATH=/bin", "MODE=image"}}
+	cases := []struct {
+		name   string
+		config *ocispec.ImageConfig
+		env    map[string]string
+		want   string
+	}{
+		{"image env", image, nil, "exec /usr/bin/env -i 'PATH=/bin' 'MODE=image' '/bin/app'"},
+		{
+			"task env over the image env", image,
+			map[string]string{"NOMAD_TASK_NAME": "web", "MODE": "task"},
+			"exec /usr/bin/env -i 'PATH=/bin' 'MODE=task' 'NOMAD_TASK_NAME=web' '/bin/app'",
+		},
+		{
+			"working directory", &ocispec.ImageConfig{WorkingDir: "/srv/my app"}, nil,
+			"cd '/srv/my app' && exec /usr/bin/env -i '/bin/app'",
+		},
+	}
+	for _, c := range cases {
+		if got := startCommand(c.config, c.env, []string{"/bin/app"}); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+	if !reflect.DeepEqual(image.Env, []string{"PATH=/bin", "MODE=image"}) {
+		t.Errorf("the image env was modified: %v", image.Env)
+	}
+}
+
+func TestStopCommand(t *testing.T) {
+	cases := []struct {
+		signal string
+		want   string
+	}{
+		{"SIGTERM", "kill -s TERM -1"},
+		{"sigquit", "kill -s QUIT -1"},
+		{"HUP", "kill -s HUP -1"},
+		{"9", "kill -s 9 -1"},
+		{"", ""},
+		{"SIGTERM; rm -rf /", ""},
+		{"SIG1X", ""},
+	}
+	for _, c := range cases {
+		got, err := stopCommand(c.signal)
+		if len(c.want) == 0 {
+			if err == nil {
+				t.Errorf("stopCommand(%q) = %s, expected an error", c.signal, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("stopCommand(%q) = %s, %v, want %s", c.signal, got, err, c.want)
+		}
+	}
+}
+
+func TestJailUser(t *testing.T) {
+	root, err := ioutil.TempDir("", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"etc/passwd": "# users\nroot:*:0:0:Charlie &:/root:/bin/sh\nwww:*:80:80:World Wide Web Owner:/nonexistent:/usr/sbin/nologin\n",
+		"etc/group":  "wheel:*:0:root\nwww:*:80:\nstaff:*:20:www\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		user string
+		want string
+	}{
+		{"www", "www"},
+		{"80", "www"},
+		{"0", "root"},
+		{"www:www", "www"},
+		{"www:80", "www"},
+		{"80:www", "www"},
+		{"root:wheel", "root"},
+		{"www:", "www"},
+		{"nobody", "nobody"},
+		{"www:staff", ""},
+		{"www:0", ""},
+		{"www:nogroup", ""},
+		{"1000", ""},
+		{"nobody:nobody", ""},
+	}
+	for _, c := range cases {
+		got, err := jailUser(root, c.user)
+		if len(c.want) == 0 {
+			if err == nil {
+				t.Errorf("jailUser(%q) = %s, expected an error", c.user, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("jailUser(%q) = %s, %v, want %s", c.user, got, err, c.want)
+		}
+	}
+}
+
+func TestImageConfigFallback(t *testing.T) {
+	s := testStore(t)
+	cases := []struct {
+		name   string
+		config string
+		want   ocispec.ImageConfig
+	}{
+		{
+			"runtime config",
+			`{"config":{"Cmd":["/bin/app"]},"container_config":{"Cmd":["/bin/sh","-c","#(nop) build"]}}`,
+			ocispec.ImageConfig{Cmd: []string{"/bin/app"}},
+		},
+		{
+			"container config of an image without runtime config",
+			`{"container_config":{"Cmd":["/bin/app"],"Env":["A=b"]}}`,
+			ocispec.ImageConfig{Cmd: []string{"/bin/app"}, Env: []string{"A=b"}},
+		},
+		{
+			"runtime config with only a user",
+			`{"config":{"User":"www"},"container_config":{"Cmd":["/bin/app"]}}`,
+			ocispec.ImageConfig{User: "www"},
+		},
+		{"no config", `{}`, ocispec.ImageConfig{}},
+	}
+	for _, c := range cases {
+		d, _, err := s.putBlob(strings.NewReader(c.config), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := s.imageConfig(&imageRecord{Config: d})
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if !reflect.DeepEqual(img.Config, c.want) {
+			got, _ := json.Marshal(img.Config)
+			t.Errorf("%s: got %s", c.name, got)
+		}
+	}
+
+	if !isZeroConfig(ocispec.ImageConfig{}) {
+		t.Error("an empty config is zero")
+	}
+	if isZeroConfig(ocispec.ImageConfig{WorkingDir: "/srv"}) {
+		t.Error("a config with a working directory is not zero")
+	}
+}
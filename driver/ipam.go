@@ -0,0 +1,325 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+const (
+	// leaseReapDelay leaves tasks time to be recovered after the plugin
+	// starts before the leases of missing tasks are released
+	leaseReapDelay = time.Minute
+
+	// maxLeaseScan bounds the addresses tried in large pools, like the
+	// 2^64 of an IPv6 /64
+	maxLeaseScan = 1 << 16
+)
+
+// leasesBucket holds a bucket of leases, keyed by address, per pool
+var leasesBucket = []byte("leases")
+
+// IPAMConfig is the address allocation of the plugin config
+type IPAMConfig struct {
+	// DB is the BoltDB file leases are persisted in
+	DB    string         `codec:"db"`
+	Pools []IPPoolConfig `codec:"pool"`
+}
+
+// IPPoolConfig is a pool of addresses tasks get leased one of
+type IPPoolConfig struct {
+	Name      string `codec:"name"`
+	Interface string `codec:"interface"`
+
+	// IPv4 and IPv6 are the CIDRs of the pool, either may be empty
+	IPv4 string `codec:"ipv4"`
+	IPv6 string `codec:"ipv6"`
+
+	// Exclude lists addresses and CIDRs never leased, like gateways
+	Exclude []string `codec:"exclude"`
+}
+
+// ipPool is the parsed form of IPPoolConfig
+type ipPool struct {
+	name    string
+	iface   string
+	v4      *net.IPNet
+	v6      *net.IPNet
+	exclude []*net.IPNet
+}
+
+// ipLease is an address leased to a task
+type ipLease struct {
+	TaskID  string    `json:"task_id"`
+	AllocID string    `json:"alloc_id"`
+	Task    string    `json:"task"`
+	Created time.Time `json:"created"`
+}
+
+// poolLease are the addresses of a pool leased to a task, with the prefix
+// length of the pool
+type poolLease struct {
+	Interface string
+	IPv4      *net.IPNet
+	IPv6      *net.IPNet
+}
+
+// jailAddrs formats the addresses as ip4.addr and ip6.addr values
+func (l *poolLease) jailAddrs() (string, string) {
+	var v4, v6 string
+	if l.IPv4 != nil {
+		v4 = l.Interface + "|" + l.IPv4.String()
+	}
+	if l.IPv6 != nil {
+		v6 = l.Interface + "|" + l.IPv6.String()
+	}
+	return v4, v6
+}
+
+// ipam leases the addresses of the configured pools to tasks
+type ipam struct {
+	db      *bolt.DB
+	pools   map[string]*ipPool
+	started time.Time
+	logger  hclog.Logger
+}
+
+func parsePool(c IPPoolConfig) (*ipPool, error) {
+	if len(c.Name) == 0 || len(c.Interface) == 0 {
+		return nil, fmt.Errorf("ip pools need a name and an interface")
+	}
+	p := &ipPool{name: c.Name, iface: c.Interface}
+	var err error
+	if len(c.IPv4) > 0 {
+		if _, p.v4, err = net.ParseCIDR(c.IPv4); err != nil || p.v4.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid ipv4 CIDR %q of pool %s", c.IPv4, c.Name)
+		}
+	}
+	if len(c.IPv6) > 0 {
+		if _, p.v6, err = net.ParseCIDR(c.IPv6); err != nil || p.v6.IP.To4() != nil {
+			return nil, fmt.Errorf("invalid ipv6 CIDR %q of pool %s", c.IPv6, c.Name)
+		}
+	}
+	if p.v4 == nil && p.v6 == nil {
+		return nil, fmt.Errorf("pool %s has no addresses", c.Name)
+	}
+	for _, e := range c.Exclude {
+		if !strings.Contains(e, "/") {
+			if strings.Contains(e, ":") {
+				e += "/128"
+			} else {
+				e += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude %q of pool %s", e, c.Name)
+		}
+		p.exclude = append(p.exclude, n)
+	}
+	return p, nil
+}
+
+func newIPAM(c IPAMConfig, logger hclog.Logger) (*ipam, error) {
+	a := &ipam{
+		pools:   make(map[string]*ipPool),
+		started: time.Now(),
+		logger:  logger.Named("ipam"),
+	}
+	for _, pc := range c.Pools {
+		p, err := parsePool(pc)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := a.pools[p.name]; ok {
+			return nil, fmt.Errorf("duplicate ip pool %s", p.name)
+		}
+		a.pools[p.name] = p
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.DB), 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(c.DB, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lease db %s: %s", c.DB, err)
+	}
+	a.db = db
+	return a, nil
+}
+
+// lease gives the task an address from each family of the pool. A task
+// already holding addresses of the pool, like one being recovered, gets the
+// same ones again.
+func (a *ipam) lease(pool, taskID, allocID, task string) (*poolLease, error) {
+	p, ok := a.pools[pool]
+	if !ok {
+		return nil, fmt.Errorf("unknown ip pool %q", pool)
+	}
+	l := &poolLease{Interface: p.iface}
+	record, err := json.Marshal(ipLease{TaskID: taskID, AllocID: allocID, Task: task, Created: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		leases, err := tx.CreateBucketIfNotExists(leasesBucket)
+		if err != nil {
+			return err
+		}
+		b, err := leases.CreateBucketIfNotExists([]byte(pool))
+		if err != nil {
+			return err
+		}
+
+		held := make(map[bool]net.IP)
+		b.ForEach(func(k, v []byte) error {
+			var existing ipLease
+			if json.Unmarshal(v, &existing) == nil && existing.TaskID == taskID {
+				ip := net.ParseIP(string(k))
+				held[ip.To4() != nil] = ip
+			}
+			return nil
+		})
+
+		for _, n := range []*net.IPNet{p.v4, p.v6} {
+			if n == nil {
+				continue
+			}
+			isV4 := n.IP.To4() != nil
+			ip, ok := held[isV4]
+			if !ok {
+				if ip, err = p.free(n, b); err != nil {
+					return err
+				}
+				if err := b.Put([]byte(ip.String()), record); err != nil {
+					return err
+				}
+			}
+			addr := &net.IPNet{IP: ip, Mask: n.Mask}
+			if isV4 {
+				l.IPv4 = addr
+			} else {
+				l.IPv6 = addr
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// free finds the first address of n neither leased in b nor excluded. The
+// network and broadcast addresses of IPv4 pools are skipped.
+func (p *ipPool) free(n *net.IPNet, b *bolt.Bucket) (net.IP, error) {
+	ones, bits := n.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	first := big.NewInt(1)
+	last := new(big.Int).Sub(size, big.NewInt(1))
+	if n.IP.To4() == nil {
+		last = size
+	}
+	if last.Cmp(big.NewInt(maxLeaseScan)) > 0 {
+		last = big.NewInt(maxLeaseScan)
+	}
+
+	base := new(big.Int).SetBytes(n.IP)
+	for i := new(big.Int).Set(first); i.Cmp(last) < 0; i.Add(i, big.NewInt(1)) {
+		ip := bigToIP(new(big.Int).Add(base, i), len(n.IP))
+		if p.excluded(ip) || b.Get([]byte(ip.String())) != nil {
+			continue
+		}
+		return ip, nil
+	}
+	return nil, fmt.Errorf("ip pool %s has no free address in %s", p.name, n)
+}
+
+func (p *ipPool) excluded(ip net.IP) bool {
+	for _, e := range p.exclude {
+		if e.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func bigToIP(i *big.Int, size int) net.IP {
+	buf := i.Bytes()
+	ip := make(net.IP, size)
+	copy(ip[size-len(buf):], buf)
+	return ip
+}
+
+// release frees every address leased to the task
+func (a *ipam) release(taskID string) error {
+	return a.reap(func(l ipLease) bool { return l.TaskID != taskID })
+}
+
+// reap deletes the leases keep returns false for
+func (a *ipam) reap(keep func(ipLease) bool) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		leases := tx.Bucket(leasesBucket)
+		if leases == nil {
+			return nil
+		}
+		return leases.ForEach(func(pool, _ []byte) error {
+			b := leases.Bucket(pool)
+			if b == nil {
+				return nil
+			}
+			var stale [][]byte
+			b.ForEach(func(k, v []byte) error {
+				var l ipLease
+				if json.Unmarshal(v, &l) != nil || !keep(l) {
+					a.logger.Info("releasing address", "pool", string(pool), "address", string(k), "task", l.TaskID)
+					stale = append(stale, append([]byte{}, k...))
+				}
+				return nil
+			})
+			for _, k := range stale {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// reapOrphans releases, once recovered tasks had time to come back, the
+// leases held from before the plugin started by tasks it does not know.
+func (a *ipam) reapOrphans(ctx context.Context, known func(taskID string) bool) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(leaseReapDelay):
+	}
+	err := a.reap(func(l ipLease) bool {
+		return l.Created.After(a.started) || known(l.TaskID)
+	})
+	if err != nil {
+		a.logger.Error("failed to reap orphaned leases", "error", err)
+	}
+}
+
+func (a *ipam) close() error {
+	return a.db.Close()
+}
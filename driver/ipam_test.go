@@ -0,0 +1,229 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+func testIPAM(t *testing.T, pools ...IPPoolConfig) *ipam {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	a, err := newIPAM(IPAMConfig{DB: filepath.Join(dir, "leases.db"), Pools: pools}, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.close() })
+	return a
+}
+
+func assertLease(t *testing.T, l *poolLease, v4, v6 string) {
+	t.Helper()
+	var got4, got6 string
+	if l.IPv4 != nil {
+		got4 = l.IPv4.String()
+	}
+	if l.IPv6 != nil {
+		got6 = l.IPv6.String()
+	}
+	if got4 != v4 || got6 != v6 {
+		t.Fatalf("leased %q %q, want %q %q", got4, got6, v4, v6)
+	}
+}
+
+func TestParsePool(t *testing.T) {
+	cases := []struct {
+		name string
+		c    IPPoolConfig
+		err  bool
+	}{
+		{"ipv4", IPPoolConfig{Name: "web", Interface: "em0", IPv4: "10.0.0.0/24"}, false},
+		{"dual stack", IPPoolConfig{Name: "web", Interface: "em0", IPv4: "10.0.0.0/24", IPv6: "fd00::/64", Exclude: []string{"10.0.0.1", "fd00::1", "10.0.0.128/25"}}, false},
+		{"no name", IPPoolConfig{Interface: "em0", IPv4: "10.0.0.0/24"}, true},
+		{"no interface", IPPoolConfig{Name: "web", IPv4: "10.0.0.0/24"}, true},
+		{"no addresses", IPPoolConfig{Name: "web", Interface: "em0"}, true},
+		{"ipv6 as ipv4", IPPoolConfig{Name: "web", Interface: "em0", IPv4: "fd00::/64"}, true},
+		{"ipv4 as ipv6", IPPoolConfig{Name: "web", Interface: "em0", IPv6: "10.0.0.0/24"}, true},
+		{"invalid cidr", IPPoolConfig{Name: "web", Interface: "em0", IPv4: "10.0.0.0/33"}, true},
+		{"invalid exclude", IPPoolConfig{Name: "web", Interface: "em0", IPv4: "10.0.0.0/24", Exclude: []string{"gateway"}}, true},
+	}
+	for _, c := range cases {
+		if _, err := parsePool(c.c); (err != nil) != c.err {
+			t.Errorf("%s: parsePool() error = %v, want error %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestNewIPAMDuplicatePool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pool := IPPoolConfig{Name: "web", Interface: "em0", IPv4: "10.0.0.0/24"}
+	if _, err := newIPAM(IPAMConfig{DB: filepath.Join(dir, "leases.db"), Pools: []IPPoolConfig{pool, pool}}, hclog.NewNullLogger()); err == nil {
+		t.Fatal("expected an error for a duplicate pool")
+	}
+}
+
+func TestIPAMLease(t *testing.T) {
+	a := testIPAM(t, IPPoolConfig{
+		Name:      "web",
+		Interface: "em0",
+		IPv4:      "10.0.0.0/29",
+		IPv6:      "fd00::/64",
+		Exclude:   []string{"10.0.0.1", "10.0.0.4/31", "fd00::1"},
+	})
+
+	first, err := a.lease("web", "task-1", "alloc", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLease(t, first, "10.0.0.2/29", "fd00::2/64")
+	if v4, v6 := first.jailAddrs(); v4 != "em0|10.0.0.2/29" || v6 != "em0|fd00::2/64" {
+		t.Errorf("jail addresses are %q %q", v4, v6)
+	}
+
+	second, err := a.lease("web", "task-2", "alloc", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLease(t, second, "10.0.0.3/29", "fd00::3/64")
+
+	// a recovered task gets its addresses back
+	again, err := a.lease("web", "task-1", "alloc", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLease(t, again, "10.0.0.2/29", "fd00::2/64")
+
+	// .4 and .5 are excluded and .7 is the broadcast address
+	third, err := a.lease("web", "task-3", "alloc", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLease(t, third, "10.0.0.6/29", "fd00::4/64")
+	if _, err := a.lease("web", "task-4", "alloc", "cache"); err == nil {
+		t.Fatal("expected the pool to be exhausted")
+	}
+
+	if err := a.release("task-2"); err != nil {
+		t.Fatal(err)
+	}
+	fourth, err := a.lease("web", "task-4", "alloc", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLease(t, fourth, "10.0.0.3/29", "fd00::3/64")
+
+	if _, err := a.lease("other", "task-5", "alloc", "web"); err == nil {
+		t.Fatal("expected an error for an unknown pool")
+	}
+}
+
+func TestIPAMLeaseSingleFamily(t *testing.T) {
+	a := testIPAM(t,
+		IPPoolConfig{Name: "v4", Interface: "em0", IPv4: "192.0.2.0/30"},
+		IPPoolConfig{Name: "v6", Interface: "em1", IPv6: "2001:db8::/126"},
+	)
+	l, err := a.lease("v4", "task-1", "alloc", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLease(t, l, "192.0.2.1/30", "")
+	if _, v6 := l.jailAddrs(); v6 != "" {
+		t.Errorf("ipv6 jail address is %q", v6)
+	}
+
+	// IPv6 pools have no broadcast address, only the first one is skipped
+	for _, want := range []string{"2001:db8::1/126", "2001:db8::2/126", "2001:db8::3/126"} {
+		l, err := a.lease("v6", want, "alloc", "web")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertLease(t, l, "", want)
+	}
+	if _, err := a.lease("v6", "task-2", "alloc", "web"); err == nil {
+		t.Fatal("expected the pool to be exhausted")
+	}
+}
+
+func TestIPAMLeasesPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := IPAMConfig{DB: filepath.Join(dir, "leases.db"), Pools: []IPPoolConfig{{Name: "web", Interface: "em0", IPv4: "10.0.0.0/24"}}}
+
+	a, err := newIPAM(c, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.lease("web", "task-1", "alloc", "web"); err != nil {
+		t.Fatal(err)
+	}
+	a.close()
+
+	b, err := newIPAM(c, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+	l, err := b.lease("web", "task-2", "alloc", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLease(t, l, "10.0.0.2/24", "")
+}
+
+func TestIPAMReap(t *testing.T) {
+	a := testIPAM(t, IPPoolConfig{Name: "web", Interface: "em0", IPv4: "10.0.0.0/24"})
+	for _, id := range []string{"known", "orphan"} {
+		if _, err := a.lease("web", id, "alloc", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the leases above predate the plugin start, a task leasing after it
+	// isn't known yet while it starts
+	time.Sleep(10 * time.Millisecond)
+	a.started = time.Now()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := a.lease("web", "starting", "alloc", "starting"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := a.reap(func(l ipLease) bool {
+		return l.Created.After(a.started) || l.TaskID == "known"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := a.lease("web", "new", "alloc", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLease(t, l, "10.0.0.2/24", "")
+	for id, want := range map[string]string{"known": "10.0.0.1/24", "starting": "10.0.0.3/24"} {
+		l, err := a.lease("web", id, "alloc", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertLease(t, l, want, "")
+	}
+}
@@ -14,18 +14,15 @@ import "C"
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
-	"encoding/json"
 	"fmt"
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad/plugins/drivers"
-	"io"
-	"io/ioutil"
-	"net/http"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
 	"unsafe"
@@ -48,201 +45,20 @@ func simple_uuid() (string, error) {
 	return uuid, nil
 }
 
-func docker_getconfig(library string, tag string) (map[string]string, error) {
-	respo, erro := http.Get("https://auth.docker.io/token?service=registry.docker.io&scope=repository:" + library + ":pull&service=registry.docker.io")
-	if erro != nil {
-		fmt.Println("Failed getting token")
-		return nil, fmt.Errorf("failed to get token")
-	}
-	defer respo.Body.Close()
-	var result map[string]interface{}
-	json.NewDecoder(respo.Body).Decode(&result)
-	token := result["token"].(string)
-
-	//GET DIGEST
-	req, err2 := http.NewRequest("GET", "https://registry-1.docker.io/v2/"+library+"/manifests/"+tag, nil)
-	req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.v2+json")
-	req.Header.Add("Authorization", "Bearer "+string(token))
-	client := &http.Client{}
-	resp, err2 := client.Do(req)
-	if err2 != nil {
-		fmt.Println("Failed getting digest")
-		return nil, fmt.Errorf("Failed retrieving blobs")
-	}
-
-	var resultdigest map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&resultdigest)
-	if resultdigest["config"] == nil {
-		fmt.Println("Failed retriving digest ", resp.Header["Www-Authenticate"])
-		return nil, fmt.Errorf("Failed retrieving digest")
-	}
-	config := resultdigest["config"].(map[string]interface{})
-	digest := config["digest"].(string)
-	defer resp.Body.Close()
-
-	// GET CONTAINER CONFIG
-	digesturl := "https://registry-1.docker.io/v2/" + library + "/blobs/" + digest
-
-	req2, err3 := http.NewRequest("GET", digesturl, nil)
-	if err3 != nil {
-		fmt.Println("Failed retriving container config")
-		return nil, fmt.Errorf("Failed retrieving blobs")
-	}
-	req2.Header.Add("Authorization", "Bearer "+string(token))
-	req2.Header.Add("Accept", "application/vnd.docker.distribution.manifest.v2+json")
-
-	client2 := &http.Client{}
-	resp2, err4 := client2.Do(req2)
-	if err4 != nil {
-		return nil, fmt.Errorf("Failed retrieving image blob: ")
-	}
-
-	var result3 map[string]interface{}
-	json.NewDecoder(resp2.Body).Decode(&result3)
-	container_config := result3["container_config"].(map[string]interface{})
-
-	var execute []string
-	m := make(map[string]string)
-	var re = regexp.MustCompile(`([\[|\]])`)
-
-	if container_config["Entrypoint"] != nil {
-		entrypoint := container_config["Entrypoint"].([]interface{})
-		entry := fmt.Sprintf("%s", entrypoint)
-		m["entrypoint"] = re.ReplaceAllString(entry, "")
-	}
-
-	if container_config["Env"] != nil {
-		envi := container_config["Env"].([]interface{})
-		env := fmt.Sprintf("%s", envi)
-		m["env"] = re.ReplaceAllString(env, "")
-	}
-
-	if container_config["Cmd"] != nil {
-		cmds := container_config["Cmd"].([]interface{})
-		for _, v := range cmds {
-			if strings.Contains(v.(string), "CMD") {
-				scmd := strings.Replace(v.(string), `CMD`, " ", -1)
-				execute = append(execute, scmd)
-			}
-		}
-		if len(execute) > 0 {
-			cmdargs := strings.Join(execute, " ")
-			m["cmd"] = fmt.Sprintf("%s", re.ReplaceAllString(cmdargs, ""))
-		}
-	}
-
-	defer resp.Body.Close()
-
-	return m, nil
-}
-
+// RemoveDuplicatesFromSlice drops repeated entries, keeping the first
+// occurrence so that the original order is preserved.
 func RemoveDuplicatesFromSlice(s []string) []string {
 	m := make(map[string]bool)
+	var result []string
 	for _, item := range s {
-		if _, ok := m[item]; ok {
-		} else {
+		if _, ok := m[item]; !ok {
 			m[item] = true
+			result = append(result, item)
 		}
 	}
-
-	var result []string
-	for item, _ := range m {
-		result = append(result, item)
-	}
 	return result
 }
 
-func dockerpull(library string, tag string, path string) error {
-	resp, err := http.Get("https://auth.docker.io/token?service=registry.docker.io&scope=repository:" + library + ":pull")
-	if err != nil {
-		return fmt.Errorf("failed to get token from docker registry")
-	}
-	defer resp.Body.Close()
-	var result map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&result)
-	token := result["token"].(string)
-
-	req, err2 := http.NewRequest("GET", "https://registry-1.docker.io/v2/"+library+"/manifests/"+tag, nil)
-	req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.v2+json")
-	req.Header.Add("Authorization", "Bearer "+string(token))
-
-	client := &http.Client{}
-	resp, err2 = client.Do(req)
-	if err2 != nil {
-		return fmt.Errorf("Failed retrieving blobs")
-	}
-
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("Failed retrieving blobs")
-	}
-
-	defer resp.Body.Close()
-
-	schema := make(map[string]interface{})
-	json.Unmarshal(bodyBytes, &schema)
-	blobs := schema["layers"].([]interface{})
-	var gzblobs []string
-
-	for _, v := range blobs {
-		m := v.(map[string]interface{})
-		for k, o := range m {
-			if k == "digest" {
-				gzblobs = append(gzblobs, o.(string))
-			}
-		}
-	}
-
-	dedupblobs := RemoveDuplicatesFromSlice(gzblobs)
-
-	for _, blob := range dedupblobs {
-		url := "https://registry-1.docker.io/v2/" + library + "/blobs/" + blob
-		req, err := http.NewRequest("GET", url, nil)
-		req.Header.Add("Authorization", "Bearer "+string(token))
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			return fmt.Errorf("Failed retrieving image blob:%s err=%s ", blob, err)
-		}
-
-		out, err := os.Create("/tmp/" + blob + ".gz")
-		if err != nil {
-			return fmt.Errorf("Failed creating temporary image: %s")
-		}
-
-		_, err = io.Copy(out, resp.Body)
-
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			os.Mkdir(path, os.ModePerm)
-		}
-		args := []string{"xvfz", "/tmp/" + blob + ".gz", "-C", path}
-
-		if err := exec.Command("gtar", args...).Run(); err != nil {
-			return fmt.Errorf("error running gtar:%s", err, args)
-		}
-
-		cleanerr := os.Remove("/tmp/" + blob + ".gz")
-		if cleanerr != nil {
-			return fmt.Errorf("Failed cleaning up", cleanerr)
-		}
-
-		out.Close()
-		resp.Body.Close()
-	}
-	cargs := []string{"cvfz", path + ".tar.gz", "-C", path, "."}
-	if err := exec.Command("gtar", cargs...).Run(); err != nil {
-		return fmt.Errorf("error running compress: %s:%s", err, cargs)
-	}
-
-	cleanerr := os.RemoveAll(path)
-
-	if cleanerr != nil {
-		return fmt.Errorf("Failed cleaning up image dir %s", cleanerr)
-	}
-
-	return nil
-}
-
 func IsJailActive(jailname string) bool {
 	args := []string{"-n", "name"}
 	out, err := exec.Command("jls", args...).Output()
@@ -285,18 +101,25 @@ func isparamboolean(category string) bool {
 	return false
 }
 
-func Jailcmd(params map[string]string) (error, string) {
+// jailArgs formats params as arguments of jail(8)
+func jailArgs(params map[string]string) []string {
 	args := make([]string, 0)
-	args = append(args, "-cmr")
-
 	for k, v := range params {
 		if isparamboolean(k) {
 			args = append(args, k)
 		} else {
-			param := fmt.Sprintf(k + "=" + v)
+			param := k + "=" + v
 			args = append(args, param)
 		}
 	}
+	return args
+}
+
+func Jailcmd(params map[string]string) (error, string) {
+	args := make([]string, 0)
+	args = append(args, "-cmr")
+	args = append(args, jailArgs(params)...)
+
 	cmd := exec.Command("jail", args...)
 	buf := &bytes.Buffer{}
 	buferr := &bytes.Buffer{}
@@ -322,7 +145,7 @@ func Jailrctl(jname string, params map[string]uint64) error {
 	return nil
 }
 
-func (d *Driver) initializeContainer(cfg *drivers.TaskConfig, taskConfig TaskConfig) (int32, error) {
+func (d *Driver) initializeContainer(ctx context.Context, cfg *drivers.TaskConfig, taskConfig TaskConfig, h *taskHandle) (int32, error) {
 
 	jailparams := make(map[string]string)
 
@@ -335,6 +158,27 @@ func (d *Driver) initializeContainer(cfg *drivers.TaskConfig, taskConfig TaskCon
 		jailparams["path"] = filepath.Join(cfg.AllocDir, cfg.Name)
 	}
 
+	if err := checkPackages(taskConfig); err != nil {
+		return -1, err
+	}
+	if err := checkDNS(taskConfig); err != nil {
+		return -1, err
+	}
+
+	if taskConfig.Ephemeral {
+		if len(taskConfig.Path) == 0 || len(taskConfig.Image) != 0 || len(taskConfig.Docker) != 0 || len(taskConfig.BaseRelease) != 0 {
+			return -1, fmt.Errorf("ephemeral requires Path, jails created from images already get their own rootfs")
+		}
+		dest := filepath.Join(cfg.TaskDir().Dir, "ephemeral")
+		clone, mounted, err := createEphemeral(taskConfig.Path, jailparams["name"], dest)
+		if err != nil {
+			return -1, fmt.Errorf("failed to create ephemeral rootfs from %s: %s", taskConfig.Path, err)
+		}
+		h.ephemeral = clone
+		h.mounts = append(h.mounts, mounted...)
+		jailparams["path"] = dest
+	}
+
 	if len(taskConfig.Jid) > 0 {
 		jailparams["jid"] = taskConfig.Jid
 	}
@@ -362,6 +206,37 @@ func (d *Driver) initializeContainer(cfg *drivers.TaskConfig, taskConfig TaskCon
 		jailparams["vnet"] = taskConfig.Vnet
 	}
 
+	var lease *poolLease
+	if len(taskConfig.IPPool) > 0 {
+		if d.ipam == nil {
+			return -1, fmt.Errorf("ip_pool %s requested but no ipam pools are configured", taskConfig.IPPool)
+		}
+		if len(taskConfig.Ip4_addr) > 0 || len(taskConfig.Ip6_addr) > 0 || len(taskConfig.Vnet) > 0 {
+			return -1, fmt.Errorf("ip_pool can't be combined with Ip4_addr, Ip6_addr or Vnet")
+		}
+		var err error
+		// the parent jail of a shared network holds the lease for the
+		// whole allocation
+		owner := cfg.ID
+		if taskConfig.SharedNetwork {
+			owner = sharedJailName(cfg.AllocID)
+		}
+		lease, err = d.ipam.lease(taskConfig.IPPool, owner, cfg.AllocID, cfg.Name)
+		if err != nil {
+			return -1, fmt.Errorf("failed to lease an address from %s: %s", taskConfig.IPPool, err)
+		}
+		// VNET jails configure the leased addresses on their own interface
+		if taskConfig.Network.Mode != networkModeVnet {
+			v4, v6 := lease.jailAddrs()
+			if len(v4) > 0 {
+				jailparams["ip4.addr"] = v4
+			}
+			if len(v6) > 0 {
+				jailparams["ip6.addr"] = v6
+			}
+		}
+	}
+
 	if len(taskConfig.Host_hostname) > 1 {
 		jailparams["host.hostname"] = taskConfig.Host_hostname
 	}
@@ -567,60 +442,191 @@ func (d *Driver) initializeContainer(cfg *drivers.TaskConfig, taskConfig TaskCon
 
 	// Docker images + Entrypoint handling
 
-	if len(taskConfig.Docker) != 0 {
+	var img *imageRecord
+	var labels map[string]string
+	if len(taskConfig.Image) != 0 || len(taskConfig.Docker) != 0 || len(taskConfig.BaseRelease) != 0 {
+		if d.images == nil {
+			return -1, fmt.Errorf("image store is not configured")
+		}
+	}
+
+	if len(taskConfig.Image) != 0 {
+		// images built on the node are referenced by tag
+		img, _ = d.images.resolve(taskConfig.Image)
+		if img == nil {
+			path, err := resolveImagePath(cfg, taskConfig.Image)
+			if err != nil {
+				return -1, err
+			}
+			d.logger.Info("Importing image", "driver_initialize_container", hclog.Fmt("%v+", path))
+			img, err = d.images.coalesce(ctx, "import:"+path, nil, func(ctx context.Context, _ func(pullProgress)) (*imageRecord, error) {
+				return d.images.importImage(ctx, path, cfg.JobName)
+			})
+			if err != nil {
+				return -1, fmt.Errorf("image import failed %s", err)
+			}
+		}
+	} else if len(taskConfig.BaseRelease) != 0 {
+		d.logger.Info("Provisioning base release", "driver_initialize_container", hclog.Fmt("%v+", taskConfig.BaseRelease))
+		var err error
+		img, err = d.pullRelease(ctx, d.pullReporter(cfg), taskConfig.BaseRelease, taskConfig.BaseDistsets)
+		if err != nil {
+			return -1, fmt.Errorf("base release provisioning failed %s", err)
+		}
+	} else if len(taskConfig.Docker) != 0 {
 		s := strings.Split(taskConfig.Docker, " ")
 		d.logger.Info("Pulling image", "driver_initialize_container", hclog.Fmt("%v+", s))
-		uuid, _ := simple_uuid()
 		var library, tag string
-		if len(s) > 0 {
-			if len(s) > 1 {
-				library, tag = s[0], s[1]
-			} else {
-				library, tag = s[0], "latest"
+		if len(s) > 1 {
+			library, tag = s[0], s[1]
+		} else {
+			library, tag = s[0], "latest"
+		}
+		name := strings.Split(library, "/")
+		var libtag string
+		if len(name) > 1 {
+			libtag = s[0]
+		} else {
+			libtag = "library/" + s[0]
+		}
+		ref := imageRef{Registry: dockerHubRegistry, Repository: libtag, Reference: tag}
+		var err error
+		img, err = d.pullImage(ctx, cfg, ref, taskConfig.ForcePull)
+		if err != nil {
+			return -1, fmt.Errorf("docker pull failed %s", err)
+		}
+	}
+
+	// the OS of an image is known once it is in the store, Linux images are
+	// checked before the task gets packages, a rootfs or mounts
+	if img != nil {
+		image, err := d.images.imageConfig(img)
+		if err != nil {
+			return -1, err
+		}
+		if image.OS == "linux" {
+			if len(taskConfig.Packages) > 0 {
+				return -1, fmt.Errorf("packages cannot be installed in Linux images")
+			}
+			if err := ensureLinuxABI(); err != nil {
+				return -1, err
 			}
-			name := strings.Split(library, "/")
-			var libtag string
-			if len(name) > 1 {
-				library = name[1]
-				libtag = s[0]
-			} else {
-				libtag = "library/" + s[0]
-				library = name[0]
+		}
+	}
+
+	if img != nil && len(taskConfig.Packages) > 0 {
+		var err error
+		img, err = d.installPackages(ctx, cfg, img, taskConfig.Packages)
+		if err != nil {
+			return -1, fmt.Errorf("package installation failed %s", err)
+		}
+	} else if len(taskConfig.Packages) > 0 {
+		if err := pkgInstall(ctx, jailparams["path"], packageSet(taskConfig.Packages)); err != nil {
+			d.emitPkgFailure(cfg, err)
+			return -1, fmt.Errorf("package installation failed %s", err)
+		}
+	}
+
+	if img != nil {
+		if err := d.images.acquire(img.ID, cfg.ID); err != nil {
+			return -1, err
+		}
+		h.imageID = img.ID
+		// the rootfs is removed with the task, so a Path only receives
+		// one when it holds nothing else, or the rootfs of an earlier
+		// start of the task
+		if len(taskConfig.Path) > 0 && !isEmptyDir(taskConfig.Path) && !d.images.ownsRootfs(jailparams["name"], taskConfig.Path) {
+			return -1, fmt.Errorf("Path %s is not empty, the rootfs of images is only created in an empty or missing directory", taskConfig.Path)
+		}
+		switch taskConfig.RootfsMode {
+		case "", rootfsCopy:
+			path, err := d.images.createRootfs(img, jailparams["name"], jailparams["path"])
+			if err != nil {
+				return -1, err
 			}
-			path := "/tmp/" + library + "-" + tag + "-" + uuid
-			err := dockerpull(libtag, tag, path)
+			jailparams["path"] = path
+		default:
+			mounted, err := d.images.createSharedRootfs(img, taskConfig.RootfsMode, jailparams["path"])
 			if err != nil {
-				return -1, fmt.Errorf("docker pull failed %s", err)
+				return -1, err
 			}
+			h.mounts = mounted
+		}
+		if err := d.images.writeContainer(jailparams["name"], containerRecord{Image: img.ID, Rootfs: jailparams["path"], Owned: len(taskConfig.Path) > 0}); err != nil {
+			return -1, err
+		}
 
-			jailparams["exec.prestart"] = "\"" + "mount -t linsysfs linsysfs " + jailparams["path"] + "/sys" +
-				"; " + "mount -t linprocfs linprocfs " + jailparams["path"] + "/proc" + "\""
-			jailparams["exec.stop"] = "\"" + "umount " + jailparams["path"] + "/sys" + "; " + "umount  " +
-				jailparams["path"] + "/proc;" + "\""
+		image, err := d.images.imageConfig(img)
+		if err != nil {
+			return -1, err
+		}
+		c := &image.Config
+		labels = c.Labels
 
-			m, err := docker_getconfig(libtag, tag)
+		if image.OS == "linux" {
+			ruleset := taskConfig.Devfs_ruleset
+			if len(ruleset) == 0 {
+				ruleset = defaultDevfsRuleset
+			}
+			// devfs is mounted by the driver, before the tmpfs of /dev/shm,
+			// rather than by the jail over it
+			delete(jailparams, "mount.devfs")
+			mounted, err := mountAll(jailparams["path"], linuxMounts(taskConfig), ruleset)
+			if err != nil {
+				return -1, err
+			}
+			h.mounts = append(h.mounts, mounted...)
 
-			if err == nil {
-				cmd := ""
-				env := ""
-				entrypoint := ""
-				if val, ok := m["cmd"]; ok {
-					cmd = string(val)
-				}
-				if val, ok := m["env"]; ok {
-					env = string(val)
+			if _, ok := jailparams["linux"]; !ok {
+				jailparams["linux"] = "new"
+			}
+			if _, ok := jailparams["linux.osname"]; !ok {
+				jailparams["linux.osname"] = "Linux"
+			}
+			if _, ok := jailparams["linux.osrelease"]; !ok {
+				if release := linuxOsrelease(); len(release) > 0 {
+					jailparams["linux.osrelease"] = release
 				}
+			}
+		}
 
-				if val, ok := m["entrypoint"]; ok {
-					entrypoint = string(val)
+		if err := createVolumes(jailparams["path"], c.Volumes); err != nil {
+			return -1, err
+		}
+		if len(c.User) > 0 && len(taskConfig.Exec_jail_user) == 0 {
+			user, err := jailUser(jailparams["path"], c.User)
+			if err != nil {
+				return -1, err
+			}
+			jailparams["exec.jail_user"] = user
+		}
+		if len(c.StopSignal) > 0 && len(taskConfig.Exec_stop) == 0 {
+			stop, err := stopCommand(c.StopSignal)
+			if err != nil {
+				return -1, err
+			}
+			jailparams["exec.stop"] = stop
+		} else if image.OS == "freebsd" && len(taskConfig.Exec_stop) == 0 {
+			if rc, err := securePath(jailparams["path"], "/etc/rc.shutdown"); err == nil {
+				if _, err := os.Stat(rc); err == nil {
+					jailparams["exec.stop"] = "/bin/sh /etc/rc.shutdown"
 				}
-				jailparams["exec.start"] = "\"" + "/usr/bin/env" + " " + env + " " + entrypoint + " " + cmd + "\""
-				d.logger.Info("jail exec.start  ", "driver_initialize_container", hclog.Fmt("%v+", jailparams))
-			} else {
-				d.logger.Info("docker get_config failed", "driver_initialize_container", hclog.Fmt("%v+", err))
-				return -1, fmt.Errorf("docker get_config failed %s", err)
 			}
 		}
+		if len(taskConfig.PortMap) == 0 {
+			h.portMap = imagePortMap(c, portLabels(cfg))
+			if len(h.portMap) > 0 {
+				d.logger.Info("mapping ports exposed by the image", "image", img.ID, "port_map", h.portMap)
+			}
+		}
+		if len(taskConfig.Exec_start) == 0 {
+			argv := imageArgv(c, taskConfig.Entrypoint, taskConfig.Args)
+			if len(argv) == 0 {
+				return -1, fmt.Errorf("image %s has no command, set entrypoint or args", img.ID)
+			}
+			jailparams["exec.start"] = startCommand(c, cfg.Env, argv)
+		}
+		d.logger.Info("jail exec.start  ", "driver_initialize_container", hclog.Fmt("%v+", jailparams))
 	}
 
 	//RCTL options
@@ -634,7 +640,7 @@ func (d *Driver) initializeContainer(cfg *drivers.TaskConfig, taskConfig TaskCon
 		defer C.free(unsafe.Pointer(cs))
 		err := C.expand_number(cs, &amnt)
 		if err != 0 {
-			return -1, fmt.Errorf("Amount for Cputime is invalid %s")
+			return -1, fmt.Errorf("Amount for Cputime is invalid %s", rctl.Cputime.Amount)
 		}
 		if len(rctl.Cputime.Per) > 0 {
 			rctlm[":cputime:"+rctl.Cputime.Action+"="+fmt.Sprintf("%d", (uint64)(amnt))+"/"+rctl.Cputime.Per] = (uint64)(amnt)
@@ -648,7 +654,7 @@ func (d *Driver) initializeContainer(cfg *drivers.TaskConfig, taskConfig TaskCon
 		defer C.free(unsafe.Pointer(cs))
 		err := C.expand_number(cs, &amnt)
 		if err != 0 {
-			return -1, fmt.Errorf("Amount for Stacksize is invalid %s")
+			return -1, fmt.Errorf("Amount for Stacksize is invalid %s", rctl.Stacksize.Amount)
 		}
 		if len(rctl.Stacksize.Per) > 0 {
 			rctlm[":stacksize:"+rctl.Stacksize.Action+"="+fmt.Sprintf("%d", (uint64)(amnt))+"/"+rctl.Stacksize.Per] = (uint64)(amnt)
@@ -662,7 +668,7 @@ func (d *Driver) initializeContainer(cfg *drivers.TaskConfig, taskConfig TaskCon
 		defer C.free(unsafe.Pointer(cs))
 		err := C.expand_number(cs, &amnt)
 		if err != 0 {
-			return -1, fmt.Errorf("Amount for Coredumpsize is invalid %s")
+			return -1, fmt.Errorf("Amount for Coredumpsize is invalid %s", rctl.Coredumpsize.Amount)
 		}
 		if len(rctl.Coredumpsize.Per) > 0 {
 			rctlm[":coredumpsize:"+rctl.Coredumpsize.Action+"="+fmt.Sprintf("%d", (uint64)(amnt))+"/"+rctl.Coredumpsize.Per] = (uint64)(amnt)
@@ -949,6 +955,62 @@ func (d *Driver) initializeContainer(cfg *drivers.TaskConfig, taskConfig TaskCon
 		}
 
 	}
+
+	if taskConfig.SharedNetwork {
+		if taskConfig.NetworkLimits.enabled() {
+			return -1, fmt.Errorf("network_limits can't be combined with shared_network")
+		}
+		if err := d.joinSharedNetwork(cfg, taskConfig, jailparams, lease, h); err != nil {
+			return -1, err
+		}
+	} else {
+		epair, err := setupVnet(jailparams, cfg.ID, taskConfig.Network, lease)
+		if err != nil {
+			return -1, err
+		}
+		h.epair = epair
+
+		aliases, err := createAliases(jailparams)
+		if err != nil {
+			return -1, err
+		}
+		h.aliases = aliases
+
+		// loaded before the jail exists so it never runs unfiltered
+		if taskConfig.Firewall.enabled() {
+			addrs, err := configuredAddresses(jailparams, taskConfig.Network, lease)
+			if err != nil {
+				return -1, err
+			}
+			anchor, err := loadFirewall(jailparams["name"], taskConfig.Firewall, addrs)
+			if err != nil {
+				return -1, fmt.Errorf("failed to load the firewall: %s", err)
+			}
+			h.firewall = anchor
+		}
+
+		if taskConfig.NetworkLimits.enabled() {
+			var addrs []net.IP
+			if len(epair) == 0 {
+				if addrs, err = configuredAddresses(jailparams, taskConfig.Network, lease); err != nil {
+					return -1, err
+				}
+			}
+			sh, err := d.shaper.apply(addrs, epair, taskConfig.NetworkLimits)
+			if err != nil {
+				return -1, fmt.Errorf("failed to apply network_limits: %s", err)
+			}
+			h.shaping = sh
+		}
+	}
+	h.containerName = jailparams["name"]
+
+	dns, err := d.setupDNS(cfg, taskConfig, jailparams, lease, img != nil || taskConfig.Ephemeral, labels)
+	if err != nil {
+		return -1, err
+	}
+	h.dns = dns
+
 	err, args := Jailcmd(jailparams)
 	d.logger.Info("Jail params", "driver_initialize_container", hclog.Fmt("Params %s", args))
 	if err != nil {
@@ -0,0 +1,144 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// releaseRegexp matches FreeBSD release names like 14.1-RELEASE
+var releaseRegexp = regexp.MustCompile(`^[0-9]+\.[0-9]+-[A-Z0-9-]+$`)
+
+// jailfileInstruction is a single instruction of a Jailfile
+type jailfileInstruction struct {
+	Line int
+	Cmd  string
+	Args string
+}
+
+// jailfileCommands are the instructions a Jailfile may use
+var jailfileCommands = map[string]bool{
+	"FROM":    true,
+	"RUN":     true,
+	"COPY":    true,
+	"ENV":     true,
+	"WORKDIR": true,
+	"USER":    true,
+	"CMD":     true,
+}
+
+// parseJailfile reads the Dockerfile like instructions of a Jailfile.
+// Comments start with #, and lines ending with \ continue on the next one.
+func parseJailfile(r io.Reader) ([]jailfileInstruction, error) {
+	var instructions []jailfileInstruction
+	var current string
+	start := 0
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(current) == 0 && (len(line) == 0 || strings.HasPrefix(line, "#")) {
+			continue
+		}
+		if len(current) == 0 {
+			start = n
+		}
+		if strings.HasSuffix(line, "\\") {
+			current += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		current += line
+
+		fields := strings.SplitN(current, " ", 2)
+		cmd := strings.ToUpper(fields[0])
+		if !jailfileCommands[cmd] {
+			return nil, fmt.Errorf("line %d: unknown instruction %s", start, fields[0])
+		}
+		var args string
+		if len(fields) > 1 {
+			args = strings.TrimSpace(fields[1])
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("line %d: %s requires arguments", start, cmd)
+		}
+		instructions = append(instructions, jailfileInstruction{Line: start, Cmd: cmd, Args: args})
+		current = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(current) > 0 {
+		return nil, fmt.Errorf("line %d: unterminated instruction", start)
+	}
+
+	if len(instructions) == 0 || instructions[0].Cmd != "FROM" {
+		return nil, fmt.Errorf("a Jailfile must start with FROM")
+	}
+	for _, i := range instructions[1:] {
+		if i.Cmd == "FROM" {
+			return nil, fmt.Errorf("line %d: only one FROM is supported", i.Line)
+		}
+	}
+	return instructions, nil
+}
+
+// commandArgv parses the exec form, a JSON array, of RUN and CMD. The shell
+// form is run by /bin/sh.
+func commandArgv(args string) ([]string, error) {
+	if strings.HasPrefix(args, "[") {
+		var argv []string
+		if err := json.Unmarshal([]byte(args), &argv); err != nil {
+			return nil, fmt.Errorf("invalid exec form %s: %s", args, err)
+		}
+		return argv, nil
+	}
+	return []string{"/bin/sh", "-c", args}, nil
+}
+
+// parseEnv parses ENV arguments, either KEY=value pairs or KEY value
+func parseEnv(args string) ([]string, error) {
+	fields := strings.Fields(args)
+	if !strings.Contains(fields[0], "=") {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("ENV %s has no value", args)
+		}
+		return []string{fields[0] + "=" + strings.TrimSpace(strings.TrimPrefix(args, fields[0]))}, nil
+	}
+	var env []string
+	for _, f := range fields {
+		if !strings.Contains(f, "=") {
+			return nil, fmt.Errorf("invalid ENV %s", f)
+		}
+		kv := strings.SplitN(f, "=", 2)
+		env = append(env, kv[0]+"="+strings.Trim(kv[1], `"`))
+	}
+	return env, nil
+}
+
+// setEnv replaces or appends the variables of add in env
+func setEnv(env, add []string) []string {
+	for _, kv := range add {
+		key := strings.SplitN(kv, "=", 2)[0]
+		replaced := false
+		for i, e := range env {
+			if strings.SplitN(e, "=", 2)[0] == key {
+				env[i] = kv
+				replaced = true
+			}
+		}
+		if !replaced {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
@@ -0,0 +1,104 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJailfile(t *testing.T) {
+	jailfile := `# build the app
+FROM 12.0-RELEASE
+
+run pkg install -y \
+    nginx \
+    curl
+COPY nginx.conf /usr/local/etc/nginx/
+ENV PATH=/usr/local/bin:/bin
+CMD ["nginx", "-g", "daemon off;"]
+`
+	got, err := parseJailfile(strings.NewReader(jailfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []jailfileInstruction{
+		{Line: 2, Cmd: "FROM", Args: "12.0-RELEASE"},
+		{Line: 4, Cmd: "RUN", Args: "pkg install -y  nginx  curl"},
+		{Line: 7, Cmd: "COPY", Args: "nginx.conf /usr/local/etc/nginx/"},
+		{Line: 8, Cmd: "ENV", Args: "PATH=/usr/local/bin:/bin"},
+		{Line: 9, Cmd: "CMD", Args: `["nginx", "-g", "daemon off;"]`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestParseJailfileErrors(t *testing.T) {
+	cases := map[string]string{
+		"empty":                 "# nothing\n",
+		"missing FROM":          "RUN true\n",
+		"FROM not first":        "RUN true\nFROM 12.0-RELEASE\n",
+		"second FROM":           "FROM 12.0-RELEASE\nFROM 13.0-RELEASE\n",
+		"unknown instruction":   "FROM 12.0-RELEASE\nEXPOSE 80\n",
+		"no arguments":          "FROM 12.0-RELEASE\nRUN\n",
+		"unterminated":          "FROM 12.0-RELEASE\nRUN true \\\n",
+		"continuation at start": "FROM \\\n",
+	}
+	for name, jailfile := range cases {
+		if _, err := parseJailfile(strings.NewReader(jailfile)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestCommandArgv(t *testing.T) {
+	cases := []struct {
+		args string
+		want []string
+		err  bool
+	}{
+		{`["nginx", "-g", "daemon off;"]`, []string{"nginx", "-g", "daemon off;"}, false},
+		{"echo $HOME", []string{"/bin/sh", "-c", "echo $HOME"}, false},
+		{`["nginx",`, nil, true},
+	}
+	for _, c := range cases {
+		got, err := commandArgv(c.args)
+		if (err != nil) != c.err || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("commandArgv(%q) = %q, %v", c.args, got, err)
+		}
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	cases := []struct {
+		args string
+		want []string
+		err  bool
+	}{
+		{"PATH /usr/local/bin:/bin", []string{"PATH=/usr/local/bin:/bin"}, false},
+		{"GREETING hello world", []string{"GREETING=hello world"}, false},
+		{`A=1 B="two"`, []string{"A=1", "B=two"}, false},
+		{"A=1 B", nil, true},
+		{"A", nil, true},
+	}
+	for _, c := range cases {
+		got, err := parseEnv(c.args)
+		if (err != nil) != c.err || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseEnv(%q) = %q, %v", c.args, got, err)
+		}
+	}
+}
+
+func TestSetEnv(t *testing.T) {
+	env := setEnv([]string{"PATH=/bin", "HOME=/root"}, []string{"PATH=/usr/bin", "LANG=C"})
+	if want := []string{"PATH=/usr/bin", "HOME=/root", "LANG=C"}; !reflect.DeepEqual(env, want) {
+		t.Fatalf("got %q, want %q", env, want)
+	}
+}
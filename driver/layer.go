@@ -0,0 +1,331 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+)
+
+// diffLayer writes to w a layer that turns the tree at lower into the tree
+// at upper when extracted on top of it. Removed paths become whiteouts.
+// Directories in skip, relative to the roots, are left out entirely.
+func diffLayer(lower, upper string, skip map[string]bool, w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(lower, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(lower, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if skip[filepath.ToSlash(rel)] {
+			return filepath.SkipDir
+		}
+		ufi, err := os.Lstat(filepath.Join(upper, rel))
+		if os.IsNotExist(err) {
+			dir, base := path.Split(filepath.ToSlash(rel))
+			hdr := &tar.Header{
+				Name:     dir + whiteoutPrefix + base,
+				Typeflag: tar.TypeReg,
+				Mode:     0600,
+				ModTime:  time.Unix(0, 0),
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && !ufi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	links := make(map[inodeKey]string)
+	err = filepath.Walk(upper, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if skip[name] && fi.IsDir() {
+			return filepath.SkipDir
+		}
+
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("unsupported file info for %s", p)
+		}
+		key := inodeKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+		if fi.Mode().IsRegular() && st.Nlink > 1 {
+			if first, ok := links[key]; ok {
+				return tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: first})
+			}
+		}
+
+		if lfi, err := os.Lstat(filepath.Join(lower, rel)); err == nil && sameFile(lfi, fi, filepath.Join(lower, rel), p) {
+			return nil
+		}
+
+		switch {
+		case fi.Mode()&(os.ModeDevice|os.ModeCharDevice|os.ModeSocket) != 0:
+			// device nodes are provided by devfs inside the jail
+			return nil
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		var f *os.File
+		if fi.Mode().IsRegular() {
+			if f, err = openInRoot(upper, rel, fi); err != nil {
+				return err
+			}
+			defer f.Close()
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid = int(st.Uid), int(st.Gid)
+		hdr.Uname, hdr.Gname = "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if f != nil {
+			if st.Nlink > 1 {
+				links[key] = name
+			}
+			_, err = io.CopyN(tw, f, hdr.Size)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// openInRoot opens the regular file rel of root that a walk found as fi. A
+// live jail may have swapped the file, or a directory above it, for a link
+// since, so no link is followed and the file opened must still be fi.
+func openInRoot(root, rel string, fi os.FileInfo) (*os.File, error) {
+	fd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for _, part := range parts[:len(parts)-1] {
+		next, err := unix.Openat(fd, part, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %s", rel, err)
+		}
+		fd = next
+	}
+	// a fifo swapped in must not block the open
+	ffd, err := unix.Openat(fd, parts[len(parts)-1], unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	unix.Close(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %s", rel, err)
+	}
+	f := os.NewFile(uintptr(ffd), filepath.Join(root, rel))
+	ffi, err := f.Stat()
+	if err != nil || !ffi.Mode().IsRegular() || !os.SameFile(fi, ffi) {
+		f.Close()
+		return nil, fmt.Errorf("%s changed while the layer was created", rel)
+	}
+	return f, nil
+}
+
+// sameFile reports whether the upper file is unchanged from the lower one
+func sameFile(lower, upper os.FileInfo, lowerPath, upperPath string) bool {
+	if lower.Mode() != upper.Mode() || !lower.ModTime().Equal(upper.ModTime()) {
+		return false
+	}
+	if !upper.IsDir() && lower.Size() != upper.Size() {
+		return false
+	}
+	lst, lok := lower.Sys().(*syscall.Stat_t)
+	ust, uok := upper.Sys().(*syscall.Stat_t)
+	if !lok || !uok || lst.Uid != ust.Uid || lst.Gid != ust.Gid {
+		return false
+	}
+	if upper.Mode()&os.ModeSymlink != 0 {
+		l, _ := os.Readlink(lowerPath)
+		u, _ := os.Readlink(upperPath)
+		return l == u
+	}
+	return true
+}
+
+// deriveImage creates an image with one more layer on top of base. build
+// modifies a copy of the base rootfs, and the changes it makes become the
+// new layer. mutate, when set, amends the config of the new image.
+func (s *imageStore) deriveImage(base *imageRecord, createdBy string, build func(root string) error, mutate func(*ocispec.Image)) (*imageRecord, error) {
+	staging, err := ioutil.TempDir(filepath.Join(s.root, "tmp"), "derive-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	// keep the base from being collected while deriving from it
+	if err := s.acquire(base.ID, staging); err != nil {
+		return nil, err
+	}
+	defer s.release(base.ID, staging)
+
+	lower, err := s.backend.BasePath(base)
+	if err != nil {
+		return nil, err
+	}
+	root := filepath.Join(staging, "rootfs")
+	if err := copyTree(lower, root); err != nil {
+		return nil, fmt.Errorf("failed to copy image %s: %s", base.ID, err)
+	}
+	if err := build(root); err != nil {
+		return nil, err
+	}
+
+	return s.commitLayer(base, lower, root, nil, createdBy, mutate)
+}
+
+// commitLayer stores the difference between the rootfs of base at lower
+// and the tree at upper as a new layer, and creates the image made of the
+// layers of base plus that one. Directories in skip are left out.
+func (s *imageStore) commitLayer(base *imageRecord, lower, upper string, skip map[string]bool, createdBy string, mutate func(*ocispec.Image)) (*imageRecord, error) {
+	tmp, err := ioutil.TempFile(filepath.Join(s.root, "tmp"), "layer-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	diffID := digest.Canonical.Digester()
+	gz := gzip.NewWriter(tmp)
+	if err := diffLayer(lower, upper, skip, io.MultiWriter(gz, diffID.Hash())); err != nil {
+		return nil, fmt.Errorf("failed to create layer: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	layer, size, err := s.putBlob(tmp, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed storing layer: %s", err)
+	}
+
+	buf, err := s.readBlob(base.Config)
+	if err != nil {
+		return nil, err
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return nil, fmt.Errorf("failed decoding image config %s: %s", base.Config, err)
+	}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID.Digest())
+	config.History = append(config.History, ocispec.History{CreatedBy: createdBy})
+	if config.Config.Labels == nil {
+		config.Config.Labels = make(map[string]string)
+	}
+	if mutate != nil {
+		mutate(&config)
+	}
+	buf, err = json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	configDigest, n, err := s.putBlob(bytes.NewReader(buf), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed storing image config: %s", err)
+	}
+
+	// keep the manifest format of base, registries refuse docker layers
+	// in OCI manifests and the other way around
+	manifestType, configType, layerType := ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageConfig, ocispec.MediaTypeImageLayerGzip
+	if buf, err := s.readBlob(base.Manifest); err == nil && manifestMediaType(buf) == mediaTypeDockerManifest {
+		manifestType, configType, layerType = mediaTypeDockerManifest, mediaTypeDockerConfig, mediaTypeDockerLayerGzip
+	}
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    ocispec.Descriptor{MediaType: configType, Digest: configDigest, Size: n},
+	}
+	manifest.Layers = append(s.layerDescriptors(base), ocispec.Descriptor{
+		MediaType: layerType,
+		Digest:    layer,
+		Size:      size,
+	})
+	manifestDigest, err := s.putManifest(manifestType, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.createImage(manifestDigest, configDigest, append(append([]digest.Digest{}, base.Layers...), layer))
+}
+
+// layerDescriptors describes the layers of img as listed by its manifest
+func (s *imageStore) layerDescriptors(img *imageRecord) []ocispec.Descriptor {
+	var manifest ocispec.Manifest
+	if buf, err := s.readBlob(img.Manifest); err == nil && json.Unmarshal(buf, &manifest) == nil &&
+		len(manifest.Layers) == len(img.Layers) {
+		return manifest.Layers
+	}
+
+	var layers []ocispec.Descriptor
+	for _, l := range img.Layers {
+		desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: l}
+		if fi, err := os.Stat(s.blobPath(l)); err == nil {
+			desc.Size = fi.Size()
+		}
+		layers = append(layers, desc)
+	}
+	return layers
+}
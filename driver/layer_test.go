@@ -0,0 +1,224 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// layerEntries lists the names of the entries of a layer
+func layerEntries(t *testing.T, layer []byte) []string {
+	t.Helper()
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(layer))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// treeContent maps every path below root to the content of files and the
+// target of links, directories map to "/"
+func treeContent(t *testing.T, root string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		switch {
+		case fi.IsDir():
+			tree[rel] = "/"
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			tree[rel] = "-> " + link
+			return err
+		default:
+			buf, err := ioutil.ReadFile(p)
+			tree[rel] = string(buf)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestDiffLayer(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	lower := filepath.Join(tmp, "lower")
+	upper := filepath.Join(tmp, "upper")
+
+	if err := extractLayer(testLayer(t,
+		dir("etc"), file("etc/keep", "keep"), file("etc/change", "old"), file("etc/gone", "gone"),
+		dir("var"), dir("var/cache"), file("var/cache/pkg", "pkg"),
+		dir("usr"), file("usr/lib", "lib"),
+		symlink("link", "etc/keep"),
+		dir("dev"),
+	), lower); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyTree(lower, upper); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range map[string]string{"etc/change": "new", "etc/added": "added", "dev/null": "skipped"} {
+		if err := ioutil.WriteFile(filepath.Join(upper, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(filepath.Join(upper, "etc/gone")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(upper, "var/cache")); err != nil {
+		t.Fatal(err)
+	}
+	// a directory replacing a file, and a link pointing elsewhere
+	if err := os.Remove(filepath.Join(upper, "usr/lib")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(upper, "usr/lib/sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(upper, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("etc/added", filepath.Join(upper, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(upper, "etc/added"), filepath.Join(upper, "etc/hardlink")); err != nil {
+		t.Fatal(err)
+	}
+
+	layer := &bytes.Buffer{}
+	if err := diffLayer(lower, upper, map[string]bool{"dev": true}, layer); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := layerEntries(t, layer.Bytes())
+	for _, name := range []string{"etc/keep", "dev/null", "dev/"} {
+		for _, e := range entries {
+			if e == name {
+				t.Errorf("unchanged or skipped %s is in the layer", name)
+			}
+		}
+	}
+
+	// extracting the layer on the lower tree gives the upper tree
+	if err := extractLayer(bytes.NewReader(layer.Bytes()), lower); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(upper, "dev/null"))
+	if got, want := treeContent(t, lower), treeContent(t, upper); !reflect.DeepEqual(got, want) {
+		t.Fatalf("layer entries %v\ngot tree %v\nwant %v", entries, got, want)
+	}
+	a, _ := os.Stat(filepath.Join(lower, "etc/added"))
+	b, _ := os.Stat(filepath.Join(lower, "etc/hardlink"))
+	if a == nil || b == nil || !os.SameFile(a, b) {
+		t.Error("hard links should be kept")
+	}
+}
+
+func TestDiffLayerUnchanged(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	lower := filepath.Join(tmp, "lower")
+	upper := filepath.Join(tmp, "upper")
+	if err := extractLayer(testLayer(t, dir("etc"), file("etc/keep", "keep"), symlink("link", "etc/keep")), lower); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyTree(lower, upper); err != nil {
+		t.Fatal(err)
+	}
+
+	layer := &bytes.Buffer{}
+	if err := diffLayer(lower, upper, nil, layer); err != nil {
+		t.Fatal(err)
+	}
+	if entries := layerEntries(t, layer.Bytes()); len(entries) != 0 {
+		t.Fatalf("a copy has no changes, got %v", entries)
+	}
+}
+
+func TestOpenInRoot(t *testing.T) {
+	root, outside := testRoot(t)
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"etc/passwd", "etc/group"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lstat := func(name string) os.FileInfo {
+		fi, err := os.Lstat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+
+	passwd := lstat("etc/passwd")
+	f, err := openInRoot(root, "etc/passwd", passwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := openInRoot(root, "etc/passwd", lstat("etc/group")); err == nil {
+		t.Error("expected an error opening another file than the one walked")
+	}
+
+	// the jail swaps the file for a link after the walk found it
+	group := lstat("etc/group")
+	if err := os.Remove(filepath.Join(root, "etc/group")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "etc/group")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openInRoot(root, "etc/group", group); err == nil {
+		t.Error("expected an error opening a link")
+	}
+
+	// then etc, the walk followed it to the host
+	if err := os.Rename(filepath.Join(root, "etc"), filepath.Join(root, "etc.old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openInRoot(root, "etc/secret", lstat("etc/secret")); err == nil {
+		t.Error("expected an error opening a file through a link")
+	}
+}
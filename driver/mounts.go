@@ -0,0 +1,149 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// defaultDevfsRuleset is devfsrules_jail from /etc/defaults/devfs.rules
+	defaultDevfsRuleset = "4"
+)
+
+// jailMount is a filesystem the driver mounts in the rootfs of a jail
+type jailMount struct {
+	FSType  string
+	Source  string
+	Target  string
+	Options string
+}
+
+// linuxMounts are the filesystems Linux binaries expect, relative to the
+// rootfs, in mount order. devfs is always mounted here, even with
+// Mount_devfs, as the jail would mount it over /dev/shm. fdescfs is left out
+// when the jail mounts it itself.
+func linuxMounts(taskConfig TaskConfig) []jailMount {
+	mounts := []jailMount{{FSType: "devfs", Source: "devfs", Target: "/dev"}}
+	if !taskConfig.Mount_fdescfs {
+		mounts = append(mounts, jailMount{FSType: "fdescfs", Source: "fdescfs", Target: "/dev/fd", Options: "linrdlnk"})
+	}
+	return append(mounts,
+		jailMount{FSType: "tmpfs", Source: "tmpfs", Target: "/dev/shm", Options: "mode=1777"},
+		jailMount{FSType: "linprocfs", Source: "linprocfs", Target: "/proc"},
+		jailMount{FSType: "linsysfs", Source: "linsysfs", Target: "/sys"},
+	)
+}
+
+// mountAll mounts every filesystem below root in order, returning the
+// mounted paths. Targets are resolved inside root, so symlinks of the image
+// cannot redirect mounts to the host. devfs mounts get the ruleset applied.
+func mountAll(root string, mounts []jailMount, ruleset string) ([]string, error) {
+	var mounted []string
+	for _, m := range mounts {
+		target, err := secureDir(root, m.Target)
+		if err != nil {
+			unmountAll(mounted)
+			return nil, err
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			unmountAll(mounted)
+			return nil, fmt.Errorf("failed to create mountpoint %s: %s", target, err)
+		}
+
+		args := []string{"-t", m.FSType}
+		if len(m.Options) > 0 {
+			args = append(args, "-o", m.Options)
+		}
+		if out, err := exec.Command("mount", append(args, m.Source, target)...).CombinedOutput(); err != nil {
+			unmountAll(mounted)
+			return nil, fmt.Errorf("failed to mount %s on %s: %s: %s", m.FSType, target, err, strings.TrimSpace(string(out)))
+		}
+		mounted = append(mounted, target)
+
+		if m.FSType == "devfs" {
+			out, err := exec.Command("devfs", "-m", target, "rule", "-s", ruleset, "applyset").CombinedOutput()
+			if err != nil {
+				unmountAll(mounted)
+				return nil, fmt.Errorf("failed to apply devfs ruleset %s on %s: %s: %s", ruleset, target, err, strings.TrimSpace(string(out)))
+			}
+		}
+	}
+	return mounted, nil
+}
+
+// unmountAll unmounts the paths in the reverse order they were mounted,
+// trying every one of them and returning the first failure.
+func unmountAll(mounted []string) error {
+	var first error
+	for i := len(mounted) - 1; i >= 0; i-- {
+		out, err := exec.Command("umount", "-f", mounted[i]).CombinedOutput()
+		if err != nil && first == nil {
+			first = fmt.Errorf("failed to unmount %s: %s: %s", mounted[i], err, strings.TrimSpace(string(out)))
+		}
+	}
+	return first
+}
+
+// ensureLinuxABI loads the linux64 module unless it already is
+func ensureLinuxABI() error {
+	if exec.Command("kldstat", "-q", "-m", "linux64").Run() == nil {
+		return nil
+	}
+	if out, err := exec.Command("kldload", "-n", "linux64").CombinedOutput(); err != nil {
+		return fmt.Errorf("linux64.ko is unavailable, Linux images cannot run: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// linuxOsrelease is the Linux kernel version reported by the host
+func linuxOsrelease() string {
+	out, err := exec.Command("sysctl", "-n", "compat.linux.osrelease").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// pseudoFilesystems are filesystems without files of their own, skipped
+// when a live rootfs is committed into a layer
+var pseudoFilesystems = map[string]bool{
+	"devfs":     true,
+	"fdescfs":   true,
+	"procfs":    true,
+	"linprocfs": true,
+	"linsysfs":  true,
+	"tmpfs":     true,
+}
+
+// pseudoMounts returns the mount points of pseudo filesystems below root,
+// relative to it
+func pseudoMounts(root string) (map[string]bool, error) {
+	out, err := exec.Command("mount", "-p").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed listing mounts: %s", err)
+	}
+	root = filepath.Clean(root)
+	skip := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !pseudoFilesystems[fields[2]] {
+			continue
+		}
+		rel, err := filepath.Rel(root, fields[1])
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		skip[filepath.ToSlash(rel)] = true
+	}
+	return skip, nil
+}
@@ -0,0 +1,57 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLinuxMounts(t *testing.T) {
+	targets := func(mounts []jailMount) []string {
+		var targets []string
+		for _, m := range mounts {
+			targets = append(targets, m.Target)
+		}
+		return targets
+	}
+
+	all := linuxMounts(TaskConfig{})
+	if got := targets(all); !reflect.DeepEqual(got, []string{"/dev", "/dev/fd", "/dev/shm", "/proc", "/sys"}) {
+		t.Fatalf("got %v", got)
+	}
+	if all[1].FSType != "fdescfs" || all[1].Options != "linrdlnk" {
+		t.Errorf("fdescfs needs linrdlnk for Linux binaries, got %+v", all[1])
+	}
+
+	// the jail mounts fdescfs itself, but devfs would hide /dev/shm
+	own := linuxMounts(TaskConfig{Mount_devfs: true, Mount_fdescfs: true})
+	if got := targets(own); !reflect.DeepEqual(got, []string{"/dev", "/dev/shm", "/proc", "/sys"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestMountAllStaysInRoot(t *testing.T) {
+	root, outside := testRoot(t)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../outside", filepath.Join(root, "proc")); err != nil {
+		t.Fatal(err)
+	}
+	mounted, err := mountAll(root, []jailMount{{FSType: "linprocfs", Source: "linprocfs", Target: "/proc/self"}}, defaultDevfsRuleset)
+	if err == nil {
+		t.Fatal("expected an error mounting through a link out of the rootfs")
+	}
+	if len(mounted) != 0 {
+		t.Fatalf("mounted %v", mounted)
+	}
+	assertOutsideIntact(t, outside)
+}
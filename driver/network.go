@@ -0,0 +1,166 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// networkWait is how long a started jail is given to come up with an
+	// address, VNET jails usually configure theirs from exec.start
+	networkWait = 10 * time.Second
+
+	// networkPollIntv is how often the address of a starting jail is checked
+	networkPollIntv = 250 * time.Millisecond
+)
+
+// jailParams reads parameters of the running jail name with jls
+func jailParams(name string, params ...string) (map[string]string, error) {
+	args := append([]string{"-j", name, "-n"}, params...)
+	out, err := exec.Command("jls", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("jail %s not found: %s", name, err)
+	}
+	values := make(map[string]string)
+	for _, kv := range strings.Fields(string(out)) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			values[parts[0]] = parts[1]
+		}
+	}
+	return values, nil
+}
+
+// jailAddresses returns the addresses of the jail name usable by other
+// hosts, IPv4 first, and whether it has its own network stack. VNET jails
+// are asked for the addresses of their interfaces.
+func jailAddresses(name string) ([]net.IP, bool, error) {
+	params, err := jailParams(name, "ip4.addr", "ip6.addr", "vnet")
+	if err != nil {
+		return nil, false, err
+	}
+
+	var candidates []string
+	vnet := params["vnet"] == "new" || params["vnet"] == "1"
+	if vnet {
+		out, err := exec.Command("jexec", name, "/sbin/ifconfig", "-a").Output()
+		if err != nil {
+			return nil, vnet, fmt.Errorf("failed listing interfaces of %s: %s", name, err)
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 1 && (fields[0] == "inet" || fields[0] == "inet6") {
+				candidates = append(candidates, strings.SplitN(fields[1], "%", 2)[0])
+			}
+		}
+	} else {
+		for _, param := range []string{"ip4.addr", "ip6.addr"} {
+			for _, addr := range strings.Split(params[param], ",") {
+				// jail(8) syntax, interface|address/prefix
+				addr = addr[strings.LastIndex(addr, "|")+1:]
+				candidates = append(candidates, strings.SplitN(addr, "/", 2)[0])
+			}
+		}
+	}
+
+	var v4, v6 []net.IP
+	for _, c := range candidates {
+		ip := net.ParseIP(c)
+		if ip == nil || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+			continue
+		}
+		// every VNET jail has lo0, other jails only get loopback addresses
+		// reached through port forwards
+		if vnet && ip.IsLoopback() {
+			continue
+		}
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	return append(v4, v6...), vnet, nil
+}
+
+// jailNetwork describes the network of the started jail name to nomad, so
+// services with address_mode "driver" use the address of the jail. It is
+// nil for jails sharing the addresses of the host. running tells when the
+// task exited before an address could be found.
+func jailNetwork(ctx context.Context, name string, cfg *drivers.TaskConfig, taskConfig TaskConfig, running func() bool) (*drivers.DriverNetwork, error) {
+	ctx, cancel := context.WithTimeout(ctx, networkWait)
+	defer cancel()
+
+	var addrs []net.IP
+	for {
+		var vnet bool
+		var err error
+		addrs, vnet, err = jailAddresses(name)
+		if err == nil && len(addrs) > 0 {
+			break
+		}
+		if (err == nil && !vnet) || !running() {
+			// inheriting the network of the host, or gone already
+			return nil, nil
+		}
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return nil, err
+			}
+			return nil, nil
+		case <-time.After(networkPollIntv):
+		}
+	}
+
+	return &drivers.DriverNetwork{
+		IP:            addrs[0].String(),
+		AutoAdvertise: !addrs[0].IsLoopback(),
+		PortMap:       portMap(cfg, taskConfig.PortMap),
+	}, nil
+}
+
+// portLabels lists the labels of the ports nomad allocated the task
+func portLabels(cfg *drivers.TaskConfig) []string {
+	var labels []string
+	if cfg.Resources != nil && cfg.Resources.NomadResources != nil {
+		for _, network := range cfg.Resources.NomadResources.Networks {
+			for _, p := range append(network.ReservedPorts, network.DynamicPorts...) {
+				labels = append(labels, p.Label)
+			}
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// portMap maps every port label of the task to the port the task listens
+// on, the one set in port_map or else the port nomad allocated.
+func portMap(cfg *drivers.TaskConfig, mapped map[string]int) map[string]int {
+	ports := make(map[string]int)
+	if cfg.Resources != nil && cfg.Resources.NomadResources != nil {
+		for _, network := range cfg.Resources.NomadResources.Networks {
+			for _, p := range append(network.ReservedPorts, network.DynamicPorts...) {
+				ports[p.Label] = p.Value
+			}
+		}
+	}
+	for label, port := range mapped {
+		ports[label] = port
+	}
+	return ports
+}
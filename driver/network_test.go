@@ -0,0 +1,48 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestPortMap(t *testing.T) {
+	cfg := testPortsTask(
+		&structs.NetworkResource{
+			IP:            "192.0.2.10",
+			ReservedPorts: []structs.Port{{Label: "http", Value: 8080}},
+			DynamicPorts:  []structs.Port{{Label: "admin", Value: 25000}},
+		},
+		&structs.NetworkResource{
+			IP:           "2001:db8::10",
+			DynamicPorts: []structs.Port{{Label: "metrics", Value: 25001}},
+		},
+	)
+
+	got := portMap(cfg, map[string]int{"http": 80})
+	want := map[string]int{"http": 80, "admin": 25000, "metrics": 25001}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("portMap() = %v, want %v", got, want)
+	}
+	if labels := portLabels(cfg); !reflect.DeepEqual(labels, []string{"admin", "http", "metrics"}) {
+		t.Errorf("portLabels() = %v", labels)
+	}
+
+	// a port_map without allocated ports is still reported
+	got = portMap(&drivers.TaskConfig{}, map[string]int{"http": 80})
+	if !reflect.DeepEqual(got, map[string]int{"http": 80}) {
+		t.Errorf("portMap() without resources = %v", got)
+	}
+	if labels := portLabels(&drivers.TaskConfig{}); len(labels) != 0 {
+		t.Errorf("portLabels() without resources = %v", labels)
+	}
+}
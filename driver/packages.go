@@ -0,0 +1,129 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// pkgOutputLines is how much of the pkg output failure events carry
+	pkgOutputLines = 20
+)
+
+// pkgError is a failed pkg run together with its output
+type pkgError struct {
+	err    error
+	output string
+}
+
+func (e *pkgError) Error() string {
+	return fmt.Sprintf("pkg failed: %s", e.err)
+}
+
+// packageSet sorts and deduplicates the packages of a task, so every
+// ordering of the same packages shares one cached image
+func packageSet(pkgs []string) []string {
+	set := RemoveDuplicatesFromSlice(pkgs)
+	sort.Strings(set)
+	return set
+}
+
+// checkPackages refuses packages for jails using Path directly, as pkg
+// would modify the shared Path again on every start of the task
+func checkPackages(c TaskConfig) error {
+	if len(c.Packages) == 0 || len(c.Path) == 0 || c.Ephemeral {
+		return nil
+	}
+	if len(c.Image) != 0 || len(c.Docker) != 0 || len(c.BaseRelease) != 0 {
+		return nil
+	}
+	return fmt.Errorf("packages with Path require ephemeral, or an image, Docker or base_release to install them in")
+}
+
+// packagesRef is the image store reference of base with pkgs installed
+func packagesRef(base *imageRecord, pkgs []string) string {
+	sum := digest.FromString(strings.Join(pkgs, " ")).Hex()
+	return "packages/" + base.ID[:12] + ":" + sum[:12]
+}
+
+// pkgInstall installs pkgs in the rootfs at root from the repositories
+// configured on the host.
+func pkgInstall(ctx context.Context, root string, pkgs []string) error {
+	args := append([]string{"-r", root, "install", "-y"}, pkgs...)
+	cmd := exec.CommandContext(ctx, "pkg", args...)
+	cmd.Env = append(os.Environ(), "ASSUME_ALWAYS_YES=yes")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return &pkgError{err: err, output: string(out)}
+	}
+	return nil
+}
+
+// installPackages returns base with pkgs installed. The result is cached as
+// an image deriving from base, built once per base and package set.
+func (d *Driver) installPackages(ctx context.Context, cfg *drivers.TaskConfig, base *imageRecord, pkgs []string) (*imageRecord, error) {
+	pkgs = packageSet(pkgs)
+	ref := packagesRef(base, pkgs)
+	if img, err := d.images.resolve(ref); err == nil {
+		return img, nil
+	}
+
+	img, err := d.images.coalesce(ctx, "packages:"+ref, nil, func(ctx context.Context, _ func(pullProgress)) (*imageRecord, error) {
+		createdBy := "pkg install " + strings.Join(pkgs, " ")
+		img, err := d.images.deriveImage(base, createdBy, func(root string) error {
+			return pkgInstall(ctx, root, pkgs)
+		}, func(config *ocispec.Image) {
+			config.Config.Labels["org.freebsd.packages"] = strings.Join(pkgs, " ")
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := d.images.tag(ref, img.ID); err != nil {
+			return nil, err
+		}
+		return img, nil
+	})
+	if err != nil {
+		d.emitPkgFailure(cfg, err)
+		return nil, err
+	}
+	return img, nil
+}
+
+// emitPkgFailure reports a failed package installation as a task event
+// carrying the end of the pkg output.
+func (d *Driver) emitPkgFailure(cfg *drivers.TaskConfig, err error) {
+	perr, ok := err.(*pkgError)
+	if !ok {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(perr.output), "\n")
+	if len(lines) > pkgOutputLines {
+		lines = lines[len(lines)-pkgOutputLines:]
+	}
+	output := strings.Join(lines, "\n")
+	d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:      cfg.ID,
+		TaskName:    cfg.Name,
+		AllocID:     cfg.AllocID,
+		Timestamp:   time.Now(),
+		Message:     fmt.Sprintf("Installing packages failed: %s", output),
+		Annotations: map[string]string{"output": output},
+	})
+}
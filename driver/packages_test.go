@@ -0,0 +1,57 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPackageSet(t *testing.T) {
+	got := packageSet([]string{"nginx", "curl", "nginx", "ca_root_nss"})
+	if want := []string{"ca_root_nss", "curl", "nginx"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestPackagesRef(t *testing.T) {
+	base := &imageRecord{ID: "0123456789abcdef0123"}
+	a := packagesRef(base, packageSet([]string{"nginx", "curl"}))
+	b := packagesRef(base, packageSet([]string{"curl", "nginx", "curl"}))
+	if a != b {
+		t.Errorf("the same package set has two refs, %s and %s", a, b)
+	}
+	if c := packagesRef(base, []string{"curl"}); c == a {
+		t.Error("different package sets share a ref")
+	}
+	if c := packagesRef(&imageRecord{ID: "fedcba9876543210fedc"}, packageSet([]string{"nginx", "curl"})); c == a {
+		t.Error("different bases share a ref")
+	}
+}
+
+func TestCheckPackages(t *testing.T) {
+	pkgs := []string{"nginx"}
+	cases := []struct {
+		name   string
+		config TaskConfig
+		err    bool
+	}{
+		{"no packages", TaskConfig{Path: "/jails/base"}, false},
+		{"task directory", TaskConfig{Packages: pkgs}, false},
+		{"path", TaskConfig{Path: "/jails/base", Packages: pkgs}, true},
+		{"ephemeral path", TaskConfig{Path: "/jails/base", Ephemeral: true, Packages: pkgs}, false},
+		{"image", TaskConfig{Image: "app.tar", Packages: pkgs}, false},
+		{"docker", TaskConfig{Docker: "alpine", Packages: pkgs}, false},
+		{"base release", TaskConfig{BaseRelease: "12.0-RELEASE", Packages: pkgs}, false},
+	}
+	for _, c := range cases {
+		if err := checkPackages(c.config); (err != nil) != c.err {
+			t.Errorf("%s: error = %v, want error %v", c.name, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// pfAnchorRoot is the anchor the per allocation and per task anchors are
+// attached to, pf.conf must evaluate it with rdr-anchor "jail-task-driver/*"
+// and anchor "jail-task-driver/*"
+const pfAnchorRoot = pluginName
+
+// portForward redirects a port nomad allocated on the host to the jail
+type portForward struct {
+	HostIP   string
+	HostPort int
+	JailIP   string
+	JailPort int
+
+	// Filtered leaves the redirected connections to the firewall of the
+	// task instead of passing them
+	Filtered bool
+}
+
+// pfAnchors keeps the pf rules of every task, grouped in an anchor per
+// allocation that is reloaded as a whole when one of its tasks changes
+type pfAnchors struct {
+	lock     sync.Mutex
+	forwards map[string]map[string][]portForward
+}
+
+func newPFAnchors() *pfAnchors {
+	return &pfAnchors{forwards: make(map[string]map[string][]portForward)}
+}
+
+func allocAnchor(allocID string) string {
+	return pfAnchorRoot + "/" + allocID
+}
+
+// set replaces the forwards of a task and reloads the anchor of its
+// allocation. Recovered tasks pass load false, their rules are still loaded.
+func (p *pfAnchors) set(allocID, taskID string, forwards []portForward, load bool) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(forwards) == 0 {
+		return nil
+	}
+	if p.forwards[allocID] == nil {
+		p.forwards[allocID] = make(map[string][]portForward)
+	}
+	p.forwards[allocID][taskID] = forwards
+	if !load {
+		return nil
+	}
+	return p.load(allocID)
+}
+
+// remove drops the forwards of a task, flushing the anchor of its
+// allocation once no task has any left
+func (p *pfAnchors) remove(allocID, taskID string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.forwards[allocID][taskID]; !ok {
+		return nil
+	}
+	delete(p.forwards[allocID], taskID)
+	if len(p.forwards[allocID]) == 0 {
+		delete(p.forwards, allocID)
+	}
+	return p.load(allocID)
+}
+
+// load replaces the rules of the anchor of an allocation, the lock must be
+// held
+func (p *pfAnchors) load(allocID string) error {
+	var forwards []portForward
+	for _, f := range p.forwards[allocID] {
+		forwards = append(forwards, f...)
+	}
+	anchor := allocAnchor(allocID)
+	if len(forwards) == 0 {
+		return pfctl(anchor, nil, "-F", "all")
+	}
+	return pfctl(anchor, []byte(renderRdr(forwards)), "-f", "-")
+}
+
+func pfctl(anchor string, stdin []byte, args ...string) error {
+	cmd := exec.Command("pfctl", append([]string{"-q", "-a", anchor}, args...)...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("pfctl -a %s %s failed: %s: %s", anchor, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// renderRdr renders the rdr rules of forwards, in a stable order
+func renderRdr(forwards []portForward) string {
+	sorted := append([]portForward{}, forwards...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].HostIP != sorted[j].HostIP {
+			return sorted[i].HostIP < sorted[j].HostIP
+		}
+		return sorted[i].HostPort < sorted[j].HostPort
+	})
+	var b strings.Builder
+	for _, f := range sorted {
+		family := "inet"
+		if net.ParseIP(f.HostIP).To4() == nil {
+			family = "inet6"
+		}
+		action := "rdr pass"
+		if f.Filtered {
+			action = "rdr"
+		}
+		fmt.Fprintf(&b, "%s %s proto { tcp udp } from any to %s port %d -> %s port %d\n",
+			action, family, f.HostIP, f.HostPort, f.JailIP, f.JailPort)
+	}
+	return b.String()
+}
+
+// portForwards redirects every port nomad allocated the task to the port
+// of jailIP it maps to, skipping the ports the jail already receives
+// directly and host addresses of the other family
+func portForwards(cfg *drivers.TaskConfig, jailIP string, mapped map[string]int) []portForward {
+	jail := net.ParseIP(jailIP)
+	if jail == nil || cfg.Resources == nil || cfg.Resources.NomadResources == nil {
+		return nil
+	}
+	var forwards []portForward
+	for _, network := range cfg.Resources.NomadResources.Networks {
+		host := net.ParseIP(network.IP)
+		if host == nil || (host.To4() == nil) != (jail.To4() == nil) {
+			continue
+		}
+		for _, p := range append(network.ReservedPorts, network.DynamicPorts...) {
+			port := p.Value
+			if m, ok := mapped[p.Label]; ok {
+				port = m
+			}
+			if host.Equal(jail) && port == p.Value {
+				continue
+			}
+			forwards = append(forwards, portForward{
+				HostIP:   host.String(),
+				HostPort: p.Value,
+				JailIP:   jail.String(),
+				JailPort: port,
+			})
+		}
+	}
+	return forwards
+}
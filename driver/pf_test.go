@@ -0,0 +1,116 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestRenderRdr(t *testing.T) {
+	got := renderRdr([]portForward{
+		{HostIP: "192.0.2.10", HostPort: 25000, JailIP: "10.0.0.5", JailPort: 80},
+		{HostIP: "2001:db8::10", HostPort: 25001, JailIP: "fd00::5", JailPort: 443, Filtered: true},
+		{HostIP: "192.0.2.10", HostPort: 24000, JailIP: "10.0.0.6", JailPort: 24000, Filtered: true},
+	})
+	// filtered forwards are left to the firewall of their task
+	want := "rdr inet proto { tcp udp } from any to 192.0.2.10 port 24000 -> 10.0.0.6 port 24000\n" +
+		"rdr pass inet proto { tcp udp } from any to 192.0.2.10 port 25000 -> 10.0.0.5 port 80\n" +
+		"rdr inet6 proto { tcp udp } from any to 2001:db8::10 port 25001 -> fd00::5 port 443\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if got := renderRdr(nil); got != "" {
+		t.Errorf("no forwards rendered %q", got)
+	}
+}
+
+func testPortsTask(networks ...*structs.NetworkResource) *drivers.TaskConfig {
+	return &drivers.TaskConfig{
+		Resources: &drivers.Resources{
+			NomadResources: &structs.AllocatedTaskResources{Networks: networks},
+		},
+	}
+}
+
+func TestPortForwards(t *testing.T) {
+	cfg := testPortsTask(
+		&structs.NetworkResource{
+			IP:            "192.0.2.10",
+			ReservedPorts: []structs.Port{{Label: "http", Value: 8080}},
+			DynamicPorts:  []structs.Port{{Label: "admin", Value: 25000}, {Label: "metrics", Value: 25001}},
+		},
+		&structs.NetworkResource{
+			IP:           "2001:db8::10",
+			DynamicPorts: []structs.Port{{Label: "http", Value: 25002}},
+		},
+	)
+	got := portForwards(cfg, "10.0.0.5", map[string]int{"http": 80, "admin": 9000})
+	want := []portForward{
+		{HostIP: "192.0.2.10", HostPort: 8080, JailIP: "10.0.0.5", JailPort: 80},
+		{HostIP: "192.0.2.10", HostPort: 25000, JailIP: "10.0.0.5", JailPort: 9000},
+		{HostIP: "192.0.2.10", HostPort: 25001, JailIP: "10.0.0.5", JailPort: 25001},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	got = portForwards(cfg, "fd00::5", nil)
+	want = []portForward{{HostIP: "2001:db8::10", HostPort: 25002, JailIP: "fd00::5", JailPort: 25002}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestPortForwardsSkipsDirectPorts(t *testing.T) {
+	// a jail on the host address receives the unmapped ports itself
+	cfg := testPortsTask(&structs.NetworkResource{
+		IP:           "192.0.2.10",
+		DynamicPorts: []structs.Port{{Label: "http", Value: 25000}, {Label: "admin", Value: 25001}},
+	})
+	got := portForwards(cfg, "192.0.2.10", map[string]int{"admin": 9000})
+	want := []portForward{{HostIP: "192.0.2.10", HostPort: 25001, JailIP: "192.0.2.10", JailPort: 9000}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for _, jailIP := range []string{"", "dhcp"} {
+		if got := portForwards(cfg, jailIP, nil); got != nil {
+			t.Errorf("jail address %q got forwards %+v", jailIP, got)
+		}
+	}
+	if got := portForwards(&drivers.TaskConfig{}, "10.0.0.5", nil); got != nil {
+		t.Errorf("task without resources got forwards %+v", got)
+	}
+}
+
+func TestPFAnchorsSet(t *testing.T) {
+	p := newPFAnchors()
+	f := []portForward{{HostIP: "192.0.2.10", HostPort: 25000, JailIP: "10.0.0.5", JailPort: 80}}
+
+	// recovered tasks don't reload the anchor
+	if err := p.set("alloc", "task", f, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.set("alloc", "empty", nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.forwards, map[string]map[string][]portForward{"alloc": {"task": f}}) {
+		t.Fatalf("got forwards %+v", p.forwards)
+	}
+	// nothing to flush for a task without forwards
+	if err := p.remove("alloc", "empty"); err != nil {
+		t.Fatal(err)
+	}
+	if allocAnchor("alloc") != pluginName+"/alloc" {
+		t.Errorf("anchor of alloc is %s", allocAnchor("alloc"))
+	}
+}
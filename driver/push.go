@@ -0,0 +1,406 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// uploadChunkSize is the size of the chunks blobs larger than it are
+	// uploaded in. Each chunk is retried on its own.
+	uploadChunkSize = 16 << 20
+)
+
+func pushScope(ref imageRef) string {
+	return "repository:" + ref.Repository + ":pull,push"
+}
+
+// manifestMediaType tells the media type of a manifest blob of the store,
+// which is either a docker schema 2 or an OCI image manifest
+func manifestMediaType(body []byte) string {
+	var m struct {
+		MediaType string `json:"mediaType"`
+		Config    struct {
+			MediaType string `json:"mediaType"`
+		} `json:"config"`
+	}
+	if json.Unmarshal(body, &m) == nil {
+		if len(m.MediaType) > 0 {
+			return m.MediaType
+		}
+		if m.Config.MediaType == mediaTypeDockerConfig {
+			return mediaTypeDockerManifest
+		}
+	}
+	return ocispec.MediaTypeImageManifest
+}
+
+// push uploads img to the registry as ref. Blobs the registry already has
+// are skipped, and blobs of images pulled from other repositories of the
+// same registry are mounted from them instead of uploaded.
+func (r *registryClient) push(ctx context.Context, store *imageStore, img *imageRecord, ref imageRef, report func(pullProgress)) error {
+	body, err := store.readBlob(img.Manifest)
+	if err != nil {
+		return fmt.Errorf("failed reading manifest of %s: %s", img.ID, err)
+	}
+	var manifest imageManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return fmt.Errorf("failed decoding manifest of %s: %s", img.ID, err)
+	}
+	mediaType := manifestMediaType(body)
+	if len(manifest.MediaType) == 0 {
+		// manifests written by earlier versions of the driver lack their
+		// media type, which registries refuse
+		manifest.MediaType = mediaType
+		if body, err = json.Marshal(manifest); err != nil {
+			return err
+		}
+	}
+
+	sources := store.mountSources(ref)
+	for _, desc := range append(manifest.Layers, manifest.Config) {
+		exists, err := r.hasBlob(ctx, ref, desc.Digest)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if err := r.pushBlob(ctx, store, ref, desc, sources[desc.Digest], report); err != nil {
+			return fmt.Errorf("failed uploading blob %s: %s", desc.Digest, err)
+		}
+	}
+
+	return r.withRetries(ctx, func() error {
+		req, err := http.NewRequest("PUT", r.url(ref, "manifests", ref.Reference), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", mediaType)
+		reqCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+		resp, err := r.do(reqCtx, ref, pushScope(ref), req)
+		if err != nil {
+			return fmt.Errorf("failed uploading manifest: %s", err)
+		}
+		resp.Body.Close()
+		return nil
+	})
+}
+
+// mountSources maps the blobs of images tagged from other repositories of
+// the registry of ref to one of those repositories
+func (s *imageStore) mountSources(ref imageRef) map[digest.Digest]string {
+	sources := make(map[digest.Digest]string)
+	s.lock.Lock()
+	repos, err := s.repositories()
+	s.lock.Unlock()
+	if err != nil {
+		return sources
+	}
+	for tag, id := range repos {
+		from := parseImageRef(tag)
+		if from.Registry != ref.Registry || from.Repository == ref.Repository {
+			continue
+		}
+		img, err := s.image(id)
+		if err != nil {
+			continue
+		}
+		for _, blob := range append([]digest.Digest{img.Config}, img.Layers...) {
+			sources[blob] = from.Repository
+		}
+	}
+	return sources
+}
+
+// hasBlob asks the registry whether the repository of ref holds the blob
+func (r *registryClient) hasBlob(ctx context.Context, ref imageRef, blob digest.Digest) (bool, error) {
+	var exists bool
+	err := r.withRetries(ctx, func() error {
+		req, err := http.NewRequest("HEAD", r.url(ref, "blobs", blob.String()), nil)
+		if err != nil {
+			return err
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+		resp, err := r.do(reqCtx, ref, pushScope(ref), req)
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			exists = false
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		exists = true
+		return nil
+	})
+	return exists, err
+}
+
+// pushBlob uploads a blob of the store to the repository of ref. When from
+// is set the registry is first asked to mount the blob from that
+// repository. Small blobs are sent in a single request, larger ones in
+// chunks, resuming from the offset the registry acknowledged after a
+// failure.
+func (r *registryClient) pushBlob(ctx context.Context, store *imageStore, ref imageRef, desc ocispec.Descriptor, from string, report func(pullProgress)) error {
+	query := url.Values{}
+	scope := pushScope(ref)
+	if len(from) > 0 {
+		query.Set("mount", desc.Digest.String())
+		query.Set("from", from)
+		scope += " repository:" + from + ":pull"
+	}
+
+	var location string
+	err := r.withRetries(ctx, func() error {
+		u := r.url(ref, "blobs", "uploads/")
+		if len(query) > 0 {
+			u += "?" + query.Encode()
+		}
+		req, err := http.NewRequest("POST", u, nil)
+		if err != nil {
+			return err
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+		resp, err := r.do(reqCtx, ref, scope, req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusCreated {
+			// mounted from the other repository
+			location = ""
+			return nil
+		}
+		location, err = uploadLocation(resp)
+		return err
+	})
+	if err != nil || len(location) == 0 {
+		return err
+	}
+
+	f, err := os.Open(store.blobPath(desc.Digest))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	progress := pullProgress{Ref: ref.String(), Blob: desc.Digest, Total: size}
+
+	if size <= uploadChunkSize {
+		err := r.withRetries(ctx, func() error {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			pr := &progressReader{r: f, report: report, progress: progress}
+			err := r.putUpload(ctx, ref, location, desc.Digest, pr, size)
+			if pr.err != nil {
+				// the store failed, not the registry
+				return fmt.Errorf("failed reading blob %s: %s", desc.Digest, pr.err)
+			}
+			if err == nil {
+				pr.flush()
+			}
+			return err
+		})
+		return err
+	}
+
+	var offset int64
+	for offset < size {
+		err := r.withRetries(ctx, func() error {
+			n := size - offset
+			if n > uploadChunkSize {
+				n = uploadChunkSize
+			}
+			chunk := &progressReader{r: io.NewSectionReader(f, offset, n)}
+			next, err := r.patchUpload(ctx, ref, location, chunk, offset, n)
+			if chunk.err != nil {
+				return fmt.Errorf("failed reading blob %s: %s", desc.Digest, chunk.err)
+			}
+			if err != nil {
+				// continue from what the registry received
+				if acked, next, ok := r.uploadStatus(ctx, ref, location); ok {
+					offset, location = acked, next
+				}
+				return err
+			}
+			offset, location = offset+n, next
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		progress.Done = offset
+		if report != nil {
+			report(progress)
+		}
+	}
+	return r.withRetries(ctx, func() error {
+		return r.putUpload(ctx, ref, location, desc.Digest, nil, 0)
+	})
+}
+
+// patchUpload sends a chunk of an upload, returning the location to send
+// the next one to
+func (r *registryClient) patchUpload(ctx context.Context, ref imageRef, location string, chunk io.Reader, offset, n int64) (string, error) {
+	req, err := http.NewRequest("PATCH", location, chunk)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+n-1))
+	reqCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	resp, err := r.do(reqCtx, ref, pushScope(ref), req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return uploadLocation(resp)
+}
+
+// putUpload completes an upload, sending the last bytes of the blob in the
+// request when body is set
+func (r *registryClient) putUpload(ctx context.Context, ref imageRef, location string, blob digest.Digest, body io.Reader, n int64) error {
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("digest", blob.String())
+	u.RawQuery = q.Encode()
+
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest("PUT", u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Type", "application/octet-stream")
+	reqCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	resp, err := r.do(reqCtx, ref, pushScope(ref), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// uploadStatus asks the registry how much of an upload it has received,
+// returning the offset and location to continue the upload from
+func (r *registryClient) uploadStatus(ctx context.Context, ref imageRef, location string) (int64, string, bool) {
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return 0, "", false
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	resp, err := r.do(reqCtx, ref, pushScope(ref), req)
+	if err != nil {
+		return 0, "", false
+	}
+	resp.Body.Close()
+	next, err := uploadLocation(resp)
+	if err != nil {
+		return 0, "", false
+	}
+	// Range is inclusive, like 0-1023
+	parts := strings.SplitN(resp.Header.Get("Range"), "-", 2)
+	if len(parts) != 2 {
+		return 0, "", false
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return end + 1, next, true
+}
+
+// uploadLocation resolves the Location of an upload response against the
+// request url, as registries may return relative locations
+func uploadLocation(resp *http.Response) (string, error) {
+	location := resp.Header.Get("Location")
+	if len(location) == 0 {
+		return "", fmt.Errorf("%s %s: registry returned no upload location", resp.Request.Method, resp.Request.URL)
+	}
+	u, err := resp.Request.URL.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid upload location %q: %s", location, err)
+	}
+	return u.String(), nil
+}
+
+// dockerCredentials reads the registry credentials docker login stores in
+// $DOCKER_CONFIG/config.json or ~/.docker/config.json
+func dockerCredentials() map[string]string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if len(dir) == 0 {
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return nil
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return nil
+	}
+
+	creds := make(map[string]string)
+	for host, a := range config.Auths {
+		auth := a.Auth
+		if len(auth) == 0 && len(a.Username) > 0 {
+			auth = base64.StdEncoding.EncodeToString([]byte(a.Username + ":" + a.Password))
+		}
+		if len(auth) == 0 {
+			continue
+		}
+		if u, err := url.Parse(host); err == nil && len(u.Host) > 0 {
+			host = u.Host
+		}
+		if host == "index.docker.io" || host == "docker.io" {
+			host = dockerHubRegistry
+		}
+		creds[host] = auth
+	}
+	return creds
+}
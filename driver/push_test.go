@@ -0,0 +1,259 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// importTestImage imports a docker save archive of an image holding a
+// single file into s
+func importTestImage(t *testing.T, s *imageStore) *imageRecord {
+	t.Helper()
+	path := writeArchive(t, dockerSaveFiles(t, "world", dockerSaveManifest{
+		Config: "config.json",
+		Layers: []string{"layer/layer.tar"},
+	})...)
+	img, err := s.importImage(context.Background(), path, "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// assertPushed checks the registry holds img as repository:tag, with the
+// media type the store recorded
+func assertPushed(t *testing.T, reg *testRegistry, s *imageStore, img *imageRecord, repository, tag, mediaType string) {
+	t.Helper()
+	m, ok := reg.manifest(repository, tag)
+	if !ok {
+		t.Fatalf("%s:%s wasn't pushed", repository, tag)
+	}
+	if m.mediaType != mediaType {
+		t.Errorf("manifest pushed as %s, want %s", m.mediaType, mediaType)
+	}
+	var manifest imageManifest
+	if err := json.Unmarshal(m.body, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.MediaType != mediaType {
+		t.Errorf("manifest declares %q, want %s", manifest.MediaType, mediaType)
+	}
+	stored, err := s.readBlob(img.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, m.body) {
+		t.Error("pushed manifest differs from the one of the store")
+	}
+}
+
+func TestPushDockerSaveImage(t *testing.T) {
+	reg := newTestRegistry(t)
+	s := testStore(t)
+	img := importTestImage(t, s)
+
+	if err := testRegistryClient(t).push(context.Background(), s, img, reg.ref("app", "1.0"), nil); err != nil {
+		t.Fatal(err)
+	}
+	assertPushed(t, reg, s, img, "app", "1.0", mediaTypeDockerManifest)
+}
+
+func TestPushDerivedImages(t *testing.T) {
+	cases := []struct {
+		name      string
+		base      func(*testing.T, *imageStore) *imageRecord
+		mediaType string
+		layerType string
+	}{
+		{"docker base", importTestImage, mediaTypeDockerManifest, mediaTypeDockerLayerGzip},
+		{"oci base", func(t *testing.T, s *imageStore) *imageRecord {
+			dir, _ := ociLayout(t, "world", nil)
+			img, err := s.importImage(context.Background(), dir, "job")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return img
+		}, ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageLayerGzip},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reg := newTestRegistry(t)
+			s := testStore(t)
+			base := c.base(t, s)
+			img, err := s.deriveImage(base, "test", func(root string) error {
+				return ioutil.WriteFile(filepath.Join(root, "added"), []byte("added"), 0644)
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := testRegistryClient(t).push(context.Background(), s, img, reg.ref("app", "derived"), nil); err != nil {
+				t.Fatal(err)
+			}
+			assertPushed(t, reg, s, img, "app", "derived", c.mediaType)
+			descs := s.layerDescriptors(img)
+			if got := descs[len(descs)-1].MediaType; got != c.layerType {
+				t.Errorf("new layer is a %s, want %s", got, c.layerType)
+			}
+		})
+	}
+}
+
+func TestPushMountsBlobs(t *testing.T) {
+	reg := newTestRegistry(t)
+	s := testStore(t)
+	img := importTestImage(t, s)
+	r := testRegistryClient(t)
+
+	base := reg.ref("library/base", "1")
+	if err := r.push(context.Background(), s, img, base, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.tag(base.String(), img.ID); err != nil {
+		t.Fatal(err)
+	}
+	uploads := len(reg.uploads)
+
+	if err := r.push(context.Background(), s, img, reg.ref("app", "1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if reg.mounts != 2 {
+		t.Errorf("mounted %d blobs, want the config and the layer", reg.mounts)
+	}
+	if len(reg.uploads) != uploads {
+		t.Errorf("started %d uploads for blobs the registry could mount", len(reg.uploads)-uploads)
+	}
+	assertPushed(t, reg, s, img, "app", "1", mediaTypeDockerManifest)
+
+	// pushing again finds every blob in place
+	mounts := reg.mounts
+	if err := r.push(context.Background(), s, img, reg.ref("app", "2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if reg.mounts != mounts || len(reg.uploads) != uploads {
+		t.Error("blobs the repository holds were sent again")
+	}
+}
+
+func TestPushManifestWithoutMediaType(t *testing.T) {
+	reg := newTestRegistry(t)
+	s := testStore(t)
+	img := importTestImage(t, s)
+
+	// manifests stored by earlier versions have no mediaType
+	var manifest imageManifest
+	buf, err := s.readBlob(img.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := json.Marshal(manifest.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Manifest, _, err = s.putBlob(bytes.NewReader(legacy), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := testRegistryClient(t).push(context.Background(), s, img, reg.ref("app", "legacy"), nil); err != nil {
+		t.Fatal(err)
+	}
+	m, ok := reg.manifest("app", "legacy")
+	if !ok {
+		t.Fatal("manifest wasn't pushed")
+	}
+	if m.mediaType != mediaTypeDockerManifest || !bytes.Contains(m.body, []byte(`"mediaType":"`+mediaTypeDockerManifest+`"`)) {
+		t.Errorf("pushed %s manifest %s", m.mediaType, m.body)
+	}
+}
+
+func TestPullReleaseManifest(t *testing.T) {
+	mirror, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mirror)
+	dir := filepath.Join(mirror, "12.0-RELEASE")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// distsets may be plain tars, like any layer
+	base := testLayer(t, file("COPYRIGHT", "FreeBSD")).Bytes()
+	if err := ioutil.WriteFile(filepath.Join(dir, "base.txz"), base, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := digest.FromBytes(base)
+	if err := ioutil.WriteFile(filepath.Join(dir, "MANIFEST"), []byte("base.txz\t"+sum.Hex()+"\t1\tbase\t\"Base system\"\ton\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{images: testStore(t), config: &Config{ReleaseMirror: mirror}, logger: hclog.NewNullLogger()}
+	img, err := d.pullRelease(context.Background(), nil, "12.0-RELEASE", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := d.images.readBlob(img.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest imageManifest
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.MediaType != ocispec.MediaTypeImageManifest {
+		t.Errorf("release manifest declares %q", manifest.MediaType)
+	}
+	if manifest.Layers[0].Size != int64(len(base)) {
+		t.Errorf("distset descriptor has size %d, want %d", manifest.Layers[0].Size, len(base))
+	}
+	assertRootfsFile(t, d.images, img, "COPYRIGHT", "FreeBSD")
+}
+
+func TestManifestMediaType(t *testing.T) {
+	manifest := func(mediaType, configType string) []byte {
+		buf, _ := json.Marshal(imageManifest{
+			MediaType: mediaType,
+			Manifest: ocispec.Manifest{
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				Config:    ocispec.Descriptor{MediaType: configType, Digest: digest.Digest("sha256:" + hex.EncodeToString(make([]byte, 32)))},
+			},
+		})
+		return buf
+	}
+	cases := []struct {
+		name string
+		body []byte
+		want string
+	}{
+		{"declared docker", manifest(mediaTypeDockerManifest, mediaTypeDockerConfig), mediaTypeDockerManifest},
+		{"declared oci", manifest(ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageConfig), ocispec.MediaTypeImageManifest},
+		{"docker config", manifest("", mediaTypeDockerConfig), mediaTypeDockerManifest},
+		{"oci config", manifest("", ocispec.MediaTypeImageConfig), ocispec.MediaTypeImageManifest},
+		{"garbage", []byte("{"), ocispec.MediaTypeImageManifest},
+	}
+	for _, c := range cases {
+		if got := manifestMediaType(c.body); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,559 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// dockerHubRegistry serves images without an explicit registry
+	dockerHubRegistry = "registry-1.docker.io"
+
+	// mediaTypeDockerManifest is the docker image manifest, schema 2
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+
+	// progressInterval is how often download progress is reported per blob
+	progressInterval = 5 * time.Second
+)
+
+// PullConfig controls image downloads in the plugin config
+type PullConfig struct {
+	Timeout string `codec:"timeout"`
+	Retries int    `codec:"retries"`
+	Backoff string `codec:"backoff"`
+}
+
+// imageRef is a reference to an image in a registry
+type imageRef struct {
+	Registry   string
+	Repository string
+	Reference  string
+}
+
+func (r imageRef) String() string {
+	if r.Registry == dockerHubRegistry {
+		return r.Repository + ":" + r.Reference
+	}
+	return r.Registry + "/" + r.Repository + ":" + r.Reference
+}
+
+// parseImageRef parses a reference like [registry/]repository[:tag]. The
+// first component names a registry when it looks like a host, otherwise
+// the image is on Docker Hub.
+func parseImageRef(s string) imageRef {
+	ref := imageRef{Registry: dockerHubRegistry, Reference: "latest"}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Registry, s = parts[0], parts[1]
+	}
+	if i := strings.LastIndex(s, "@"); i > 0 {
+		ref.Reference, s = s[i+1:], s[:i]
+	} else if i := strings.LastIndex(s, ":"); i > 0 {
+		ref.Reference, s = s[i+1:], s[:i]
+	}
+	if ref.Registry == dockerHubRegistry && !strings.Contains(s, "/") {
+		s = "library/" + s
+	}
+	ref.Repository = s
+	return ref
+}
+
+// pullProgress is reported while a blob of an image is downloaded
+type pullProgress struct {
+	Ref   string
+	Blob  digest.Digest
+	Done  int64
+	Total int64
+}
+
+// shortBlob is the blob as progress messages show it, the first 12
+// characters of its hex. Hex panics on digests without an algorithm.
+func (p pullProgress) shortBlob() string {
+	hex := string(p.Blob)
+	if i := strings.Index(hex, ":"); i >= 0 {
+		hex = hex[i+1:]
+	}
+	if len(hex) > 12 {
+		return hex[:12]
+	}
+	return hex
+}
+
+// registryClient talks to docker registry v2 APIs. Every request is bound
+// to a context, and blob downloads are retried with backoff.
+type registryClient struct {
+	client  *http.Client
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+
+	// tokens caches the Authorization header by registry and scope
+	tokensLock sync.Mutex
+	tokens     map[string]string
+
+	// credentials are the base64 user:password pairs of registries,
+	// presented to their token service or as basic auth
+	credentials map[string]string
+}
+
+func newRegistryClient(c PullConfig) (*registryClient, error) {
+	r := &registryClient{
+		client:  cleanhttp.DefaultPooledClient(),
+		retries: c.Retries,
+		tokens:  make(map[string]string),
+	}
+	var err error
+	if r.timeout, err = time.ParseDuration(c.Timeout); err != nil {
+		return nil, fmt.Errorf("invalid pull timeout %q: %s", c.Timeout, err)
+	}
+	if r.backoff, err = time.ParseDuration(c.Backoff); err != nil {
+		return nil, fmt.Errorf("invalid pull backoff %q: %s", c.Backoff, err)
+	}
+	return r, nil
+}
+
+// retryable is an error worth retrying the request for
+type retryable struct {
+	err error
+}
+
+func (r retryable) Error() string {
+	return r.err.Error()
+}
+
+// withRetries calls fn until it succeeds, fails with an error that isn't
+// retryable, or the retries are exhausted.
+func (r *registryClient) withRetries(ctx context.Context, fn func() error) error {
+	wait := r.backoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(retryable); !ok || attempt >= r.retries || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// do sends the request, authenticating against the registry token service
+// when challenged. The caller must close the body of the response.
+func (r *registryClient) do(ctx context.Context, ref imageRef, scope string, req *http.Request) (*http.Response, error) {
+	req = req.WithContext(ctx)
+	key := ref.Registry + " " + scope
+
+	r.tokensLock.Lock()
+	auth := r.tokens[key]
+	r.tokensLock.Unlock()
+	if len(auth) > 0 {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, retryable{err}
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, checkStatus(resp)
+	}
+	resp.Body.Close()
+
+	auth, err = r.authenticate(ctx, ref.Registry, resp.Header.Get("Www-Authenticate"), scope)
+	if err != nil {
+		return nil, err
+	}
+	r.tokensLock.Lock()
+	r.tokens[key] = auth
+	r.tokensLock.Unlock()
+
+	if req.GetBody != nil {
+		if req.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	} else if req.Body != nil {
+		// the body was consumed, the caller resends it with the new
+		// authorization
+		return nil, retryable{fmt.Errorf("%s %s: authorization renewed", req.Method, req.URL)}
+	}
+	req.Header.Set("Authorization", auth)
+	resp, err = r.client.Do(req)
+	if err != nil {
+		return nil, retryable{err}
+	}
+	return resp, checkStatus(resp)
+}
+
+// checkStatus turns error responses into errors, closing their body
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	err := fmt.Errorf("%s %s: %s %s", resp.Request.Method, resp.Request.URL, resp.Status, strings.TrimSpace(string(body)))
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return retryable{err}
+	}
+	return err
+}
+
+// authenticate answers a registry challenge, returning the Authorization
+// header to send. Bearer tokens are fetched from the token service, with
+// the credentials of the registry when there are some. scope may hold
+// several space separated scopes.
+func (r *registryClient) authenticate(ctx context.Context, registry, challenge, scope string) (string, error) {
+	creds := r.credentials[registry]
+	if strings.HasPrefix(strings.ToLower(strings.TrimSpace(challenge)), "basic") {
+		if len(creds) == 0 {
+			return "", fmt.Errorf("registry %s requires credentials", registry)
+		}
+		return "Basic " + creds, nil
+	}
+
+	params := parseChallenge(challenge)
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("unsupported registry auth challenge %q", challenge)
+	}
+
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid registry auth realm %q: %s", realm, err)
+	}
+	q := u.Query()
+	if service, ok := params["service"]; ok {
+		q.Set("service", service)
+	}
+	for _, s := range strings.Fields(scope) {
+		q.Add("scope", s)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if len(creds) > 0 {
+		req.Header.Set("Authorization", "Basic "+creds)
+	}
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", retryable{err}
+	}
+	if err := checkStatus(resp); err != nil {
+		return "", fmt.Errorf("failed to get registry token: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed decoding registry token: %s", err)
+	}
+	if len(result.Token) > 0 {
+		return "Bearer " + result.Token, nil
+	}
+	return "Bearer " + result.AccessToken, nil
+}
+
+// parseChallenge parses a `Bearer realm="...",service="..."` header
+func parseChallenge(challenge string) map[string]string {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return params
+	}
+	for _, kv := range strings.Split(parts[1], ",") {
+		kv := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return params
+}
+
+func pullScope(ref imageRef) string {
+	return "repository:" + ref.Repository + ":pull"
+}
+
+func (r *registryClient) url(ref imageRef, kind, reference string) string {
+	return registryScheme(ref.Registry) + "://" + ref.Registry + "/v2/" + ref.Repository + "/" + kind + "/" + reference
+}
+
+// registryScheme is https, except for registries on the loopback interface
+// which are spoken to over plain http, like docker does
+func registryScheme(registry string) string {
+	host := registry
+	if h, _, err := net.SplitHostPort(registry); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return "http"
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return "http"
+	}
+	return "https"
+}
+
+// manifest fetches the raw manifest of ref by tag or digest, which is either
+// an image manifest or a manifest list
+func (r *registryClient) manifest(ctx context.Context, ref imageRef, reference string) ([]byte, error) {
+	var body []byte
+	err := r.withRetries(ctx, func() error {
+		req, err := http.NewRequest("GET", r.url(ref, "manifests", reference), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Add("Accept", mediaTypeDockerManifest)
+		req.Header.Add("Accept", ocispec.MediaTypeImageManifest)
+		req.Header.Add("Accept", mediaTypeDockerManifestList)
+		req.Header.Add("Accept", ocispec.MediaTypeImageIndex)
+
+		reqCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+		resp, err := r.do(reqCtx, ref, pullScope(ref), req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return retryable{err}
+		}
+		return nil
+	})
+	return body, err
+}
+
+// fetchBlob downloads a blob into the store, reporting progress
+func (r *registryClient) fetchBlob(ctx context.Context, store *imageStore, ref imageRef, desc ocispec.Descriptor, report func(pullProgress)) error {
+	return r.download(ctx, store, ref.String(), desc, report, func(ctx context.Context) (*http.Response, error) {
+		req, err := http.NewRequest("GET", r.url(ref, "blobs", desc.Digest.String()), nil)
+		if err != nil {
+			return nil, err
+		}
+		return r.do(ctx, ref, pullScope(ref), req)
+	})
+}
+
+// fetchURL downloads the file at url into the store, reporting progress
+func (r *registryClient) fetchURL(ctx context.Context, store *imageStore, name, url string, desc ocispec.Descriptor, report func(pullProgress)) error {
+	return r.download(ctx, store, name, desc, report, func(ctx context.Context) (*http.Response, error) {
+		return r.get(ctx, url)
+	})
+}
+
+// get sends an unauthenticated GET request
+func (r *registryClient) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, retryable{err}
+	}
+	return resp, checkStatus(resp)
+}
+
+// download stores the body returned by send, which must match desc, in the
+// store. Every attempt is bound by the pull timeout.
+func (r *registryClient) download(ctx context.Context, store *imageStore, name string, desc ocispec.Descriptor,
+	report func(pullProgress), send func(context.Context) (*http.Response, error)) error {
+	return r.withRetries(ctx, func() error {
+		blobCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+		resp, err := send(blobCtx)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		pr := &progressReader{
+			r:      resp.Body,
+			report: report,
+			progress: pullProgress{
+				Ref:   name,
+				Blob:  desc.Digest,
+				Total: desc.Size,
+			},
+		}
+		if _, _, err := store.putBlob(pr, desc.Digest); err != nil {
+			// only reading the body is worth another attempt, the content
+			// not matching the digest or the store failing to write won't
+			// change
+			switch {
+			case ctx.Err() != nil:
+				return ctx.Err()
+			case blobCtx.Err() != nil:
+				return retryable{fmt.Errorf("blob %s: %s", desc.Digest, blobCtx.Err())}
+			case pr.err != nil:
+				return retryable{fmt.Errorf("blob %s: %s", desc.Digest, pr.err)}
+			}
+			return fmt.Errorf("blob %s: %s", desc.Digest, err)
+		}
+		pr.flush()
+		return nil
+	})
+}
+
+// platformManifest resolves a manifest list or image index to the image
+// manifest for this host, body is returned unchanged if it already is one.
+func (r *registryClient) platformManifest(ctx context.Context, ref imageRef, body []byte) ([]byte, error) {
+	var index ocispec.Index
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, fmt.Errorf("failed decoding manifest of %s: %s", ref, err)
+	}
+	if len(index.Manifests) == 0 {
+		return body, nil
+	}
+	desc, err := selectPlatform(index.Manifests, runtime.GOARCH)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ref, err)
+	}
+	body, err = r.manifest(ctx, ref, desc.Digest.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed retrieving manifest %s of %s: %s", desc.Digest, ref, err)
+	}
+	if desc.Digest.Validate() != nil || desc.Digest.Algorithm().FromBytes(body) != desc.Digest {
+		return nil, fmt.Errorf("manifest of %s doesn't match digest %s", ref, desc.Digest)
+	}
+	return body, nil
+}
+
+// selectPlatform picks the image manifest for arch out of the entries of a
+// manifest list. FreeBSD images are preferred, linux images run under the
+// linux ABI.
+func selectPlatform(manifests []ocispec.Descriptor, arch string) (ocispec.Descriptor, error) {
+	var found []string
+	for _, goos := range []string{"freebsd", "linux"} {
+		for _, m := range manifests {
+			if m.Platform == nil {
+				continue
+			}
+			if m.MediaType != "" && m.MediaType != mediaTypeDockerManifest && m.MediaType != ocispec.MediaTypeImageManifest {
+				continue
+			}
+			if m.Platform.OS == goos && m.Platform.Architecture == arch {
+				return m, nil
+			}
+		}
+	}
+	for _, m := range manifests {
+		if m.Platform != nil {
+			found = append(found, m.Platform.OS+"/"+m.Platform.Architecture)
+		}
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("no freebsd/%s or linux/%s image in manifest list, found %s",
+		arch, arch, strings.Join(found, ", "))
+}
+
+// pull fetches the manifest of ref and every blob it references that is
+// not in the image store yet, then unpacks the image.
+func (r *registryClient) pull(ctx context.Context, store *imageStore, ref imageRef, report func(pullProgress)) (*imageRecord, error) {
+	body, err := r.manifest(ctx, ref, ref.Reference)
+	if err != nil {
+		return nil, fmt.Errorf("failed retrieving manifest of %s: %s", ref, err)
+	}
+	if body, err = r.platformManifest(ctx, ref, body); err != nil {
+		return nil, err
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("failed decoding manifest of %s: %s", ref, err)
+	}
+	if manifest.Config.Digest == "" {
+		return nil, fmt.Errorf("unsupported manifest for %s", ref)
+	}
+
+	manifestDigest, _, err := store.putBlob(bytes.NewReader(body), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed storing manifest: %s", err)
+	}
+
+	var layers []digest.Digest
+	for _, l := range manifest.Layers {
+		layers = append(layers, l.Digest)
+	}
+
+	for _, desc := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		if store.hasBlob(desc.Digest) {
+			continue
+		}
+		if err := r.fetchBlob(ctx, store, ref, desc, report); err != nil {
+			return nil, fmt.Errorf("failed retrieving image blob %s: %s", desc.Digest, err)
+		}
+	}
+
+	img, err := store.createImage(manifestDigest, manifest.Config.Digest, layers)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.tag(ref.String(), img.ID); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// progressReader reports the bytes read at most every progressInterval
+type progressReader struct {
+	r        io.Reader
+	report   func(pullProgress)
+	progress pullProgress
+	last     time.Time
+
+	// err is the error reading r failed with
+	err error
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if err != nil && err != io.EOF {
+		p.err = err
+	}
+	p.progress.Done += int64(n)
+	if p.report != nil && time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		p.report(p.progress)
+	}
+	return n, err
+}
+
+// flush reports the final progress of a completed download
+func (p *progressReader) flush() {
+	if p.report != nil {
+		p.report(p.progress)
+	}
+}
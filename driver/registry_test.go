@@ -0,0 +1,510 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testRegistry is a registry keeping blobs and manifests in memory. Like
+// a real registry it checks uploaded blobs against their digest and
+// manifests against their media type and the blobs of their repository.
+type testRegistry struct {
+	*httptest.Server
+	t *testing.T
+
+	lock sync.Mutex
+	// blobs and manifests are keyed by repository
+	blobs     map[string]map[digest.Digest][]byte
+	manifests map[string]map[string]testManifest
+	uploads   map[string][]byte
+	mounts    int
+}
+
+type testManifest struct {
+	mediaType string
+	body      []byte
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{
+		t:         t,
+		blobs:     make(map[string]map[digest.Digest][]byte),
+		manifests: make(map[string]map[string]testManifest),
+		uploads:   make(map[string][]byte),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// ref returns a reference to repository:tag of the registry
+func (r *testRegistry) ref(repository, tag string) imageRef {
+	return imageRef{Registry: strings.TrimPrefix(r.URL, "http://"), Repository: repository, Reference: tag}
+}
+
+func (r *testRegistry) addBlob(repository string, body []byte) ocispec.Descriptor {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	d := digest.FromBytes(body)
+	r.putBlob(repository, d, body)
+	return ocispec.Descriptor{Digest: d, Size: int64(len(body))}
+}
+
+func (r *testRegistry) putBlob(repository string, d digest.Digest, body []byte) {
+	if r.blobs[repository] == nil {
+		r.blobs[repository] = make(map[digest.Digest][]byte)
+	}
+	r.blobs[repository][d] = body
+}
+
+// addManifest serves v as a manifest by digest and by the tags given
+func (r *testRegistry) addManifest(repository, mediaType string, v interface{}, tags ...string) ocispec.Descriptor {
+	body, err := json.Marshal(v)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	d := digest.FromBytes(body)
+	for _, ref := range append(tags, d.String()) {
+		r.putManifest(repository, ref, testManifest{mediaType: mediaType, body: body})
+	}
+	return ocispec.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(body))}
+}
+
+func (r *testRegistry) putManifest(repository, reference string, m testManifest) {
+	if r.manifests[repository] == nil {
+		r.manifests[repository] = make(map[string]testManifest)
+	}
+	r.manifests[repository][reference] = m
+}
+
+// manifest returns the manifest stored as repository:reference
+func (r *testRegistry) manifest(repository, reference string) (testManifest, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	m, ok := r.manifests[repository][reference]
+	return m, ok
+}
+
+func (r *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	var repository, kind, reference string
+	for _, k := range []string{"/manifests/", "/blobs/uploads/", "/blobs/"} {
+		if i := strings.Index(p, k); i > 0 {
+			repository, kind, reference = p[:i], strings.Trim(k, "/"), p[i+len(k):]
+			break
+		}
+	}
+
+	switch {
+	case kind == "manifests" && req.Method == "GET":
+		m, ok := r.manifests[repository][reference]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Write(m.body)
+	case kind == "manifests" && req.Method == "PUT":
+		body, _ := ioutil.ReadAll(req.Body)
+		if code, err := r.checkManifest(repository, req.Header.Get("Content-Type"), body); err != "" {
+			http.Error(w, `{"errors":[{"code":"`+code+`","message":"`+err+`"}]}`, http.StatusBadRequest)
+			return
+		}
+		m := testManifest{mediaType: req.Header.Get("Content-Type"), body: body}
+		r.putManifest(repository, reference, m)
+		r.putManifest(repository, digest.FromBytes(body).String(), m)
+		w.WriteHeader(http.StatusCreated)
+	case kind == "blobs" && (req.Method == "GET" || req.Method == "HEAD"):
+		body, ok := r.blobs[repository][digest.Digest(reference)]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if req.Method == "GET" {
+			w.Write(body)
+		}
+	case kind == "blobs/uploads" && req.Method == "POST":
+		q := req.URL.Query()
+		if body, ok := r.blobs[q.Get("from")][digest.Digest(q.Get("mount"))]; ok {
+			r.putBlob(repository, digest.Digest(q.Get("mount")), body)
+			r.mounts++
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		id := strconv.Itoa(len(r.uploads))
+		r.uploads[id] = nil
+		w.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case kind == "blobs/uploads" && (req.Method == "PATCH" || req.Method == "PUT"):
+		data, ok := r.uploads[reference]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		data = append(data, body...)
+		if req.Method == "PATCH" {
+			r.uploads[reference] = data
+			w.Header().Set("Location", req.URL.Path)
+			w.Header().Set("Range", "0-"+strconv.Itoa(len(data)-1))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		d := digest.Digest(req.URL.Query().Get("digest"))
+		if d.Validate() != nil || digest.FromBytes(data) != d {
+			http.Error(w, `{"errors":[{"code":"DIGEST_INVALID"}]}`, http.StatusBadRequest)
+			return
+		}
+		delete(r.uploads, reference)
+		r.putBlob(repository, d, data)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkManifest validates an uploaded manifest the way docker distribution
+// does, returning the error code it would answer with
+func (r *testRegistry) checkManifest(repository, contentType string, body []byte) (string, string) {
+	var m imageManifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return "MANIFEST_INVALID", err.Error()
+	}
+	switch {
+	case contentType == mediaTypeDockerManifest && m.MediaType != mediaTypeDockerManifest:
+		return "MANIFEST_INVALID", "mediaType in manifest should be " + mediaTypeDockerManifest
+	case contentType == ocispec.MediaTypeImageManifest && m.MediaType != "" && m.MediaType != contentType:
+		return "MANIFEST_INVALID", "mediaType in manifest should be " + contentType
+	case contentType != mediaTypeDockerManifest && contentType != ocispec.MediaTypeImageManifest:
+		return "MANIFEST_INVALID", "unsupported manifest type " + contentType
+	}
+	for _, desc := range append([]ocispec.Descriptor{m.Config}, m.Layers...) {
+		blob, ok := r.blobs[repository][desc.Digest]
+		if !ok {
+			return "MANIFEST_BLOB_UNKNOWN", desc.Digest.String()
+		}
+		if desc.Size != int64(len(blob)) {
+			return "MANIFEST_INVALID", "size of " + desc.Digest.String() + " doesn't match"
+		}
+	}
+	return "", ""
+}
+
+// testImage serves an image holding a single file in repository,
+// returning its manifest
+func (r *testRegistry) testImage(repository, goos, content string) ocispec.Manifest {
+	layer := testLayer(r.t, file("platform", content))
+	config, err := json.Marshal(ocispec.Image{OS: goos, Architecture: runtime.GOARCH})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	configDesc := r.addBlob(repository, config)
+	configDesc.MediaType = ocispec.MediaTypeImageConfig
+	layerDesc := r.addBlob(repository, layer.Bytes())
+	layerDesc.MediaType = ocispec.MediaTypeImageLayer
+	return ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    configDesc,
+		Layers:    []ocispec.Descriptor{layerDesc},
+	}
+}
+
+func testRegistryClient(t *testing.T) *registryClient {
+	t.Helper()
+	r, err := newRegistryClient(PullConfig{Timeout: "10s", Backoff: "10ms", Retries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func platformDesc(mediaType, os, arch string) ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromString(os + arch),
+		Platform:  &ocispec.Platform{OS: os, Architecture: arch},
+	}
+}
+
+func TestSelectPlatform(t *testing.T) {
+	linux := platformDesc(mediaTypeDockerManifest, "linux", "amd64")
+	freebsd := platformDesc(ocispec.MediaTypeImageManifest, "freebsd", "amd64")
+	arm := platformDesc(mediaTypeDockerManifest, "linux", "arm64")
+	windows := platformDesc(mediaTypeDockerManifest, "windows", "amd64")
+	nested := platformDesc(ocispec.MediaTypeImageIndex, "freebsd", "amd64")
+	untyped := platformDesc("", "linux", "amd64")
+	noPlatform := ocispec.Descriptor{MediaType: mediaTypeDockerManifest, Digest: digest.FromString("none")}
+
+	cases := []struct {
+		name      string
+		manifests []ocispec.Descriptor
+		want      ocispec.Descriptor
+		err       bool
+	}{
+		{"linux only", []ocispec.Descriptor{arm, linux, windows}, linux, false},
+		{"freebsd preferred", []ocispec.Descriptor{linux, freebsd}, freebsd, false},
+		{"untyped entry", []ocispec.Descriptor{untyped}, untyped, false},
+		{"nested index skipped", []ocispec.Descriptor{nested, linux}, linux, false},
+		{"no platform", []ocispec.Descriptor{noPlatform, linux}, linux, false},
+		{"wrong architecture", []ocispec.Descriptor{arm}, ocispec.Descriptor{}, true},
+		{"wrong os", []ocispec.Descriptor{windows, noPlatform}, ocispec.Descriptor{}, true},
+	}
+	for _, c := range cases {
+		got, err := selectPlatform(c.manifests, "amd64")
+		if (err != nil) != c.err {
+			t.Errorf("%s: error = %v, want error %v", c.name, err, c.err)
+			continue
+		}
+		if got.Digest != c.want.Digest {
+			t.Errorf("%s: selected %s/%s", c.name, got.Platform.OS, got.Platform.Architecture)
+		}
+	}
+}
+
+func TestPullManifestList(t *testing.T) {
+	for _, mediaType := range []string{mediaTypeDockerManifestList, ocispec.MediaTypeImageIndex} {
+		t.Run(mediaType, func(t *testing.T) {
+			reg := newTestRegistry(t)
+			linux := reg.addManifest("app", ocispec.MediaTypeImageManifest, reg.testImage("app", "linux", "linux"))
+			linux.Platform = &ocispec.Platform{OS: "linux", Architecture: runtime.GOARCH}
+			other := reg.addManifest("app", ocispec.MediaTypeImageManifest, reg.testImage("app", "linux", "other"))
+			other.Platform = &ocispec.Platform{OS: "linux", Architecture: "s390x"}
+			reg.addManifest("app", mediaType, ocispec.Index{
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				Manifests: []ocispec.Descriptor{other, linux},
+			}, "latest")
+
+			r := testRegistryClient(t)
+			body, err := r.manifest(context.Background(), reg.ref("app", "latest"), "latest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err = r.platformManifest(context.Background(), reg.ref("app", "latest"), body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if digest.FromBytes(body) != linux.Digest {
+				t.Fatalf("resolved %s, want the linux manifest of the host architecture", digest.FromBytes(body))
+			}
+		})
+	}
+}
+
+func TestPullManifestListUnpacks(t *testing.T) {
+	reg := newTestRegistry(t)
+	m := reg.testImage("freebsd", "freebsd", "freebsd")
+	desc := reg.addManifest("freebsd", ocispec.MediaTypeImageManifest, m)
+	desc.Platform = &ocispec.Platform{OS: "freebsd", Architecture: runtime.GOARCH}
+	reg.addManifest("freebsd", ocispec.MediaTypeImageIndex, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{desc},
+	}, "12.0")
+
+	s := testStore(t)
+	ref := reg.ref("freebsd", "12.0")
+	img, err := testRegistryClient(t).pull(context.Background(), s, ref, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Manifest != desc.Digest {
+		t.Errorf("image manifest is %s, want %s", img.Manifest, desc.Digest)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(s.rootfsPath(img.ID), "platform"))
+	if err != nil || string(buf) != "freebsd" {
+		t.Fatalf("unpacked rootfs holds %q %v", buf, err)
+	}
+	if _, err := s.resolve(ref.String()); err != nil {
+		t.Errorf("image isn't tagged: %s", err)
+	}
+}
+
+func TestPullManifestDigestMismatch(t *testing.T) {
+	reg := newTestRegistry(t)
+	desc := reg.addManifest("app", ocispec.MediaTypeImageManifest, reg.testImage("app", "linux", "linux"))
+	desc.Platform = &ocispec.Platform{OS: "linux", Architecture: runtime.GOARCH}
+	// serve another manifest under the digest of the index entry
+	tampered, err := json.Marshal(reg.testImage("app", "linux", "tampered"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.putManifest("app", desc.Digest.String(), testManifest{mediaType: ocispec.MediaTypeImageManifest, body: tampered})
+	index, err := json.Marshal(ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}, Manifests: []ocispec.Descriptor{desc}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = testRegistryClient(t).platformManifest(context.Background(), reg.ref("app", "latest"), index)
+	if err == nil || !strings.Contains(err.Error(), "doesn't match digest") {
+		t.Fatalf("expected a digest mismatch, got %v", err)
+	}
+}
+
+func TestDownloadRetries(t *testing.T) {
+	blob := []byte("layer")
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	cases := []struct {
+		name     string
+		serve    func(w http.ResponseWriter, attempt int)
+		timeout  time.Duration
+		noTmp    bool
+		attempts int
+		ok       bool
+	}{
+		{
+			name: "server error",
+			serve: func(w http.ResponseWriter, attempt int) {
+				if attempt == 1 {
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				w.Write(blob)
+			},
+			attempts: 2,
+			ok:       true,
+		},
+		{
+			name: "truncated body",
+			serve: func(w http.ResponseWriter, attempt int) {
+				w.Header().Set("Content-Length", "100")
+				w.Write(blob)
+			},
+			attempts: 3,
+		},
+		{
+			name: "timeout",
+			serve: func(w http.ResponseWriter, attempt int) {
+				w.Write(blob[:1])
+				w.(http.Flusher).Flush()
+				time.Sleep(200 * time.Millisecond)
+			},
+			timeout:  50 * time.Millisecond,
+			attempts: 3,
+		},
+		{
+			name:     "not found",
+			serve:    func(w http.ResponseWriter, attempt int) { http.NotFound(w, nil) },
+			attempts: 1,
+		},
+		{
+			name:     "digest mismatch",
+			serve:    func(w http.ResponseWriter, attempt int) { w.Write([]byte("tampered")) },
+			attempts: 1,
+		},
+		{
+			name:     "store failing",
+			serve:    func(w http.ResponseWriter, attempt int) { w.Write(blob) },
+			noTmp:    true,
+			attempts: 1,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var lock sync.Mutex
+			attempts := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				lock.Lock()
+				attempts++
+				attempt := attempts
+				lock.Unlock()
+				c.serve(w, attempt)
+			}))
+			defer srv.Close()
+
+			s := testStore(t)
+			if c.noTmp {
+				if err := os.RemoveAll(filepath.Join(s.root, "tmp")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r, err := newRegistryClient(PullConfig{Timeout: "10s", Backoff: "1ms", Retries: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.timeout > 0 {
+				r.timeout = c.timeout
+			}
+
+			err = r.fetchURL(context.Background(), s, "layer", srv.URL, desc, nil)
+			if c.ok != (err == nil) {
+				t.Fatalf("fetchURL() = %v", err)
+			}
+			if c.ok && !s.hasBlob(desc.Digest) {
+				t.Error("the blob isn't in the store")
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if attempts != c.attempts {
+				t.Errorf("got %d attempts, want %d: %v", attempts, c.attempts, err)
+			}
+		})
+	}
+}
+
+func TestDownloadCancel(t *testing.T) {
+	started := make(chan struct{}, 3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		w.Write([]byte("l"))
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+	}))
+	defer srv.Close()
+
+	r, err := newRegistryClient(PullConfig{Timeout: "10s", Backoff: "1ms", Retries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	blob := []byte("layer")
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	err = r.fetchURL(ctx, testStore(t), "layer", srv.URL, desc, nil)
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("fetchURL() = %v, want %v", err, context.Canceled)
+	}
+	if n := len(started); n != 0 {
+		t.Errorf("%d more attempts after the pull was canceled", n)
+	}
+}
+
+func TestShortBlob(t *testing.T) {
+	d := digest.FromString("layer")
+	if got := (pullProgress{Blob: d}).shortBlob(); got != d.Hex()[:12] {
+		t.Errorf("shortBlob() = %s", got)
+	}
+	for _, d := range []digest.Digest{"", "sha256:abc", "invalid"} {
+		if got := (pullProgress{Blob: d}).shortBlob(); len(got) > 12 {
+			t.Errorf("shortBlob() of %q = %s", d, got)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// defaultReleaseMirror serves the FreeBSD release distsets
+	defaultReleaseMirror = "https://download.freebsd.org/releases"
+
+	// mediaTypeDistset is a FreeBSD distribution set, an xz compressed tar
+	mediaTypeDistset = "application/x-freebsd-distset+xz"
+)
+
+// releaseArch is the directory of the host architecture on release mirrors
+func releaseArch() string {
+	switch runtime.GOARCH {
+	case "386":
+		return "i386"
+	case "arm64":
+		return "arm64/aarch64"
+	}
+	return runtime.GOARCH
+}
+
+// releaseRef is the image store reference of a release and its distsets
+func releaseRef(release string, distsets []string) string {
+	return "freebsd/" + strings.Join(distsets, "+") + ":" + release
+}
+
+// parseReleaseManifest reads the sha256 of every distset from a release
+// MANIFEST, whose lines start with the file name and its checksum.
+func parseReleaseManifest(buf []byte) map[string]digest.Digest {
+	sums := make(map[string]digest.Digest)
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		d := digest.NewDigestFromHex(digest.SHA256.String(), fields[1])
+		if d.Validate() == nil {
+			sums[fields[0]] = d
+		}
+	}
+	return sums
+}
+
+// pullRelease provides an image made of the distsets of a FreeBSD release,
+// downloading and verifying the ones missing from the store.
+func (d *Driver) pullRelease(ctx context.Context, report func(pullProgress), release string, distsets []string) (*imageRecord, error) {
+	if len(distsets) == 0 {
+		distsets = []string{"base"}
+	}
+	ref := releaseRef(release, distsets)
+	if img, err := d.images.resolve(ref); err == nil {
+		return img, nil
+	}
+
+	return d.images.coalesce(ctx, "release:"+ref, report, func(ctx context.Context, report func(pullProgress)) (*imageRecord, error) {
+		src := newReleaseSource(d.config.ReleaseMirror, release)
+		buf, err := src.read(ctx, d.registry, "MANIFEST")
+		if err != nil {
+			return nil, fmt.Errorf("failed retrieving MANIFEST of %s: %s", release, err)
+		}
+		sums := parseReleaseManifest(buf)
+
+		manifest := ocispec.Manifest{Versioned: specs.Versioned{SchemaVersion: 2}}
+		for _, set := range distsets {
+			name := set + ".txz"
+			sum, ok := sums[name]
+			if !ok {
+				return nil, fmt.Errorf("distset %s is not part of %s", name, release)
+			}
+			desc := ocispec.Descriptor{MediaType: mediaTypeDistset, Digest: sum}
+			if !d.images.hasBlob(sum) {
+				if err := src.fetch(ctx, d.images, d.registry, release, name, desc, report); err != nil {
+					return nil, fmt.Errorf("failed retrieving %s of %s: %s", name, release, err)
+				}
+			}
+			fi, err := os.Stat(d.images.blobPath(sum))
+			if err != nil {
+				return nil, err
+			}
+			desc.Size = fi.Size()
+			manifest.Layers = append(manifest.Layers, desc)
+		}
+
+		// The config has no timestamps so a release always maps to the
+		// same image
+		config, err := json.Marshal(ocispec.Image{
+			Architecture: runtime.GOARCH,
+			OS:           "freebsd",
+			Config: ocispec.ImageConfig{
+				Cmd: []string{"/bin/sh", "/etc/rc"},
+				Labels: map[string]string{
+					"org.freebsd.release":  release,
+					"org.freebsd.distsets": strings.Join(distsets, " "),
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		configDigest, n, err := d.images.putBlob(bytes.NewReader(config), "")
+		if err != nil {
+			return nil, fmt.Errorf("failed storing image config: %s", err)
+		}
+		manifest.Config = ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: configDigest, Size: n}
+
+		manifestDigest, err := d.images.putManifest(ocispec.MediaTypeImageManifest, manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		var layers []digest.Digest
+		for _, l := range manifest.Layers {
+			layers = append(layers, l.Digest)
+		}
+		img, err := d.images.createImage(manifestDigest, configDigest, layers)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.images.tag(ref, img.ID); err != nil {
+			return nil, err
+		}
+		return img, nil
+	})
+}
+
+// releaseSource is where the files of a release are read from, either a
+// mirror laid out like download.freebsd.org or a local directory holding
+// <release>/MANIFEST and the distsets.
+type releaseSource struct {
+	url string
+	dir string
+}
+
+func newReleaseSource(mirror, release string) *releaseSource {
+	if len(mirror) == 0 {
+		mirror = defaultReleaseMirror
+	}
+	if strings.HasPrefix(mirror, "http://") || strings.HasPrefix(mirror, "https://") {
+		return &releaseSource{url: strings.TrimSuffix(mirror, "/") + "/" + releaseArch() + "/" + release + "/"}
+	}
+	return &releaseSource{dir: filepath.Join(strings.TrimPrefix(mirror, "file://"), release)}
+}
+
+func (s *releaseSource) read(ctx context.Context, r *registryClient, name string) ([]byte, error) {
+	if len(s.dir) > 0 {
+		return ioutil.ReadFile(filepath.Join(s.dir, name))
+	}
+	var buf []byte
+	err := r.withRetries(ctx, func() error {
+		reqCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+		resp, err := r.get(reqCtx, s.url+name)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if buf, err = ioutil.ReadAll(resp.Body); err != nil {
+			return retryable{err}
+		}
+		return nil
+	})
+	return buf, err
+}
+
+// fetch copies the distset name into the store, checking it against desc
+func (s *releaseSource) fetch(ctx context.Context, store *imageStore, r *registryClient, release, name string,
+	desc ocispec.Descriptor, report func(pullProgress)) error {
+	if len(s.url) > 0 {
+		return r.fetchURL(ctx, store, "FreeBSD "+release, s.url+name, desc, report)
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, err = store.putBlob(f, desc.Digest)
+	return err
+}
@@ -0,0 +1,38 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestParseReleaseManifest(t *testing.T) {
+	base := digest.FromString("base")
+	lib32 := digest.FromString("lib32")
+	manifest := strings.Join([]string{
+		"base.txz\t" + base.Hex() + "\t26032\tbase\t\"Base system (MANDATORY)\"\ton",
+		"lib32.txz\t" + lib32.Hex() + "\t1146\tlib32\t\"32-bit compatibility libraries\"\ton",
+		"kernel.txz\tnot-a-checksum\t904\tkernel\t\"Kernel (MANDATORY)\"\ton",
+		"",
+		"ports.txz",
+	}, "\n")
+
+	sums := parseReleaseManifest([]byte(manifest))
+	if len(sums) != 2 || sums["base.txz"] != base || sums["lib32.txz"] != lib32 {
+		t.Fatalf("got %v", sums)
+	}
+}
+
+func TestReleaseRef(t *testing.T) {
+	if got := releaseRef("12.0-RELEASE", []string{"base", "lib32"}); got != "freebsd/base+lib32:12.0-RELEASE" {
+		t.Errorf("releaseRef() = %s", got)
+	}
+}
@@ -0,0 +1,305 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// shapeRuleBase and shapePipeBase are the first ipfw rule and dummynet
+	// pipe numbers used by the driver. Every shaped task gets a slot, one
+	// rule number and two pipes.
+	shapeRuleBase  = 30000
+	shapePipeBase  = 30000
+	maxShapedTasks = 4096
+
+	// shapeSampleIntv is how often the observed throughput is sampled
+	shapeSampleIntv = 10 * time.Second
+)
+
+// NetworkLimits is the network_limits block of a task
+type NetworkLimits struct {
+	EgressKbps  int `codec:"egress_kbps"`
+	IngressKbps int `codec:"ingress_kbps"`
+
+	// DelayMs is added to the packets of each direction
+	DelayMs int `codec:"delay_ms"`
+}
+
+func (l NetworkLimits) enabled() bool {
+	return l.EgressKbps > 0 || l.IngressKbps > 0 || l.DelayMs > 0
+}
+
+// shaping is the ipfw rule and dummynet pipes of a task, kept in its state
+type shaping struct {
+	Slot  int
+	Addrs []string
+	// Interface is the host side of the epair of a VNET jail, matched
+	// instead of Addrs
+	Interface string
+	Limits    NetworkLimits
+}
+
+func (s *shaping) rule() int {
+	return shapeRuleBase + s.Slot
+}
+
+func (s *shaping) egressPipe() int {
+	return shapePipeBase + 2*s.Slot
+}
+
+func (s *shaping) ingressPipe() int {
+	return shapePipeBase + 2*s.Slot + 1
+}
+
+// shaper hands out the rule and pipe numbers of shaped tasks
+type shaper struct {
+	lock sync.Mutex
+	used map[int]bool
+}
+
+func newShaper() *shaper {
+	return &shaper{used: make(map[int]bool)}
+}
+
+func ipfw(args ...string) (string, error) {
+	out, err := exec.Command("ipfw", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ipfw %s failed: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// apply creates the pipes of the limits and the rules sending the traffic
+// of the jail through them, matched on the host side of its epair for VNET
+// jails and on its addresses otherwise. The rules pass the packets out of
+// the firewall once shaped, as net.inet.ip.fw.one_pass is set by default.
+func (s *shaper) apply(addrs []net.IP, epair string, limits NetworkLimits) (*shaping, error) {
+	if len(addrs) == 0 && len(epair) == 0 {
+		return nil, fmt.Errorf("network_limits needs the addresses of the jail or network mode vnet")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sh := &shaping{Slot: -1, Limits: limits}
+	for i := 0; i < maxShapedTasks; i++ {
+		if !s.used[i] {
+			sh.Slot = i
+			break
+		}
+	}
+	if sh.Slot < 0 {
+		return nil, fmt.Errorf("more than %d tasks with network_limits", maxShapedTasks)
+	}
+	if len(epair) > 0 {
+		sh.Interface = epair + "a"
+	} else {
+		for _, ip := range addrs {
+			sh.Addrs = append(sh.Addrs, ip.String())
+		}
+	}
+	// left behind by a crash of the plugin
+	deleteShaping(sh)
+
+	for _, args := range shapingCommands(sh) {
+		if _, err := ipfw(args...); err != nil {
+			deleteShaping(sh)
+			return nil, err
+		}
+	}
+	s.used[sh.Slot] = true
+	return sh, nil
+}
+
+// shapingCommands returns the ipfw arguments configuring the pipes of sh
+// and adding its rules, a pipe is left out when it would do nothing
+func shapingCommands(sh *shaping) [][]string {
+	rule := strconv.Itoa(sh.rule())
+	delay := strconv.Itoa(sh.Limits.DelayMs)
+	// the host side of the epair receives what the jail sends
+	pipes := []struct {
+		pipe  int
+		kbps  int
+		dir   string
+		match func(addr string) []string
+	}{
+		{sh.egressPipe(), sh.Limits.EgressKbps, "in", func(addr string) []string {
+			return []string{"from", addr, "to", "any", "out"}
+		}},
+		{sh.ingressPipe(), sh.Limits.IngressKbps, "out", func(addr string) []string {
+			return []string{"from", "any", "to", addr, "in"}
+		}},
+	}
+
+	var cmds [][]string
+	for _, p := range pipes {
+		if p.kbps == 0 && sh.Limits.DelayMs == 0 {
+			continue
+		}
+		pipe := strconv.Itoa(p.pipe)
+		// bw 0 leaves the bandwidth unlimited, for a delay alone
+		cmds = append(cmds, []string{"pipe", pipe, "config", "bw", strconv.Itoa(p.kbps) + "Kbit/s", "delay", delay})
+		add := []string{"-q", "add", rule, "pipe", pipe, "ip"}
+		if len(sh.Interface) > 0 {
+			cmds = append(cmds, append(add, "from", "any", "to", "any", p.dir, "via", sh.Interface))
+			continue
+		}
+		for _, addr := range sh.Addrs {
+			cmds = append(cmds, append(append([]string{}, add...), p.match(addr)...))
+		}
+	}
+	return cmds
+}
+
+// restore marks the slot of a recovered task as used
+func (s *shaper) restore(sh *shaping) {
+	if sh == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.used[sh.Slot] = true
+}
+
+// remove deletes the rule and pipes of a task and frees its slot
+func (s *shaper) remove(sh *shaping) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := deleteShaping(sh)
+	delete(s.used, sh.Slot)
+	return err
+}
+
+// deleteShaping deletes the rule and pipes of sh that exist
+func deleteShaping(sh *shaping) error {
+	var last error
+	if out, err := ipfw("-q", "show", strconv.Itoa(sh.rule())); err == nil && len(strings.TrimSpace(out)) > 0 {
+		if _, err := ipfw("-q", "delete", strconv.Itoa(sh.rule())); err != nil {
+			last = err
+		}
+	}
+	for _, pipe := range []int{sh.egressPipe(), sh.ingressPipe()} {
+		if _, err := ipfw("pipe", strconv.Itoa(pipe), "show"); err != nil {
+			continue
+		}
+		if _, err := ipfw("pipe", "delete", strconv.Itoa(pipe)); err != nil {
+			last = err
+		}
+	}
+	return last
+}
+
+// shapingBytes reads the bytes sent through the egress and ingress pipes
+// of sh from the counters of its rule
+func shapingBytes(sh *shaping) (uint64, uint64, error) {
+	out, err := ipfw("show", strconv.Itoa(sh.rule()))
+	if err != nil {
+		return 0, 0, err
+	}
+	egress, ingress := parseShapingCounters(out, sh)
+	return egress, ingress, nil
+}
+
+// parseShapingCounters sums the bytes of the rules of sh in the output of
+// ipfw show by pipe
+func parseShapingCounters(out string, sh *shaping) (uint64, uint64) {
+	var egress, ingress uint64
+	for _, line := range strings.Split(out, "\n") {
+		// 30000 12 3456 pipe 30000 ip from 10.0.0.5 to any out
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] != strconv.Itoa(sh.rule()) || fields[3] != "pipe" {
+			continue
+		}
+		bytes, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[4] {
+		case strconv.Itoa(sh.egressPipe()):
+			egress += bytes
+		case strconv.Itoa(sh.ingressPipe()):
+			ingress += bytes
+		}
+	}
+	return egress, ingress
+}
+
+// sampleShaping reports the configured and the observed throughput of the
+// task as gauges until ctx is done
+func sampleShaping(ctx context.Context, cfg *drivers.TaskConfig, sh *shaping) {
+	labels := []metrics.Label{{Name: "alloc_id", Value: cfg.AllocID}, {Name: "task", Value: cfg.Name}}
+	gauge := func(name string, val float32) {
+		metrics.SetGaugeWithLabels([]string{"jail_task_driver", "network", name}, val, labels)
+	}
+
+	ticker := time.NewTicker(shapeSampleIntv)
+	defer ticker.Stop()
+	lastEgress, lastIngress, _ := shapingBytes(sh)
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			egress, ingress, err := shapingBytes(sh)
+			if err != nil {
+				continue
+			}
+			secs := now.Sub(last).Seconds()
+			if egress >= lastEgress && ingress >= lastIngress && secs > 0 {
+				gauge("egress_kbps", float32(float64(egress-lastEgress)*8/1000/secs))
+				gauge("ingress_kbps", float32(float64(ingress-lastIngress)*8/1000/secs))
+			}
+			gauge("egress_limit_kbps", float32(sh.Limits.EgressKbps))
+			gauge("ingress_limit_kbps", float32(sh.Limits.IngressKbps))
+			lastEgress, lastIngress, last = egress, ingress, now
+		}
+	}
+}
+
+// resumeShaping starts sampling the throughput of a shaped task
+func (d *Driver) resumeShaping(cfg *drivers.TaskConfig, sh *shaping, h *taskHandle) {
+	if sh == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(d.ctx)
+	h.stateLock.Lock()
+	h.shaping = sh
+	h.shapingCancel = cancel
+	h.stateLock.Unlock()
+	go sampleShaping(ctx, cfg, sh)
+}
+
+// releaseShaping deletes the pipes of the task, once
+func (d *Driver) releaseShaping(h *taskHandle) {
+	h.stateLock.Lock()
+	sh, cancel := h.shaping, h.shapingCancel
+	h.shaping, h.shapingCancel = nil, nil
+	h.stateLock.Unlock()
+
+	if sh == nil {
+		return
+	}
+	if cancel != nil {
+		cancel()
+	}
+	if err := d.shaper.remove(sh); err != nil {
+		d.logger.Warn("failed to remove task network limits", "error", err)
+	}
+}
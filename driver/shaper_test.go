@@ -0,0 +1,86 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShapingCommands(t *testing.T) {
+	cases := []struct {
+		name string
+		sh   shaping
+		want []string
+	}{
+		{"addresses", shaping{Slot: 2, Addrs: []string{"10.0.0.5", "fd00::5"}, Limits: NetworkLimits{EgressKbps: 1000, IngressKbps: 5000, DelayMs: 20}}, []string{
+			"pipe 30004 config bw 1000Kbit/s delay 20",
+			"-q add 30002 pipe 30004 ip from 10.0.0.5 to any out",
+			"-q add 30002 pipe 30004 ip from fd00::5 to any out",
+			"pipe 30005 config bw 5000Kbit/s delay 20",
+			"-q add 30002 pipe 30005 ip from any to 10.0.0.5 in",
+			"-q add 30002 pipe 30005 ip from any to fd00::5 in",
+		}},
+		{"epair", shaping{Slot: 0, Interface: "epair3a", Limits: NetworkLimits{EgressKbps: 1000, IngressKbps: 5000}}, []string{
+			"pipe 30000 config bw 1000Kbit/s delay 0",
+			"-q add 30000 pipe 30000 ip from any to any in via epair3a",
+			"pipe 30001 config bw 5000Kbit/s delay 0",
+			"-q add 30000 pipe 30001 ip from any to any out via epair3a",
+		}},
+		{"egress only", shaping{Slot: 1, Addrs: []string{"10.0.0.5"}, Limits: NetworkLimits{EgressKbps: 1000}}, []string{
+			"pipe 30002 config bw 1000Kbit/s delay 0",
+			"-q add 30001 pipe 30002 ip from 10.0.0.5 to any out",
+		}},
+		{"delay only", shaping{Slot: 0, Interface: "epair0a", Limits: NetworkLimits{DelayMs: 50}}, []string{
+			"pipe 30000 config bw 0Kbit/s delay 50",
+			"-q add 30000 pipe 30000 ip from any to any in via epair0a",
+			"pipe 30001 config bw 0Kbit/s delay 50",
+			"-q add 30000 pipe 30001 ip from any to any out via epair0a",
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got []string
+			for _, args := range shapingCommands(&c.sh) {
+				got = append(got, strings.Join(args, " "))
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(c.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestShaperApplyNeedsATarget(t *testing.T) {
+	s := newShaper()
+	if _, err := s.apply(nil, "", NetworkLimits{EgressKbps: 1000}); err == nil {
+		t.Fatal("expected an error without addresses or epair")
+	}
+	if len(s.used) != 0 {
+		t.Fatal("no slot should be taken")
+	}
+}
+
+func TestParseShapingCounters(t *testing.T) {
+	sh := &shaping{Slot: 1, Addrs: []string{"10.0.0.5", "10.0.0.6"}}
+	out := `30001 12 3456 pipe 30002 ip from 10.0.0.5 to any out
+30001 3 100 pipe 30002 ip from 10.0.0.6 to any out
+30001 40 80000 pipe 30003 ip from any to 10.0.0.5 in
+30000 9 99999 pipe 30000 ip from 10.0.0.9 to any out
+30001 1 x pipe 30003 ip from any to 10.0.0.6 in
+65535 0 0 allow ip from any to any
+`
+	egress, ingress := parseShapingCounters(out, sh)
+	if egress != 3556 || ingress != 80000 {
+		t.Fatalf("got egress %d ingress %d, want 3556 80000", egress, ingress)
+	}
+	if egress, ingress := parseShapingCounters("", sh); egress != 0 || ingress != 0 {
+		t.Fatalf("got egress %d ingress %d without rules", egress, ingress)
+	}
+}
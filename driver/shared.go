@@ -0,0 +1,312 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// sharedChildrenMax is the children.max of the parent jail of an
+	// allocation, the tasks of a group it can hold
+	sharedChildrenMax = 32
+)
+
+// networkParams are the jail params moved from a task to the parent jail
+// of its allocation when it shares the network
+var networkParams = []string{
+	"ip4", "ip4.addr", "ip4.saddrsel",
+	"ip6", "ip6.addr", "ip6.saddrsel",
+	"vnet", "vnet.interface",
+}
+
+// sharedParentEnforceStatfs is the enforce_statfs of a parent jail until a
+// child asks for less, the children can't see more than their parent
+const sharedParentEnforceStatfs = "2"
+
+// sharedNetwork is the parent jail holding the network of an allocation
+// whose tasks set shared_network, with the resources created for it. A
+// copy is kept in the state of every member so it survives a restart of
+// the plugin.
+type sharedNetwork struct {
+	Name     string
+	Aliases  []string
+	Epair    string
+	Firewall string
+
+	// Permissions are the allow params and enforce_statfs of the parent,
+	// those its children were created with and nothing more
+	Permissions map[string]string
+
+	// members are the ids of the tasks running in the parent
+	members map[string]bool
+}
+
+// sharedJailName names the parent jail of an allocation
+func sharedJailName(allocID string) string {
+	return "alloc-" + allocID
+}
+
+// joinSharedNetwork makes the jail of the task a child of the parent jail
+// of its allocation, creating the parent with the network params of the
+// task when it isn't running. The network params of later tasks are left
+// out, the children inherit the network stack and addresses of the parent.
+func (d *Driver) joinSharedNetwork(cfg *drivers.TaskConfig, taskConfig TaskConfig, params map[string]string, lease *poolLease, h *taskHandle) error {
+	name := sharedJailName(cfg.AllocID)
+
+	d.sharedLock.Lock()
+	defer d.sharedLock.Unlock()
+
+	s := d.shared[name]
+	if s == nil || !IsJailActive(name) {
+		if s != nil {
+			// the parent died, like on a reboot of the node
+			s.release(d)
+		}
+		created, err := createSharedJail(name, taskConfig, params, lease)
+		if err != nil {
+			return fmt.Errorf("failed to create the network jail of the allocation: %s", err)
+		}
+		if s != nil {
+			created.members = s.members
+		}
+		s = created
+		d.shared[name] = s
+	}
+
+	// a child only gets the permissions its parent has, those the parent
+	// is missing are added for it
+	if missing := missingPermissions(s.Permissions, params); len(missing) > 0 {
+		args := []string{"-m", "name=" + name}
+		for k, v := range missing {
+			args = append(args, k+"="+v)
+		}
+		if out, err := exec.Command("jail", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to grant the network jail of the allocation the permissions of the task: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+		for k, v := range missing {
+			s.Permissions[k] = v
+		}
+	}
+	s.members[cfg.ID] = true
+
+	sharedChildParams(name, params)
+	h.shared = name
+	return nil
+}
+
+// sharedChildParams turns the params of a task into those of a child of the
+// parent jail name, inheriting its network
+func sharedChildParams(name string, params map[string]string) {
+	for _, k := range networkParams {
+		delete(params, k)
+	}
+	params["name"] = name + "." + params["name"]
+	params["ip4"] = "inherit"
+	params["ip6"] = "inherit"
+}
+
+// sharedParentParams are the params of the parent jail name created for
+// the task params: rooted at the root of the host, where the paths of the
+// children are, with the network and permissions of the task
+func sharedParentParams(name string, params map[string]string) map[string]string {
+	parent := map[string]string{
+		"name":           name,
+		"path":           "/",
+		"host.hostname":  params["host.hostname"],
+		"persist":        "true",
+		"children.max":   strconv.Itoa(sharedChildrenMax),
+		"enforce_statfs": sharedParentEnforceStatfs,
+	}
+	for k, v := range missingPermissions(map[string]string{"enforce_statfs": sharedParentEnforceStatfs}, params) {
+		parent[k] = v
+	}
+	for _, k := range networkParams {
+		if v, ok := params[k]; ok {
+			parent[k] = v
+		}
+	}
+	return parent
+}
+
+// parentPermissions are the params of parent limiting its children
+func parentPermissions(parent map[string]string) map[string]string {
+	perms := make(map[string]string)
+	for k, v := range parent {
+		if strings.HasPrefix(k, "allow.") || k == "enforce_statfs" {
+			perms[k] = v
+		}
+	}
+	return perms
+}
+
+// missingPermissions are the params a parent jail with perms needs for a
+// child with params: the allow params the child sets and the parent
+// doesn't, and a lower enforce_statfs
+func missingPermissions(perms, params map[string]string) map[string]string {
+	missing := make(map[string]string)
+	for k, v := range params {
+		switch {
+		case strings.HasPrefix(k, "allow.") && (v == "true" || v == "1"):
+			if p := perms[k]; p != "true" && p != "1" {
+				missing[k] = "true"
+			}
+		case k == "enforce_statfs":
+			child, err := strconv.Atoi(v)
+			if err != nil {
+				continue
+			}
+			if parent, err := strconv.Atoi(perms[k]); err == nil && child < parent {
+				missing[k] = strconv.Itoa(child)
+			}
+		}
+	}
+	return missing
+}
+
+// createSharedJail creates the persistent parent jail name, with the
+// network and permissions of the task params
+func createSharedJail(name string, taskConfig TaskConfig, params map[string]string, lease *poolLease) (*sharedNetwork, error) {
+	parent := sharedParentParams(name, params)
+	s := &sharedNetwork{Name: name, Permissions: parentPermissions(parent), members: make(map[string]bool)}
+	var err error
+	if s.Epair, err = setupVnet(parent, name, taskConfig.Network, lease); err != nil {
+		return nil, err
+	}
+	if s.Aliases, err = createAliases(parent); err != nil {
+		s.release(nil)
+		return nil, err
+	}
+	if taskConfig.Firewall.enabled() {
+		addrs, err := configuredAddresses(parent, taskConfig.Network, lease)
+		if err == nil {
+			s.Firewall, err = loadFirewall(name, taskConfig.Firewall, addrs)
+		}
+		if err != nil {
+			s.release(nil)
+			return nil, fmt.Errorf("failed to load the firewall: %s", err)
+		}
+	}
+
+	out, err := exec.Command("jail", append([]string{"-c"}, jailArgs(parent)...)...).CombinedOutput()
+	if err != nil {
+		s.release(nil)
+		return nil, fmt.Errorf("jail -c %s failed: %s: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return s, nil
+}
+
+// leaveSharedNetwork drops the task from the parent jail of its
+// allocation, destroying the parent with its network after the last task
+func (d *Driver) leaveSharedNetwork(h *taskHandle) {
+	if len(h.shared) == 0 {
+		return
+	}
+	d.sharedLock.Lock()
+	defer d.sharedLock.Unlock()
+
+	s := d.shared[h.shared]
+	h.shared = ""
+	if s == nil {
+		return
+	}
+	delete(s.members, h.taskConfig.ID)
+	if len(s.members) > 0 {
+		return
+	}
+	delete(d.shared, s.Name)
+
+	if IsJailActive(s.Name) {
+		if out, err := exec.Command("jail", "-r", s.Name).CombinedOutput(); err != nil {
+			d.logger.Warn("failed to remove the network jail", "jail", s.Name, "error", err, "output", string(out))
+		}
+	}
+	s.release(d)
+	if d.ipam != nil {
+		if err := d.ipam.release(s.Name); err != nil {
+			d.logger.Warn("failed to release the network jail addresses", "jail", s.Name, "error", err)
+		}
+	}
+}
+
+// recoverSharedNetwork registers a recovered task as member of the parent
+// jail recorded in its state
+func (d *Driver) recoverSharedNetwork(taskID string, state *sharedNetwork) string {
+	if state == nil {
+		return ""
+	}
+	d.sharedLock.Lock()
+	defer d.sharedLock.Unlock()
+	s, ok := d.shared[state.Name]
+	if !ok {
+		s = &sharedNetwork{Name: state.Name, Aliases: state.Aliases, Epair: state.Epair, Firewall: state.Firewall}
+		s.Permissions = make(map[string]string)
+		for k, v := range state.Permissions {
+			s.Permissions[k] = v
+		}
+		s.members = make(map[string]bool)
+		d.shared[s.Name] = s
+	}
+	s.members[taskID] = true
+	return s.Name
+}
+
+// sharedState returns a copy of the parent jail of a task for its state
+func (d *Driver) sharedState(name string) *sharedNetwork {
+	if len(name) == 0 {
+		return nil
+	}
+	d.sharedLock.Lock()
+	defer d.sharedLock.Unlock()
+	s, ok := d.shared[name]
+	if !ok {
+		return nil
+	}
+	perms := make(map[string]string)
+	for k, v := range s.Permissions {
+		perms[k] = v
+	}
+	return &sharedNetwork{Name: s.Name, Aliases: s.Aliases, Epair: s.Epair, Firewall: s.Firewall, Permissions: perms}
+}
+
+// hasSharedNetwork tells whether name is a parent jail the driver knows,
+// its addresses are leased in its name
+func (d *Driver) hasSharedNetwork(name string) bool {
+	d.sharedLock.Lock()
+	defer d.sharedLock.Unlock()
+	_, ok := d.shared[name]
+	return ok
+}
+
+// release removes the aliases, epair and firewall of the parent jail. d
+// is only used for logging and may be nil.
+func (s *sharedNetwork) release(d *Driver) {
+	var errs []error
+	if err := removeAliases(s.Aliases); err != nil {
+		errs = append(errs, err)
+	}
+	if err := teardownVnet(s.Epair); err != nil {
+		errs = append(errs, err)
+	}
+	if len(s.Firewall) > 0 {
+		if err := pfctl(s.Firewall, nil, "-F", "all"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.Aliases, s.Epair, s.Firewall = nil, "", ""
+	if d != nil {
+		for _, err := range errs {
+			d.logger.Warn("failed to release the network jail", "jail", s.Name, "error", err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"reflect"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestSharedParentParams(t *testing.T) {
+	params := map[string]string{
+		"name":              "web",
+		"path":              "/var/jails/web",
+		"host.hostname":     "web",
+		"vnet":              "new",
+		"vnet.interface":    "epair0b",
+		"allow.raw_sockets": "true",
+		"allow.mount":       "true",
+		"allow.sysvipc":     "false",
+		"enforce_statfs":    "1",
+	}
+	got := sharedParentParams("alloc", params)
+	want := map[string]string{
+		"name":              "alloc",
+		"path":              "/",
+		"host.hostname":     "web",
+		"persist":           "true",
+		"children.max":      "32",
+		"enforce_statfs":    "1",
+		"vnet":              "new",
+		"vnet.interface":    "epair0b",
+		"allow.raw_sockets": "true",
+		"allow.mount":       "true",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("sharedParentParams() = %v, want %v", got, want)
+	}
+
+	// a task asking for nothing gets a parent without permissions
+	got = sharedParentParams("alloc", map[string]string{"name": "web", "ip4.addr": "192.0.2.10"})
+	want = map[string]string{
+		"name":           "alloc",
+		"path":           "/",
+		"host.hostname":  "",
+		"persist":        "true",
+		"children.max":   "32",
+		"enforce_statfs": "2",
+		"ip4.addr":       "192.0.2.10",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("sharedParentParams() = %v, want %v", got, want)
+	}
+	if perms := parentPermissions(got); !reflect.DeepEqual(perms, map[string]string{"enforce_statfs": "2"}) {
+		t.Errorf("parentPermissions() = %v", perms)
+	}
+}
+
+func TestMissingPermissions(t *testing.T) {
+	cases := []struct {
+		name   string
+		perms  map[string]string
+		params map[string]string
+		want   map[string]string
+	}{
+		{
+			name:   "nothing asked",
+			perms:  map[string]string{"enforce_statfs": "2"},
+			params: map[string]string{"name": "web", "allow.chflags": "false"},
+			want:   map[string]string{},
+		},
+		{
+			name:   "granted already",
+			perms:  map[string]string{"enforce_statfs": "1", "allow.mount": "true"},
+			params: map[string]string{"allow.mount": "true", "enforce_statfs": "2"},
+			want:   map[string]string{},
+		},
+		{
+			name:   "new allows",
+			perms:  map[string]string{"enforce_statfs": "2", "allow.mount": "true"},
+			params: map[string]string{"allow.mount": "true", "allow.mount_tmpfs": "true", "allow.vmm": "1"},
+			want:   map[string]string{"allow.mount_tmpfs": "true", "allow.vmm": "true"},
+		},
+		{
+			name:   "lower enforce_statfs",
+			perms:  map[string]string{"enforce_statfs": "2"},
+			params: map[string]string{"enforce_statfs": "0"},
+			want:   map[string]string{"enforce_statfs": "0"},
+		},
+		{
+			name:   "invalid enforce_statfs",
+			perms:  map[string]string{"enforce_statfs": "2"},
+			params: map[string]string{"enforce_statfs": "none"},
+			want:   map[string]string{},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := missingPermissions(c.perms, c.params); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("missingPermissions() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSharedChildParams(t *testing.T) {
+	params := map[string]string{
+		"name":           "web",
+		"path":           "/var/jails/web",
+		"ip4.addr":       "192.0.2.10",
+		"ip6.addr":       "2001:db8::10",
+		"ip4.saddrsel":   "true",
+		"vnet":           "new",
+		"vnet.interface": "epair0b",
+		"allow.mount":    "true",
+	}
+	sharedChildParams("alloc", params)
+	want := map[string]string{
+		"name":        "alloc.web",
+		"path":        "/var/jails/web",
+		"ip4":         "inherit",
+		"ip6":         "inherit",
+		"allow.mount": "true",
+	}
+	if !reflect.DeepEqual(params, want) {
+		t.Fatalf("sharedChildParams() = %v, want %v", params, want)
+	}
+}
+
+func TestSharedNetworkMembers(t *testing.T) {
+	d := &Driver{shared: make(map[string]*sharedNetwork), logger: hclog.NewNullLogger()}
+	state := &sharedNetwork{Name: "alloc", Permissions: map[string]string{"enforce_statfs": "2", "allow.mount": "true"}}
+
+	if name := d.recoverSharedNetwork("task1", state); name != "alloc" {
+		t.Fatalf("recoverSharedNetwork() = %s", name)
+	}
+	if name := d.recoverSharedNetwork("task2", state); name != "alloc" {
+		t.Fatalf("recoverSharedNetwork() = %s", name)
+	}
+	if name := d.recoverSharedNetwork("task3", nil); name != "" {
+		t.Fatalf("a task without a shared network got %s", name)
+	}
+	if s := d.shared["alloc"]; len(s.members) != 2 || !s.members["task1"] || !s.members["task2"] {
+		t.Fatalf("members %v", s.members)
+	}
+
+	// the state saved is a copy of the parent, permissions included
+	saved := d.sharedState("alloc")
+	if saved == nil || !reflect.DeepEqual(saved.Permissions, state.Permissions) {
+		t.Fatalf("sharedState() = %+v", saved)
+	}
+	saved.Permissions["allow.vmm"] = "true"
+	if _, ok := d.shared["alloc"].Permissions["allow.vmm"]; ok {
+		t.Error("the saved state shares the permissions of the parent")
+	}
+	if d.sharedState("") != nil {
+		t.Error("a task without a shared network has no state")
+	}
+
+	task := func(id string) *taskHandle {
+		return &taskHandle{taskConfig: &drivers.TaskConfig{ID: id}, shared: "alloc"}
+	}
+	h := task("task1")
+	d.leaveSharedNetwork(h)
+	if h.shared != "" {
+		t.Error("the task still refers to the parent")
+	}
+	if !d.hasSharedNetwork("alloc") {
+		t.Fatal("the parent was released with a task still in it")
+	}
+	d.leaveSharedNetwork(task("task2"))
+	if d.hasSharedNetwork("alloc") {
+		t.Fatal("the parent outlived its last task")
+	}
+}
@@ -0,0 +1,142 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// storageBackend materializes images whose blobs are in the image store and
+// creates the writable rootfs of tasks from them.
+type storageBackend interface {
+	// Unpack applies the layers of img in order, returning the disk space
+	// used by the unpacked image.
+	Unpack(img *imageRecord) (int64, error)
+
+	// CreateRootfs creates a writable rootfs from img for the jail name.
+	// dest is the preferred location, the path actually used is returned.
+	CreateRootfs(img *imageRecord, name, dest string) (string, error)
+
+	// BasePath is the read only, unpacked image that thin and union rootfs
+	// are mounted from
+	BasePath(img *imageRecord) (string, error)
+
+	// SnapshotRootfs returns a read only, point in time view of the rootfs
+	// of the jail name and a func discarding it. An empty path means the
+	// backend has no snapshots and the live rootfs must be read instead.
+	SnapshotRootfs(name string) (string, func(), error)
+
+	// DestroyRootfs removes the rootfs created for the jail name
+	DestroyRootfs(name string) error
+
+	// Remove deletes the unpacked image
+	Remove(img *imageRecord) error
+}
+
+// dirBackend keeps every image unpacked in a plain directory of the store
+// and copies it to create task rootfs.
+type dirBackend struct {
+	store *imageStore
+}
+
+func (b *dirBackend) Unpack(img *imageRecord) (int64, error) {
+	staging := filepath.Join(b.store.imageDir(img.ID), "rootfs.partial")
+	if err := os.RemoveAll(staging); err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return 0, err
+	}
+
+	for _, layer := range img.Layers {
+		if err := b.store.extractBlob(layer, staging); err != nil {
+			return 0, err
+		}
+	}
+
+	size, err := dirSize(staging)
+	if err != nil {
+		return 0, err
+	}
+	return size, os.Rename(staging, b.store.rootfsPath(img.ID))
+}
+
+// CreateRootfs copies the image into dest. What an earlier start of the task
+// left there was written by its jail and is removed first, so the copy only
+// ever creates fresh entries; those nomad put in the task directory are kept.
+func (b *dirBackend) CreateRootfs(img *imageRecord, name, dest string) (string, error) {
+	src := b.store.rootfsPath(img.ID)
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dest, e.Name())); err != nil {
+			return "", err
+		}
+	}
+	if err := copyTree(src, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+func (b *dirBackend) BasePath(img *imageRecord) (string, error) {
+	return b.store.rootfsPath(img.ID), nil
+}
+
+func (b *dirBackend) SnapshotRootfs(name string) (string, func(), error) {
+	return "", func() {}, nil
+}
+
+// DestroyRootfs removes the rootfs created in the Path of the task. Those
+// in the task directory are left to nomad.
+func (b *dirBackend) DestroyRootfs(name string) error {
+	c, err := b.store.container(name)
+	if err != nil || !c.Owned || len(c.Rootfs) == 0 || filepath.Clean(c.Rootfs) == "/" {
+		return nil
+	}
+	return os.RemoveAll(c.Rootfs)
+}
+
+func (b *dirBackend) Remove(img *imageRecord) error {
+	return os.RemoveAll(b.store.rootfsPath(img.ID))
+}
+
+// extractBlob applies the layer blob on top of root
+func (s *imageStore) extractBlob(layer digest.Digest, root string) error {
+	f, err := os.Open(s.blobPath(layer))
+	if err != nil {
+		return fmt.Errorf("layer %s missing from store: %s", layer, err)
+	}
+	defer f.Close()
+
+	if err := extractLayer(f, root); err != nil {
+		return fmt.Errorf("failed extracting layer %s: %s", layer, err)
+	}
+	return nil
+}
+
+// datasetName makes name usable as a ZFS dataset name component
+func datasetName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.', r == ':':
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,490 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// imageRecord describes an image unpacked in the local image store
+type imageRecord struct {
+	ID       string          `json:"id"`
+	Manifest digest.Digest   `json:"manifest"`
+	Config   digest.Digest   `json:"config"`
+	Layers   []digest.Digest `json:"layers"`
+	Created  time.Time       `json:"created"`
+
+	// Size is the disk usage of the unpacked rootfs and the image blobs
+	Size int64 `json:"size"`
+
+	// LastUsed is updated whenever a task starts or stops using the image
+	LastUsed time.Time `json:"last_used"`
+}
+
+// pullCall is an in-flight store operation that concurrent callers wait on.
+// It runs until it completes or every caller waiting on it has gone away.
+type pullCall struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	img    *imageRecord
+	err    error
+
+	// waiters counts the callers still waiting, watchers receive the
+	// progress of the call on behalf of them
+	waiters  int
+	watchers map[int]func(pullProgress)
+	nextID   int
+}
+
+// imageStore is a content addressed store of image blobs plus the unpacked
+// rootfs of every image, laid out as:
+//
+//	<root>/blobs/sha256/<hex>        manifests, configs and layers
+//	<root>/images/<id>/image.json    the imageRecord
+//	<root>/images/<id>/rootfs        the unpacked image, with the dir backend
+//	<root>/repositories.json         image references to image ids
+//	<root>/containers/<name>.json    the image and rootfs of every jail
+type imageStore struct {
+	root    string
+	logger  hclog.Logger
+	backend storageBackend
+
+	// lock syncs access to repositories.json, image records, calls and
+	// users
+	lock  sync.Mutex
+	calls map[string]*pullCall
+
+	// users maps image ids to the tasks using them
+	users map[string]map[string]bool
+}
+
+func newImageStore(root string, logger hclog.Logger) (*imageStore, error) {
+	for _, dir := range []string{"blobs/sha256", "images", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create image store %s: %s", root, err)
+		}
+	}
+	s := &imageStore{
+		root:   root,
+		logger: logger.Named("images"),
+		calls:  make(map[string]*pullCall),
+		users:  make(map[string]map[string]bool),
+	}
+	s.backend = &dirBackend{store: s}
+	return s, nil
+}
+
+// coalesce runs fn once for concurrent callers using the same key, so pulls
+// and unpacks of the same image on a node only happen once. Each caller stops
+// waiting when its ctx is done, and fn is canceled once no caller is left.
+// Progress reported by fn is forwarded to the report func of every caller.
+func (s *imageStore) coalesce(ctx context.Context, key string, report func(pullProgress),
+	fn func(context.Context, func(pullProgress)) (*imageRecord, error)) (*imageRecord, error) {
+	s.lock.Lock()
+	c, ok := s.calls[key]
+	if !ok {
+		callCtx, cancel := context.WithCancel(context.Background())
+		c = &pullCall{
+			done:     make(chan struct{}),
+			cancel:   cancel,
+			watchers: make(map[int]func(pullProgress)),
+		}
+		s.calls[key] = c
+		go func() {
+			img, err := fn(callCtx, func(p pullProgress) { s.broadcast(c, p) })
+			cancel()
+			s.lock.Lock()
+			c.img, c.err = img, err
+			if s.calls[key] == c {
+				delete(s.calls, key)
+			}
+			s.lock.Unlock()
+			close(c.done)
+		}()
+	}
+	id := c.nextID
+	c.nextID++
+	c.waiters++
+	if report != nil {
+		c.watchers[id] = report
+	}
+	s.lock.Unlock()
+
+	select {
+	case <-c.done:
+		return c.img, c.err
+	case <-ctx.Done():
+		s.lock.Lock()
+		delete(c.watchers, id)
+		c.waiters--
+		if c.waiters == 0 {
+			c.cancel()
+			// later callers start over instead of joining a canceled call
+			if s.calls[key] == c {
+				delete(s.calls, key)
+			}
+		}
+		s.lock.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *imageStore) broadcast(c *pullCall, p pullProgress) {
+	s.lock.Lock()
+	var watchers []func(pullProgress)
+	for _, w := range c.watchers {
+		watchers = append(watchers, w)
+	}
+	s.lock.Unlock()
+	for _, w := range watchers {
+		w(p)
+	}
+}
+
+func (s *imageStore) blobPath(d digest.Digest) string {
+	return filepath.Join(s.root, "blobs", d.Algorithm().String(), d.Hex())
+}
+
+func (s *imageStore) hasBlob(d digest.Digest) bool {
+	_, err := os.Stat(s.blobPath(d))
+	return err == nil
+}
+
+func (s *imageStore) readBlob(d digest.Digest) ([]byte, error) {
+	return ioutil.ReadFile(s.blobPath(d))
+}
+
+// putBlob copies r into the store. If expected is set the content must match
+// it, otherwise the digest is computed from the content.
+func (s *imageStore) putBlob(r io.Reader, expected digest.Digest) (digest.Digest, int64, error) {
+	if expected != "" {
+		if err := expected.Validate(); err != nil {
+			return "", 0, err
+		}
+		if s.hasBlob(expected) {
+			n, err := io.Copy(ioutil.Discard, r)
+			return expected, n, err
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(s.root, "tmp"), "blob-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	digester := digest.Canonical.Digester()
+	n, err := io.Copy(io.MultiWriter(tmp, digester.Hash()), r)
+	tmp.Close()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed writing blob: %s", err)
+	}
+
+	got := digester.Digest()
+	if expected != "" && got != expected {
+		return "", 0, fmt.Errorf("digest mismatch: expected %s got %s", expected, got)
+	}
+	if err := os.Rename(tmp.Name(), s.blobPath(got)); err != nil {
+		return "", 0, err
+	}
+	return got, n, nil
+}
+
+// imageManifest is an image manifest written by the driver. The vendored
+// ocispec.Manifest lacks mediaType, which registries require of docker
+// manifests and compare with the Content-Type of OCI ones.
+type imageManifest struct {
+	MediaType string `json:"mediaType"`
+	ocispec.Manifest
+}
+
+// putManifest stores manifest as a blob of type mediaType
+func (s *imageStore) putManifest(mediaType string, manifest ocispec.Manifest) (digest.Digest, error) {
+	body, err := json.Marshal(imageManifest{MediaType: mediaType, Manifest: manifest})
+	if err != nil {
+		return "", err
+	}
+	d, _, err := s.putBlob(bytes.NewReader(body), "")
+	if err != nil {
+		return "", fmt.Errorf("failed storing manifest: %s", err)
+	}
+	return d, nil
+}
+
+func (s *imageStore) imageDir(id string) string {
+	return filepath.Join(s.root, "images", id)
+}
+
+// rootfsPath is the unpacked, read only copy of an image
+func (s *imageStore) rootfsPath(id string) string {
+	return filepath.Join(s.imageDir(id), "rootfs")
+}
+
+func (s *imageStore) image(id string) (*imageRecord, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(s.imageDir(id), "image.json"))
+	if err != nil {
+		return nil, err
+	}
+	var img imageRecord
+	if err := json.Unmarshal(buf, &img); err != nil {
+		return nil, fmt.Errorf("corrupt image record %s: %s", id, err)
+	}
+	return &img, nil
+}
+
+func (s *imageStore) writeImage(img *imageRecord) error {
+	buf, err := json.Marshal(img)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.imageDir(img.ID), "image.json"), buf, 0600)
+}
+
+func (s *imageStore) repositories() (map[string]string, error) {
+	repos := make(map[string]string)
+	buf, err := ioutil.ReadFile(filepath.Join(s.root, "repositories.json"))
+	if os.IsNotExist(err) {
+		return repos, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &repos); err != nil {
+		return nil, fmt.Errorf("corrupt repositories.json: %s", err)
+	}
+	return repos, nil
+}
+
+// tag points ref at the image id
+func (s *imageStore) tag(ref, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	unlock, err := s.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	repos, err := s.repositories()
+	if err != nil {
+		return err
+	}
+	repos[ref] = id
+	return s.writeRepositories(repos)
+}
+
+func (s *imageStore) writeRepositories(repos map[string]string) error {
+	buf, err := json.Marshal(repos)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.root, "repositories.json"), buf, 0600)
+}
+
+// resolve returns the image currently tagged as ref
+func (s *imageStore) resolve(ref string) (*imageRecord, error) {
+	s.lock.Lock()
+	repos, err := s.repositories()
+	s.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	id, ok := repos[ref]
+	if !ok {
+		return nil, fmt.Errorf("image %s not found in store", ref)
+	}
+	return s.image(id)
+}
+
+// createImage unpacks the layers of an image, which must already be in the
+// blob store, and records it. Images already unpacked are reused.
+func (s *imageStore) createImage(manifest, config digest.Digest, layers []digest.Digest) (*imageRecord, error) {
+	id := config.Hex()
+	return s.coalesce(context.Background(), "unpack:"+id, nil, func(context.Context, func(pullProgress)) (*imageRecord, error) {
+		if img, err := s.image(id); err == nil {
+			return img, nil
+		}
+
+		img := &imageRecord{
+			ID:       id,
+			Manifest: manifest,
+			Config:   config,
+			Layers:   layers,
+		}
+		if err := os.MkdirAll(s.imageDir(id), 0700); err != nil {
+			return nil, err
+		}
+		size, err := s.backend.Unpack(img)
+		if err != nil {
+			return nil, err
+		}
+		size += s.blobsSize(img)
+
+		img.Created = time.Now()
+		img.LastUsed = img.Created
+		img.Size = size
+		s.lock.Lock()
+		err = s.writeImage(img)
+		s.lock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		s.logger.Info("unpacked image", "image", id, "layers", len(layers))
+		return img, nil
+	})
+}
+
+// acquire marks the image as used by a task, protecting it from garbage
+// collection until it is released.
+func (s *imageStore) acquire(id, taskID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	img, err := s.image(id)
+	if err != nil {
+		return fmt.Errorf("image %s is no longer in the store: %s", id, err)
+	}
+	if s.users[id] == nil {
+		s.users[id] = make(map[string]bool)
+	}
+	s.users[id][taskID] = true
+
+	img.LastUsed = time.Now()
+	return s.writeImage(img)
+}
+
+// release drops the reference a task holds on the image
+func (s *imageStore) release(id, taskID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.users[id], taskID)
+	if len(s.users[id]) == 0 {
+		delete(s.users, id)
+	}
+
+	img, err := s.image(id)
+	if err != nil {
+		return err
+	}
+	img.LastUsed = time.Now()
+	return s.writeImage(img)
+}
+
+// images lists every image record in the store
+func (s *imageStore) images() ([]*imageRecord, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.root, "images"))
+	if err != nil {
+		return nil, err
+	}
+	var imgs []*imageRecord
+	for _, e := range entries {
+		img, err := s.image(e.Name())
+		if err != nil {
+			// partially unpacked or corrupt
+			continue
+		}
+		imgs = append(imgs, img)
+	}
+	return imgs, nil
+}
+
+// createRootfs makes a writable rootfs for the jail name from the image,
+// returning its path. dest is used when the storage backend allows it.
+func (s *imageStore) createRootfs(img *imageRecord, name, dest string) (string, error) {
+	path, err := s.backend.CreateRootfs(img, name, dest)
+	if err != nil {
+		return "", fmt.Errorf("failed to create rootfs for %s from image %s: %s", name, img.ID, err)
+	}
+	return path, nil
+}
+
+// destroyRootfs removes the rootfs created for the jail name
+func (s *imageStore) destroyRootfs(name string) error {
+	return s.backend.DestroyRootfs(name)
+}
+
+// blobsSize is the disk space used by the blobs of img
+func (s *imageStore) blobsSize(img *imageRecord) int64 {
+	var size int64
+	for _, blob := range imageBlobs(img) {
+		if fi, err := os.Stat(s.blobPath(blob)); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// dirSize sums the size of every file below dir
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// lockFile takes the lock of the store shared with the other processes using
+// it, like the build command next to the agent, and returns its release.
+// Callers hold s.lock.
+func (s *imageStore) lockFile() (func(), error) {
+	f, err := os.OpenFile(filepath.Join(s.root, "store.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock image store %s: %s", s.root, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// writeFileAtomic replaces path with data through a rename of a temporary
+// file of its own, so concurrent writers never mix their contents
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
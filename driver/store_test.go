@@ -0,0 +1,144 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func testStore(t *testing.T) *imageStore {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := newImageStore(dir, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestPullImageUsesStore(t *testing.T) {
+	s := testStore(t)
+	img := &imageRecord{ID: "0123abcd"}
+	if err := os.MkdirAll(s.imageDir(img.ID), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeImage(img); err != nil {
+		t.Fatal(err)
+	}
+	ref := parseImageRef("alpine:3.9")
+	if err := s.tag(ref.String(), img.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a registry client, any request to the registry would panic
+	d := &Driver{images: s, logger: hclog.NewNullLogger()}
+	got, err := d.pullImage(context.Background(), &drivers.TaskConfig{}, ref, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != img.ID {
+		t.Fatalf("got image %s, want %s", got.ID, img.ID)
+	}
+}
+
+func TestDirBackendDestroyRootfs(t *testing.T) {
+	s := testStore(t)
+	parent, err := ioutil.TempDir("", "path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	owned := filepath.Join(parent, "owned")
+	kept := filepath.Join(parent, "kept")
+	for _, dir := range []string{owned, kept} {
+		if err := os.MkdirAll(filepath.Join(dir, "etc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.writeContainer("web-1", containerRecord{Image: "x", Rootfs: owned, Owned: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeContainer("web-2", containerRecord{Image: "x", Rootfs: kept}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.ownsRootfs("web-1", owned+"/") {
+		t.Error("web-1 should own its rootfs")
+	}
+	if s.ownsRootfs("web-2", kept) || s.ownsRootfs("web-1", kept) || s.ownsRootfs("web-3", owned) {
+		t.Error("only web-1 owns a rootfs")
+	}
+
+	for _, name := range []string{"web-1", "web-2", "web-3"} {
+		if err := s.destroyRootfs(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(owned); !os.IsNotExist(err) {
+		t.Error("owned rootfs should be removed")
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Error("rootfs in the task directory should be left to nomad")
+	}
+}
+
+func TestTagAcrossStores(t *testing.T) {
+	s := testStore(t)
+	// another process using the same store, like the build command
+	other, err := newImageStore(s.root, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store := s
+			if i%2 == 1 {
+				store = other
+			}
+			if err := store.tag(fmt.Sprintf("app:%d", i), "0123abcd"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	repos, err := s.repositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 20 {
+		t.Fatalf("tags were lost, got %v", repos)
+	}
+	entries, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != ".json" && e.Name() != "store.lock" && !e.IsDir() {
+			t.Errorf("temporary file %s left in the store", e.Name())
+		}
+	}
+}
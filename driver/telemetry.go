@@ -0,0 +1,73 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"fmt"
+	"net"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// TelemetryConfig is the telemetry block of the plugin config. The plugin
+// runs in its own process, its metrics don't go through the telemetry of
+// the agent and only leave it through the sinks set here, usually the same
+// as those of the agent.
+type TelemetryConfig struct {
+	StatsdAddress   string `codec:"statsd_address"`
+	StatsiteAddress string `codec:"statsite_address"`
+	DisableHostname bool   `codec:"disable_hostname"`
+}
+
+// sink is where the metrics of c are sent, nil when c sets no address
+func (c TelemetryConfig) sink() (metrics.MetricSink, error) {
+	var sinks metrics.FanoutSink
+	if len(c.StatsdAddress) > 0 {
+		if _, _, err := net.SplitHostPort(c.StatsdAddress); err != nil {
+			return nil, fmt.Errorf("invalid telemetry statsd_address %q: %s", c.StatsdAddress, err)
+		}
+		sink, err := metrics.NewStatsdSink(c.StatsdAddress)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(c.StatsiteAddress) > 0 {
+		if _, _, err := net.SplitHostPort(c.StatsiteAddress); err != nil {
+			return nil, fmt.Errorf("invalid telemetry statsite_address %q: %s", c.StatsiteAddress, err)
+		}
+		sink, err := metrics.NewStatsiteSink(c.StatsiteAddress)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return sinks, nil
+}
+
+// metricsConfig names the metrics of the plugin like the agent does, they
+// already carry the jail_task_driver prefix
+func (c TelemetryConfig) metricsConfig() *metrics.Config {
+	conf := metrics.DefaultConfig("")
+	conf.EnableHostname = !c.DisableHostname
+	conf.EnableRuntimeMetrics = false
+	return conf
+}
+
+// setupTelemetry sends the metrics of the plugin to the sinks of c. Without
+// any they go nowhere, like before.
+func setupTelemetry(c TelemetryConfig) (*metrics.Metrics, error) {
+	sink, err := c.sink()
+	if err != nil || sink == nil {
+		return nil, err
+	}
+	return metrics.NewGlobal(c.metricsConfig(), sink)
+}
@@ -0,0 +1,63 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"testing"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+func TestTelemetrySink(t *testing.T) {
+	cases := []struct {
+		name  string
+		c     TelemetryConfig
+		sinks int
+		err   bool
+	}{
+		{"none", TelemetryConfig{}, 0, false},
+		{"statsd", TelemetryConfig{StatsdAddress: "127.0.0.1:8125"}, 1, false},
+		{"both", TelemetryConfig{StatsdAddress: "127.0.0.1:8125", StatsiteAddress: "127.0.0.1:8125"}, 2, false},
+		{"no port", TelemetryConfig{StatsdAddress: "127.0.0.1"}, 0, true},
+	}
+	for _, c := range cases {
+		sink, err := c.c.sink()
+		if (err != nil) != c.err {
+			t.Errorf("%s: got error %v", c.name, err)
+			continue
+		}
+		switch {
+		case c.sinks == 0 && sink != nil:
+			t.Errorf("%s: got a sink", c.name)
+		case c.sinks > 0 && (sink == nil || len(sink.(metrics.FanoutSink)) != c.sinks):
+			t.Errorf("%s: got %v", c.name, sink)
+		}
+	}
+}
+
+func TestTelemetryNames(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	m, err := metrics.New(TelemetryConfig{DisableHostname: true}.metricsConfig(), sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetGaugeWithLabels([]string{"jail_task_driver", "network", "egress_kbps"}, 42, []metrics.Label{{Name: "task", Value: "web"}})
+	m.IncrCounter([]string{"jail_task_driver", "image_gc", "reclaimed_bytes"}, 1024)
+
+	data := sink.Data()
+	if len(data) != 1 {
+		t.Fatalf("got %d intervals", len(data))
+	}
+	if g, ok := data[0].Gauges["jail_task_driver.network.egress_kbps;task=web"]; !ok || g.Value != 42 {
+		t.Errorf("gauges %v", data[0].Gauges)
+	}
+	if c, ok := data[0].Counters["jail_task_driver.image_gc.reclaimed_bytes"]; !ok || c.Sum != 1024 {
+		t.Errorf("counters %v", data[0].Counters)
+	}
+}
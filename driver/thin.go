@@ -0,0 +1,122 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// rootfsCopy gives every task its own copy, or clone, of the image
+	rootfsCopy = "copy"
+
+	// rootfsThin nullfs mounts the system directories of the image read
+	// only and copies the rest
+	rootfsThin = "thin"
+
+	// rootfsUnion mounts the image below the task directory with unionfs
+	rootfsUnion = "union"
+)
+
+// sharedDirs are the top level directories of a thin rootfs mounted read
+// only from the image. Everything else, like /etc, /var, /tmp and /home, is
+// copied for the task.
+var sharedDirs = map[string]bool{
+	"bin":     true,
+	"boot":    true,
+	"lib":     true,
+	"lib32":   true,
+	"lib64":   true,
+	"libexec": true,
+	"rescue":  true,
+	"sbin":    true,
+	"usr":     true,
+}
+
+// writableDirs are copied as directories even when the image links them
+// into a shared directory, like /home pointing at /usr/home.
+var writableDirs = []string{"home"}
+
+// createSharedRootfs builds the rootfs of the jail in dest on top of the
+// unpacked image, mounting it according to mode. It returns the mounted
+// paths in mount order.
+func (s *imageStore) createSharedRootfs(img *imageRecord, mode, dest string) ([]string, error) {
+	base, err := s.backend.BasePath(img)
+	if err != nil {
+		return nil, fmt.Errorf("image %s cannot be shared: %s", img.ID, err)
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return nil, err
+	}
+
+	mounts, err := prepareSharedRootfs(base, mode, dest)
+	if err != nil {
+		return nil, err
+	}
+	return mountAll(dest, mounts, "")
+}
+
+// prepareSharedRootfs creates what the task gets of its own in dest and
+// returns the mounts sharing the rest of base
+func prepareSharedRootfs(base, mode, dest string) ([]jailMount, error) {
+	switch mode {
+	case rootfsThin:
+		return prepareThinRootfs(base, dest)
+	case rootfsUnion:
+		// the task directory becomes the writable upper layer
+		return []jailMount{{FSType: "unionfs", Source: base, Target: "/", Options: "below,noatime"}}, nil
+	}
+	return nil, fmt.Errorf("unknown rootfs_mode %q", mode)
+}
+
+// prepareThinRootfs copies the directories of base the task writes to into
+// dest. What an earlier start of the task left there was written by its jail
+// and is removed first, so the copies are always fresh.
+func prepareThinRootfs(base, dest string) ([]jailMount, error) {
+	entries, err := ioutil.ReadDir(base)
+	if err != nil {
+		return nil, err
+	}
+
+	var mounts []jailMount
+	for _, e := range entries {
+		name := e.Name()
+		if sharedDirs[name] && e.IsDir() {
+			mounts = append(mounts, jailMount{FSType: "nullfs", Source: filepath.Join(base, name), Target: "/" + name, Options: "ro"})
+			continue
+		}
+		target := filepath.Join(dest, name)
+		if err := os.RemoveAll(target); err != nil {
+			return nil, err
+		}
+		if err := copyTree(filepath.Join(base, name), target); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range writableDirs {
+		link := filepath.Join(dest, name)
+		if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		src, err := secureDir(base, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Remove(link); err != nil {
+			return nil, err
+		}
+		if err := copyTree(src, link); err != nil {
+			return nil, err
+		}
+	}
+	return mounts, nil
+}
@@ -0,0 +1,115 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPrepareSharedRootfs(t *testing.T) {
+	cases := []struct {
+		name string
+		mode string
+		// leftovers of an earlier start of the task
+		left   func(dest, outside string) error
+		mounts []string
+		tree   map[string]string
+		err    bool
+	}{
+		{
+			name:   "thin",
+			mode:   rootfsThin,
+			mounts: []string{"nullfs /bin ro", "nullfs /usr ro"},
+			tree: map[string]string{
+				"etc": "/", "etc/rc.conf": "rc", "lib": "lib",
+				"home": "/", "home/profile": "profile",
+			},
+		},
+		{
+			name: "thin again",
+			mode: rootfsThin,
+			left: func(dest, outside string) error {
+				if err := os.MkdirAll(dest, 0755); err != nil {
+					return err
+				}
+				if err := os.Symlink(outside, filepath.Join(dest, "etc")); err != nil {
+					return err
+				}
+				return os.Symlink(filepath.Join(outside, "secret"), filepath.Join(dest, "lib"))
+			},
+			mounts: []string{"nullfs /bin ro", "nullfs /usr ro"},
+			tree: map[string]string{
+				"etc": "/", "etc/rc.conf": "rc", "lib": "lib",
+				"home": "/", "home/profile": "profile",
+			},
+		},
+		{
+			name:   "union",
+			mode:   rootfsUnion,
+			mounts: []string{"unionfs / below,noatime"},
+			tree:   map[string]string{},
+		},
+		{
+			name: "unknown",
+			mode: "overlay",
+			err:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dest, outside := testRoot(t)
+			base := filepath.Join(filepath.Dir(dest), "base")
+			image := testLayer(t,
+				dir("bin"), file("bin/sh", "sh"),
+				dir("usr"), dir("usr/home"), file("usr/home/profile", "profile"),
+				dir("etc"), file("etc/rc.conf", "rc"),
+				symlink("home", "usr/home"),
+				// not a directory, so it is copied
+				file("lib", "lib"),
+			)
+			if err := extractLayer(image, base); err != nil {
+				t.Fatal(err)
+			}
+			if c.left != nil {
+				if err := c.left(dest, outside); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			mounts, err := prepareSharedRootfs(base, c.mode, dest)
+			if c.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, m := range mounts {
+				got = append(got, m.FSType+" "+m.Target+" "+m.Options)
+			}
+			if !reflect.DeepEqual(got, c.mounts) {
+				t.Errorf("mounts %v, want %v", got, c.mounts)
+			}
+			if tree := treeContent(t, dest); !reflect.DeepEqual(tree, c.tree) {
+				t.Errorf("rootfs %v, want %v", tree, c.tree)
+			}
+			assertOutsideIntact(t, outside)
+			assertFile(t, filepath.Join(outside, "secret"), "secret")
+		})
+	}
+}
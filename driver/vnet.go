@@ -0,0 +1,307 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+const (
+	// networkModeVnet gives the jail its own network stack attached to a
+	// bridge of the host
+	networkModeVnet = "vnet"
+
+	defaultBridge = "bridge0"
+)
+
+// vnetLock serializes the creation of bridges and epairs between tasks
+var vnetLock sync.Mutex
+
+// NetworkConfig is the network block of a task, the networking the driver
+// sets up for the jail
+type NetworkConfig struct {
+	Mode   string `codec:"mode"`
+	Bridge string `codec:"bridge"`
+
+	// IPv4 and IPv6 are the addresses of the jail in CIDR notation, IPv4
+	// may also be "dhcp". Both are left empty when ip_pool is set.
+	IPv4 string `codec:"ipv4"`
+	IPv6 string `codec:"ipv6"`
+
+	// Gateway and Gateway6 are the default routes of the jail
+	Gateway  string `codec:"gateway"`
+	Gateway6 string `codec:"gateway6"`
+}
+
+// epairName names the epair of a task, ending in a on the host and b in the
+// jail. It is derived from the task id so a pair left behind by a crash is
+// found again, and short enough for IFNAMSIZ. attempt picks another name
+// when the first is taken by another task.
+func epairName(taskID string, attempt int) string {
+	if attempt > 0 {
+		taskID = fmt.Sprintf("%s/%d", taskID, attempt)
+	}
+	return fmt.Sprintf("jtd%08x", crc32.ChecksumIEEE([]byte(taskID)))
+}
+
+// epairAttempts bounds the names tried for the epair of a task
+const epairAttempts = 8
+
+// epairDescription marks the host end of the epair of a task with its id,
+// telling the pairs a task left behind from those of other tasks
+func epairDescription(taskID string) string {
+	return "jail-task-driver " + taskID
+}
+
+// interfaceDescription parses the description of an interface out of the
+// output of ifconfig
+func interfaceDescription(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "description: ") {
+			return strings.TrimPrefix(line, "description: ")
+		}
+	}
+	return ""
+}
+
+// epairOwner returns the description of the host end of epair, and
+// whether it exists
+func epairOwner(epair string) (string, bool) {
+	if !interfaceExists(epair + "a") {
+		return "", false
+	}
+	out, err := ifconfig(epair + "a")
+	if err != nil {
+		return "", true
+	}
+	return interfaceDescription(out), true
+}
+
+// pickEpair names the epair of a task, skipping the names of pairs owner
+// finds described as another's. It returns whether the pair named was left
+// behind by the task.
+func pickEpair(taskID string, owner func(string) (string, bool)) (string, bool, error) {
+	for attempt := 0; attempt < epairAttempts; attempt++ {
+		epair := epairName(taskID, attempt)
+		desc, exists := owner(epair)
+		if !exists {
+			return epair, false, nil
+		}
+		if desc == epairDescription(taskID) {
+			return epair, true, nil
+		}
+	}
+	return "", false, fmt.Errorf("no free epair name for task %s", taskID)
+}
+
+func interfaceExists(name string) bool {
+	_, err := net.InterfaceByName(name)
+	return err == nil
+}
+
+func ifconfig(args ...string) (string, error) {
+	out, err := exec.Command("ifconfig", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ifconfig %s failed: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ensureBridge creates the bridge unless it exists. Bridges are shared by
+// tasks and may have members added by the administrator, they are never
+// destroyed by the driver.
+func ensureBridge(bridge string) error {
+	if interfaceExists(bridge) {
+		return nil
+	}
+	created, err := ifconfig("bridge", "create")
+	if err != nil {
+		return err
+	}
+	if created != bridge {
+		if _, err := ifconfig(created, "name", bridge); err != nil {
+			ifconfig(created, "destroy")
+			return err
+		}
+	}
+	_, err = ifconfig(bridge, "up")
+	return err
+}
+
+// vnetAddresses resolves the addresses of the jail from the network block
+// or the lease of ip_pool
+func vnetAddresses(nc NetworkConfig, lease *poolLease) (string, string, error) {
+	v4, v6 := nc.IPv4, nc.IPv6
+	if lease != nil {
+		if len(v4) > 0 || len(v6) > 0 {
+			return "", "", fmt.Errorf("network addresses can't be combined with ip_pool")
+		}
+		if lease.IPv4 != nil {
+			v4 = lease.IPv4.String()
+		}
+		if lease.IPv6 != nil {
+			v6 = lease.IPv6.String()
+		}
+	}
+	if len(v4) > 0 && v4 != "dhcp" {
+		if ip, _, err := net.ParseCIDR(v4); err != nil || ip.To4() == nil {
+			return "", "", fmt.Errorf("invalid network ipv4 %q, expected an address/prefix or dhcp", v4)
+		}
+	}
+	if len(v6) > 0 {
+		if ip, _, err := net.ParseCIDR(v6); err != nil || ip.To4() != nil {
+			return "", "", fmt.Errorf("invalid network ipv6 %q, expected an address/prefix", v6)
+		}
+	}
+	if len(nc.Gateway) > 0 && v4 == "dhcp" {
+		return "", "", fmt.Errorf("network gateway is set by dhcp")
+	}
+	if len(nc.Gateway) > 0 && net.ParseIP(nc.Gateway) == nil {
+		return "", "", fmt.Errorf("invalid network gateway %q", nc.Gateway)
+	}
+	if len(nc.Gateway6) > 0 && net.ParseIP(nc.Gateway6) == nil {
+		return "", "", fmt.Errorf("invalid network gateway6 %q", nc.Gateway6)
+	}
+	return v4, v6, nil
+}
+
+// setupVnet implements network mode vnet. The jail gets the b end of an
+// epair whose a end is a member of the bridge, and its addresses and
+// default routes are configured from exec.created, before exec.start runs.
+// It returns the name of the epair, to be destroyed with teardownVnet.
+func setupVnet(params map[string]string, taskID string, nc NetworkConfig, lease *poolLease) (string, error) {
+	switch nc.Mode {
+	case "":
+		return "", nil
+	case networkModeVnet:
+	default:
+		return "", fmt.Errorf("unknown network mode %q", nc.Mode)
+	}
+	if len(params["vnet"]) > 0 || len(params["vnet.interface"]) > 0 {
+		return "", fmt.Errorf("network mode vnet can't be combined with Vnet or Vnet_nic")
+	}
+	if len(params["ip4.addr"]) > 0 || len(params["ip6.addr"]) > 0 {
+		return "", fmt.Errorf("network mode vnet can't be combined with Ip4_addr or Ip6_addr")
+	}
+	if len(params["linux"]) > 0 {
+		return "", fmt.Errorf("network mode vnet needs a FreeBSD userland in the jail to configure its interface")
+	}
+	v4, v6, err := vnetAddresses(nc, lease)
+	if err != nil {
+		return "", err
+	}
+	bridge := nc.Bridge
+	if len(bridge) == 0 {
+		bridge = defaultBridge
+	}
+
+	vnetLock.Lock()
+	defer vnetLock.Unlock()
+
+	if err := ensureBridge(bridge); err != nil {
+		return "", err
+	}
+	epair, leftover, err := pickEpair(taskID, epairOwner)
+	if err != nil {
+		return "", err
+	}
+	if leftover {
+		// left behind by an earlier attempt to start the task
+		if _, err := ifconfig(epair+"a", "destroy"); err != nil {
+			return "", err
+		}
+	}
+	created, err := ifconfig("epair", "create")
+	if err != nil {
+		return "", err
+	}
+	base := strings.TrimSuffix(created, "a")
+	if _, err := ifconfig(base+"a", "name", epair+"a"); err != nil {
+		ifconfig(base+"a", "destroy")
+		return "", err
+	}
+	for _, args := range [][]string{
+		{epair + "a", "description", epairDescription(taskID)},
+		{base + "b", "name", epair + "b"},
+		{bridge, "addm", epair + "a"},
+		{epair + "a", "up"},
+	} {
+		if _, err := ifconfig(args...); err != nil {
+			ifconfig(epair+"a", "destroy")
+			return "", err
+		}
+	}
+
+	params["vnet"] = "new"
+	params["vnet.interface"] = epair + "b"
+
+	params["exec.created"] = vnetCreated(params["name"], epair+"b", v4, v6, nc, params["exec.created"])
+
+	return epair, nil
+}
+
+// vnetCreated returns the exec.created of a vnet jail, configuring iface
+// and the default routes from the host before the exec.created of the task
+func vnetCreated(name, iface, v4, v6 string, nc NetworkConfig, created string) string {
+	cmds := []string{"/sbin/ifconfig lo0 inet 127.0.0.1/8 up", "/sbin/ifconfig " + iface + " up"}
+	switch {
+	case v4 == "dhcp":
+		cmds = append(cmds, "/sbin/dhclient "+iface)
+	case len(v4) > 0:
+		cmds = append(cmds, "/sbin/ifconfig "+iface+" inet "+v4)
+	}
+	if len(nc.Gateway) > 0 {
+		cmds = append(cmds, "/sbin/route -q add -inet default "+nc.Gateway)
+	}
+	if len(v6) > 0 {
+		cmds = append(cmds, "/sbin/ifconfig "+iface+" inet6 -ifdisabled "+v6)
+	}
+	if len(nc.Gateway6) > 0 {
+		cmds = append(cmds, "/sbin/route -q add -inet6 default "+nc.Gateway6)
+	}
+	jexec := "/usr/sbin/jexec " + name + " "
+	for i := range cmds {
+		cmds[i] = jexec + cmds[i]
+	}
+	if len(created) > 0 {
+		cmds = append(cmds, created)
+	}
+	return strings.Join(cmds, " && ")
+}
+
+// teardownVnet destroys the epair of a task, both ends go away with it
+func teardownVnet(epair string) error {
+	if len(epair) == 0 {
+		return nil
+	}
+	vnetLock.Lock()
+	defer vnetLock.Unlock()
+	if !interfaceExists(epair + "a") {
+		return nil
+	}
+	_, err := ifconfig(epair+"a", "destroy")
+	return err
+}
+
+// releaseVnet destroys the epair of the task, once
+func (h *taskHandle) releaseVnet() {
+	h.stateLock.Lock()
+	epair := h.epair
+	h.epair = ""
+	h.stateLock.Unlock()
+
+	if err := teardownVnet(epair); err != nil {
+		h.logger.Warn("failed to destroy task epair", "epair", epair, "error", err)
+	}
+}
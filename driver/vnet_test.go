@@ -0,0 +1,171 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestEpairName(t *testing.T) {
+	a := epairName("0b7a6a3c-46e5-1d2c-8f0e-0c1a2b3c4d5e", 0)
+	if a != epairName("0b7a6a3c-46e5-1d2c-8f0e-0c1a2b3c4d5e", 0) {
+		t.Fatal("the epair of a task should always get the same name")
+	}
+	if a == epairName("0b7a6a3c-46e5-1d2c-8f0e-0c1a2b3c4d5f", 0) {
+		t.Fatal("tasks should get different epairs")
+	}
+	if a == epairName("0b7a6a3c-46e5-1d2c-8f0e-0c1a2b3c4d5e", 1) {
+		t.Fatal("another attempt should get another name")
+	}
+	// IFNAMSIZ is 16 with the terminating nul
+	if len(a+"a") > 15 || !strings.HasPrefix(a, "jtd") {
+		t.Fatalf("invalid epair name %q", a)
+	}
+}
+
+func TestInterfaceDescription(t *testing.T) {
+	out := "jtd1a2b3c4da: flags=8943<UP,BROADCAST,RUNNING,PROMISC,SIMPLEX,MULTICAST> metric 0 mtu 1500\n" +
+		"\tdescription: jail-task-driver web/app/1a2b\n" +
+		"\toptions=8<VLAN_MTU>\n"
+	if got := interfaceDescription(out); got != "jail-task-driver web/app/1a2b" {
+		t.Errorf("interfaceDescription() = %q", got)
+	}
+	if got := interfaceDescription("lo0: flags=8049<UP,LOOPBACK,RUNNING,MULTICAST> metric 0 mtu 16384\n"); got != "" {
+		t.Errorf("interfaceDescription() without one = %q", got)
+	}
+}
+
+func TestPickEpair(t *testing.T) {
+	const task = "web/app/1a2b"
+	first, second := epairName(task, 0), epairName(task, 1)
+	all := make(map[string]string)
+	for i := 0; i < epairAttempts; i++ {
+		all[epairName(task, i)] = "someone else"
+	}
+	cases := []struct {
+		name     string
+		existing map[string]string
+		want     string
+		leftover bool
+	}{
+		{"free", nil, first, false},
+		{"left behind by the task", map[string]string{first: epairDescription(task)}, first, true},
+		{"taken by another task", map[string]string{first: epairDescription("db/app/3c4d")}, second, false},
+		{"taken without description", map[string]string{first: ""}, second, false},
+		{
+			"second left behind",
+			map[string]string{first: epairDescription("db/app/3c4d"), second: epairDescription(task)},
+			second, true,
+		},
+		{"all taken", all, "", false},
+	}
+	for _, c := range cases {
+		got, leftover, err := pickEpair(task, func(epair string) (string, bool) {
+			desc, ok := c.existing[epair]
+			return desc, ok
+		})
+		if (len(c.want) == 0) != (err != nil) || got != c.want || leftover != c.leftover {
+			t.Errorf("%s: got %q, %v, %v, want %q, %v", c.name, got, leftover, err, c.want, c.leftover)
+		}
+	}
+}
+
+func TestVnetAddresses(t *testing.T) {
+	_, v4net, _ := net.ParseCIDR("10.0.0.0/24")
+	_, v6net, _ := net.ParseCIDR("fd00::/64")
+	lease := &poolLease{
+		Interface: "em0",
+		IPv4:      &net.IPNet{IP: net.ParseIP("10.0.0.5").To4(), Mask: v4net.Mask},
+		IPv6:      &net.IPNet{IP: net.ParseIP("fd00::5"), Mask: v6net.Mask},
+	}
+
+	cases := []struct {
+		name   string
+		nc     NetworkConfig
+		lease  *poolLease
+		v4, v6 string
+		err    bool
+	}{
+		{"static", NetworkConfig{IPv4: "10.0.0.5/24", IPv6: "fd00::5/64", Gateway: "10.0.0.1", Gateway6: "fd00::1"}, nil, "10.0.0.5/24", "fd00::5/64", false},
+		{"dhcp", NetworkConfig{IPv4: "dhcp"}, nil, "dhcp", "", false},
+		{"lease", NetworkConfig{Gateway: "10.0.0.1"}, lease, "10.0.0.5/24", "fd00::5/64", false},
+		{"none", NetworkConfig{}, nil, "", "", false},
+		{"lease and addresses", NetworkConfig{IPv4: "10.0.0.6/24"}, lease, "", "", true},
+		{"ipv4 without prefix", NetworkConfig{IPv4: "10.0.0.5"}, nil, "", "", true},
+		{"ipv6 as ipv4", NetworkConfig{IPv4: "fd00::5/64"}, nil, "", "", true},
+		{"ipv4 as ipv6", NetworkConfig{IPv6: "10.0.0.5/24"}, nil, "", "", true},
+		{"dhcp gateway", NetworkConfig{IPv4: "dhcp", Gateway: "10.0.0.1"}, nil, "", "", true},
+		{"invalid gateway", NetworkConfig{IPv4: "10.0.0.5/24", Gateway: "router"}, nil, "", "", true},
+		{"invalid gateway6", NetworkConfig{IPv6: "fd00::5/64", Gateway6: "router"}, nil, "", "", true},
+	}
+	for _, c := range cases {
+		v4, v6, err := vnetAddresses(c.nc, c.lease)
+		if (err != nil) != c.err {
+			t.Errorf("%s: vnetAddresses() error = %v, want error %v", c.name, err, c.err)
+			continue
+		}
+		if v4 != c.v4 || v6 != c.v6 {
+			t.Errorf("%s: vnetAddresses() = %q %q, want %q %q", c.name, v4, v6, c.v4, c.v6)
+		}
+	}
+}
+
+func TestSetupVnetChecksParams(t *testing.T) {
+	cases := []struct {
+		name   string
+		params map[string]string
+		nc     NetworkConfig
+		err    bool
+	}{
+		{"no mode", map[string]string{"vnet": "new"}, NetworkConfig{}, false},
+		{"unknown mode", map[string]string{}, NetworkConfig{Mode: "bridge"}, true},
+		{"vnet param", map[string]string{"vnet": "new"}, NetworkConfig{Mode: networkModeVnet}, true},
+		{"vnet interface param", map[string]string{"vnet.interface": "em1"}, NetworkConfig{Mode: networkModeVnet}, true},
+		{"ip4 param", map[string]string{"ip4.addr": "10.0.0.5"}, NetworkConfig{Mode: networkModeVnet}, true},
+		{"linux jail", map[string]string{"linux": "new"}, NetworkConfig{Mode: networkModeVnet}, true},
+		{"invalid address", map[string]string{}, NetworkConfig{Mode: networkModeVnet, IPv4: "10.0.0.5"}, true},
+	}
+	for _, c := range cases {
+		epair, err := setupVnet(c.params, "task", c.nc, nil)
+		if (err != nil) != c.err {
+			t.Errorf("%s: setupVnet() error = %v, want error %v", c.name, err, c.err)
+		}
+		if len(epair) > 0 {
+			t.Errorf("%s: setupVnet() created %s", c.name, epair)
+		}
+	}
+}
+
+func TestVnetCreated(t *testing.T) {
+	got := vnetCreated("web", "jtd0001b", "10.0.0.5/24", "fd00::5/64",
+		NetworkConfig{Gateway: "10.0.0.1", Gateway6: "fd00::1"}, "/usr/local/bin/setup")
+	want := []string{
+		"/usr/sbin/jexec web /sbin/ifconfig lo0 inet 127.0.0.1/8 up",
+		"/usr/sbin/jexec web /sbin/ifconfig jtd0001b up",
+		"/usr/sbin/jexec web /sbin/ifconfig jtd0001b inet 10.0.0.5/24",
+		"/usr/sbin/jexec web /sbin/route -q add -inet default 10.0.0.1",
+		"/usr/sbin/jexec web /sbin/ifconfig jtd0001b inet6 -ifdisabled fd00::5/64",
+		"/usr/sbin/jexec web /sbin/route -q add -inet6 default fd00::1",
+		"/usr/local/bin/setup",
+	}
+	if got != strings.Join(want, " && ") {
+		t.Errorf("got\n%s\nwant\n%s", got, strings.Join(want, " && "))
+	}
+
+	got = vnetCreated("web", "jtd0001b", "dhcp", "", NetworkConfig{}, "")
+	want = []string{
+		"/usr/sbin/jexec web /sbin/ifconfig lo0 inet 127.0.0.1/8 up",
+		"/usr/sbin/jexec web /sbin/ifconfig jtd0001b up",
+		"/usr/sbin/jexec web /sbin/dhclient jtd0001b",
+	}
+	if got != strings.Join(want, " && ") {
+		t.Errorf("got\n%s\nwant\n%s", got, strings.Join(want, " && "))
+	}
+}
@@ -0,0 +1,244 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// layerSnapshot is the snapshot taken of every unpacked layer
+	layerSnapshot = "layer"
+)
+
+// zfsBackend unpacks every layer into its own dataset stacked on a clone of
+// its parent layer, and gives each task a writable clone of the top layer:
+//
+//	<dataset>/layers/<chain id>@layer    one per layer, cloned from its parent
+//	<dataset>/tasks/<jail name>          clone of the top layer of the image
+type zfsBackend struct {
+	store   *imageStore
+	dataset string
+}
+
+func newZfsBackend(store *imageStore, dataset string) (*zfsBackend, error) {
+	if len(dataset) == 0 {
+		return nil, fmt.Errorf("zfs_dataset is required by the zfs storage backend")
+	}
+	for _, ds := range []string{dataset, dataset + "/layers", dataset + "/tasks"} {
+		if !zfsExists(ds) {
+			if _, err := zfsCmd("create", "-p", ds); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &zfsBackend{store: store, dataset: dataset}, nil
+}
+
+func zfsCmd(args ...string) (string, error) {
+	out, err := exec.Command("zfs", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("zfs %s failed: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func zfsExists(ds string) bool {
+	return exec.Command("zfs", "list", "-H", "-o", "name", ds).Run() == nil
+}
+
+func zfsMountpoint(ds string) (string, error) {
+	return zfsCmd("get", "-H", "-o", "value", "mountpoint", ds)
+}
+
+// chainIDs identifies every layer of img together with the layers below it,
+// so datasets are shared between images with a common base.
+func chainIDs(layers []digest.Digest) []digest.Digest {
+	var chain []digest.Digest
+	var parent digest.Digest
+	for _, l := range layers {
+		id := l
+		if parent != "" {
+			id = digest.FromString(parent.String() + " " + l.String())
+		}
+		chain = append(chain, id)
+		parent = id
+	}
+	return chain
+}
+
+func (b *zfsBackend) layerDataset(chain digest.Digest) string {
+	return b.dataset + "/layers/" + chain.Hex()
+}
+
+func (b *zfsBackend) taskDataset(name string) string {
+	return b.dataset + "/tasks/" + datasetName(name)
+}
+
+func (b *zfsBackend) Unpack(img *imageRecord) (int64, error) {
+	if len(img.Layers) == 0 {
+		return 0, fmt.Errorf("image %s has no layers", img.ID)
+	}
+
+	var size int64
+	var parent string
+	for i, chain := range chainIDs(img.Layers) {
+		ds := b.layerDataset(chain)
+		if zfsExists(ds + "@" + layerSnapshot) {
+			parent = ds
+			continue
+		}
+		if zfsExists(ds) {
+			// left over by an interrupted unpack
+			if _, err := zfsCmd("destroy", "-r", ds); err != nil {
+				return 0, err
+			}
+		}
+
+		var err error
+		if len(parent) == 0 {
+			_, err = zfsCmd("create", ds)
+		} else {
+			_, err = zfsCmd("clone", parent+"@"+layerSnapshot, ds)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if err := b.unpackLayer(ds, img.Layers[i]); err != nil {
+			zfsCmd("destroy", "-r", ds)
+			return 0, err
+		}
+		parent = ds
+	}
+
+	for _, chain := range chainIDs(img.Layers) {
+		used, err := zfsCmd("get", "-Hp", "-o", "value", "used", b.layerDataset(chain))
+		if err != nil {
+			return 0, err
+		}
+		n, _ := strconv.ParseInt(used, 10, 64)
+		size += n
+	}
+	return size, nil
+}
+
+func (b *zfsBackend) unpackLayer(ds string, layer digest.Digest) error {
+	mnt, err := zfsMountpoint(ds)
+	if err != nil {
+		return err
+	}
+	if err := b.store.extractBlob(layer, mnt); err != nil {
+		return err
+	}
+	if _, err := zfsCmd("snapshot", ds+"@"+layerSnapshot); err != nil {
+		return err
+	}
+	_, err = zfsCmd("set", "readonly=on", ds)
+	return err
+}
+
+// CreateRootfs clones the top layer of img. The clone is mounted at dest
+// unless dest already holds files, like the nomad task directory does, in
+// which case the dataset mountpoint is used.
+func (b *zfsBackend) CreateRootfs(img *imageRecord, name, dest string) (string, error) {
+	chain := chainIDs(img.Layers)
+	if len(chain) == 0 {
+		return "", fmt.Errorf("image %s has no layers", img.ID)
+	}
+	top := b.layerDataset(chain[len(chain)-1]) + "@" + layerSnapshot
+	ds := b.taskDataset(name)
+	if zfsExists(ds) {
+		// recovering a task whose jail went away
+		return zfsMountpoint(ds)
+	}
+
+	args := []string{"clone", "-o", "readonly=off"}
+	if isEmptyDir(dest) {
+		args = append(args, "-o", "mountpoint="+dest)
+	}
+	if _, err := zfsCmd(append(args, top, ds)...); err != nil {
+		return "", err
+	}
+	return zfsMountpoint(ds)
+}
+
+// BasePath is the mountpoint of the top layer, which is read only
+func (b *zfsBackend) BasePath(img *imageRecord) (string, error) {
+	chain := chainIDs(img.Layers)
+	if len(chain) == 0 {
+		return "", fmt.Errorf("image %s has no layers", img.ID)
+	}
+	return zfsMountpoint(b.layerDataset(chain[len(chain)-1]))
+}
+
+// SnapshotRootfs snapshots the clone of the jail name, and returns the
+// snapshot directory below its mountpoint
+func (b *zfsBackend) SnapshotRootfs(name string) (string, func(), error) {
+	ds := b.taskDataset(name)
+	if !zfsExists(ds) {
+		// thin and union rootfs are not clones
+		return "", func() {}, nil
+	}
+	mountpoint, err := zfsMountpoint(ds)
+	if err != nil {
+		return "", nil, err
+	}
+	snap := fmt.Sprintf("commit-%d", time.Now().UnixNano())
+	if _, err := zfsCmd("snapshot", ds+"@"+snap); err != nil {
+		return "", nil, err
+	}
+	discard := func() {
+		zfsCmd("destroy", ds+"@"+snap)
+	}
+	return filepath.Join(mountpoint, ".zfs", "snapshot", snap), discard, nil
+}
+
+func (b *zfsBackend) DestroyRootfs(name string) error {
+	ds := b.taskDataset(name)
+	if !zfsExists(ds) {
+		return nil
+	}
+	_, err := zfsCmd("destroy", "-r", "-f", ds)
+	return err
+}
+
+// Remove destroys the layers of img from the top down. Layers still used by
+// other images or tasks have dependent clones, and are kept together with
+// everything below them.
+func (b *zfsBackend) Remove(img *imageRecord) error {
+	chain := chainIDs(img.Layers)
+	for i := len(chain) - 1; i >= 0; i-- {
+		ds := b.layerDataset(chain[i])
+		if !zfsExists(ds) {
+			continue
+		}
+		if _, err := zfsCmd("destroy", "-r", ds); err != nil {
+			b.store.logger.Debug("keeping shared layer", "dataset", ds, "error", err)
+			return nil
+		}
+	}
+	return nil
+}
+
+func isEmptyDir(dir string) bool {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return true
+	}
+	return err == nil && len(entries) == 0
+}
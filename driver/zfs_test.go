@@ -0,0 +1,56 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ *
+ * Copyright (c) 2019, Carlos Neira cneirabustos@gmail.com
+ */
+
+package jail
+
+import (
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestChainIDs(t *testing.T) {
+	base := digest.FromString("base")
+	app := digest.FromString("app")
+	other := digest.FromString("other")
+
+	chain := chainIDs([]digest.Digest{base, app})
+	if len(chain) != 2 || chain[0] != base {
+		t.Fatalf("the bottom layer is its own chain id, got %v", chain)
+	}
+	if chain[1] != digest.FromString(base.String()+" "+app.String()) {
+		t.Fatalf("chain id of app is %s", chain[1])
+	}
+
+	// images with a common base share its datasets, but not the layers
+	// above it
+	shared := chainIDs([]digest.Digest{base, other})
+	if shared[0] != chain[0] || shared[1] == chain[1] {
+		t.Fatalf("got %v and %v", chain, shared)
+	}
+	// the same layer on another base is another dataset
+	if moved := chainIDs([]digest.Digest{other, app}); moved[1] == chain[1] {
+		t.Fatal("app on another base should get another chain id")
+	}
+	if len(chainIDs(nil)) != 0 {
+		t.Fatal("an image without layers has no chain")
+	}
+}
+
+func TestZfsDatasets(t *testing.T) {
+	b := &zfsBackend{dataset: "zroot/jail-task-driver"}
+	layer := digest.FromString("layer")
+	if got := b.layerDataset(layer); got != "zroot/jail-task-driver/layers/"+layer.Hex() {
+		t.Errorf("layerDataset() = %s", got)
+	}
+	if got := b.taskDataset("web-1a2b/task@1 x"); got != "zroot/jail-task-driver/tasks/web-1a2b_task_1_x" {
+		t.Errorf("taskDataset() = %s", got)
+	}
+	if got := datasetName("app:1.0_x-y"); got != "app:1.0_x-y" {
+		t.Errorf("datasetName() = %s", got)
+	}
+}
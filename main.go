@@ -1,12 +1,25 @@
 package main
 
 import (
+	"os"
+
 	"github.com/cneira/jail-task-driver/driver"
 	log "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad/plugins"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "build":
+			os.Exit(jail.Build(os.Args[2:]))
+		case "commit":
+			os.Exit(jail.Commit(os.Args[2:]))
+		case "push":
+			os.Exit(jail.Push(os.Args[2:]))
+		}
+	}
+
 	// Serve the plugin
 	plugins.Serve(factory)
 }